@@ -0,0 +1,61 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/cvmfs/portals/lib"
+	"github.com/cvmfs/portals/log"
+
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(doctorCmd)
+}
+
+var doctorCmd = &cobra.Command{
+	Use:   "doctor",
+	Short: "Check that every portal can reach its buckets and its repository",
+	Args:  cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, arg []string) {
+		config, err := loadConfig(arg[0])
+		if err != nil {
+			log.LogE(err).Error("Error in parsing the configuration file")
+			os.Exit(1)
+		}
+
+		reports := []lib.DoctorReport{}
+		for _, bucketConfiguration := range config.Credentials {
+			reports = append(reports, lib.RunDoctor(bucketConfiguration))
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintf(w, "portal\t%s\n", strings.Join(lib.DoctorChecks, "\t"))
+		for _, report := range reports {
+			results := []string{}
+			for _, check := range report.Checks {
+				results = append(results, check.Result())
+			}
+			fmt.Fprintf(w, "%s\t%s\n", report.Config.Bucket, strings.Join(results, "\t"))
+		}
+		w.Flush()
+
+		failed := false
+		for _, report := range reports {
+			for _, check := range report.Checks {
+				if check.Result() == "FAIL" {
+					fmt.Printf("\n%s %s: %s", report.Config.Bucket, check.Name,
+						log.RedactString(check.Err.Error()))
+				}
+			}
+			failed = failed || report.Failed()
+		}
+		if failed {
+			fmt.Println()
+			os.Exit(1)
+		}
+	},
+}
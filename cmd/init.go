@@ -0,0 +1,62 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/cvmfs/portals/lib"
+	"github.com/cvmfs/portals/log"
+
+	"github.com/spf13/cobra"
+)
+
+var initRepo string
+
+func init() {
+	initCmd.Flags().StringVar(&initRepo, "repo", "", "repository whose portals are initialized")
+	initCmd.MarkFlagRequired("repo")
+	rootCmd.AddCommand(initCmd)
+}
+
+var initCmd = &cobra.Command{
+	Use:   "init",
+	Short: "Create the data and status buckets of the portals of a repository",
+	Args:  cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, arg []string) {
+		config, err := loadConfig(arg[0])
+		if err != nil {
+			log.LogE(err).Error("Error in parsing the configuration file")
+			os.Exit(1)
+		}
+
+		found, failed := false, false
+		for _, bucketConfiguration := range config.Credentials {
+			if bucketConfiguration.CVMFSRepo != initRepo {
+				continue
+			}
+			found = true
+
+			couple, err := lib.NewS3BucketCouple(bucketConfiguration)
+			if err != nil {
+				log.LogE(err).Error("Error in generating the Couple of Buckets")
+				failed = true
+				continue
+			}
+			actions, err := lib.EnsureBuckets(couple, bucketConfiguration)
+			for _, action := range actions {
+				fmt.Println(log.RedactString(action.String()))
+				failed = failed || action.Err != nil
+			}
+			if err != nil {
+				failed = true
+			}
+		}
+		if !found {
+			fmt.Fprintf(os.Stderr, "No portal for the repository %s in %s\n", initRepo, arg[0])
+			os.Exit(1)
+		}
+		if failed {
+			os.Exit(1)
+		}
+	},
+}
@@ -19,7 +19,7 @@ var listFilesCmd = &cobra.Command{
 	Short:   "List the files in the bucket from the config",
 	Args:    cobra.MinimumNArgs(1),
 	Run: func(cmd *cobra.Command, arg []string) {
-		config, err := lib.ParseConfig(arg[0])
+		config, err := loadConfig(arg[0])
 		if err != nil {
 			log.LogE(err).Error("Error in parsing the configuration file")
 			return
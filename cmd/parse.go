@@ -2,6 +2,9 @@ package cmd
 
 import (
 	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
 
 	"github.com/cvmfs/portals/lib"
 	"github.com/cvmfs/portals/log"
@@ -20,11 +23,78 @@ var parseConfigCmd = &cobra.Command{
 	Args:    cobra.MinimumNArgs(1),
 	Run: func(cmd *cobra.Command, arg []string) {
 
-		config, err := lib.ParseConfig(arg[0])
+		config, err := loadConfig(arg[0])
+		if problems, ok := err.(lib.ConfigProblems); ok {
+			fmt.Fprintf(os.Stderr, "Configuration: %s\n", arg[0])
+			for _, problem := range problems {
+				fmt.Fprintf(os.Stderr, "  FAIL  %s\n", log.RedactString(problem))
+			}
+			os.Exit(1)
+		}
 		if err != nil {
 			log.LogE(err).Fatal("Error in parsing the configuration file")
 		}
 
-		fmt.Printf("%#v\n", config)
+		printConfigReport(os.Stdout, arg[0], config)
 	},
 }
+
+// printConfigReport shows what the daemon will do with the configuration,
+// the secrets are never printed
+func printConfigReport(out io.Writer, path string, config lib.Config) {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	defer w.Flush()
+
+	fmt.Fprintf(w, "Configuration:\t%s\tOK\n", path)
+	fmt.Fprintf(w, "spool-dir:\t%s\n", config.SpoolDir)
+	fmt.Fprintf(w, "journal:\t%s\n", config.Journal)
+	if config.Webhook.Enabled() {
+		fmt.Fprintf(w, "webhook:\t%s\n", config.Webhook.Listen)
+	}
+
+	for i, bc := range config.Credentials {
+		redacted := bc.Redacted()
+		fmt.Fprintf(w, "\nPortal %d\n", i+1)
+		row := func(name string, value interface{}) {
+			fmt.Fprintf(w, "  %s:\t%v\n", name, value)
+		}
+		if bc.Backend != "" {
+			row("backend", bc.Backend)
+		}
+		row("bucket", bc.Bucket)
+		row("status-bucket", bc.StatusBucket)
+		row("cvmfs-repo", bc.CVMFSRepo)
+		row("host-url", bc.HostURL)
+		row("region", bc.Region)
+		source := bc.CredentialSource
+		switch source.Type {
+		case lib.CredentialsStatic:
+			row("credentials", fmt.Sprintf("static, access-key %s, secret-key %s",
+				redacted.AccessKey, redacted.SecretKey))
+		case lib.CredentialsFile:
+			row("credentials", "secrets file "+source.Path)
+		case lib.CredentialsProfile:
+			row("credentials", fmt.Sprintf("profile %q", source.Profile))
+		default:
+			row("credentials", source.Type)
+		}
+		if source.AssumeRole != nil {
+			row("assume-role", source.AssumeRole.RoleARN)
+		}
+		row("tag-template", bc.TagTemplate)
+		row("path-mapping", fmt.Sprintf("%d rules", len(bc.PathMapping)))
+		row("acl", fmt.Sprintf("%d rules", len(bc.ACL)))
+		row("signature", bc.Signature.Enabled())
+		row("completion-marker", bc.CompletionMarker)
+		row("quiet-period", bc.QuietPeriod.Duration)
+		row("order", bc.Order)
+		row("priority", fmt.Sprintf("%d rules", len(bc.Priorities)))
+		row("streaming", bc.Streaming)
+		row("spool-dir", bc.SpoolDir)
+		row("download", fmt.Sprintf("parts of %d bytes, %d at a time",
+			bc.DownloadPartSize, bc.DownloadConcurrency))
+		row("poll-interval", fmt.Sprintf("%s, up to %s when idle",
+			bc.PollInterval.Duration, bc.MaxPollInterval.Duration))
+		row("full-rescan-interval", bc.FullRescanInterval.Duration)
+	}
+}
@@ -18,7 +18,7 @@ var pingCmd = &cobra.Command{
 	Short: "Start a PING subprocess against the status buckets",
 	Args:  cobra.MinimumNArgs(1),
 	Run: func(cmd *cobra.Command, arg []string) {
-		config, err := lib.ParseConfig(arg[0])
+		config, err := loadConfig(arg[0])
 		if err != nil {
 			log.LogE(err).Error("Error in parsing the configuration file")
 			return
@@ -33,7 +33,7 @@ var pingCmd = &cobra.Command{
 			wg.Add(1)
 			go func() {
 				defer wg.Done()
-				lib.UploadPingToStatusBucket(couple)
+				lib.UploadPingToStatusBucket(couple, nil)
 			}()
 		}
 		wg.Wait()
@@ -1,16 +1,12 @@
 package cmd
 
 import (
-	"fmt"
-	"strings"
 	"sync"
 
 	"github.com/cvmfs/portals/cvmfs"
 	"github.com/cvmfs/portals/lib"
 	"github.com/cvmfs/portals/log"
 
-	"github.com/aws/aws-sdk-go/service/s3"
-
 	"github.com/spf13/cobra"
 )
 
@@ -23,58 +19,85 @@ var portalsCmd = &cobra.Command{
 	Short: "Start the portals",
 	Args:  cobra.MinimumNArgs(1),
 	Run: func(cmd *cobra.Command, arg []string) {
-		config, err := lib.ParseConfig(arg[0])
+		config, err := loadConfig(arg[0])
 		if err != nil {
 			log.LogE(err).Error("Error in parsing the configuration file")
 			return
 		}
 
-		var wg sync.WaitGroup
-		for _, bucketConfiguration := range config.Credentials {
+		for _, dir := range config.SpoolDirs() {
+			if err := lib.PrepareSpoolDir(dir); err != nil {
+				log.LogE(err).Error("Error in creating the spool directory")
+				return
+			}
+			lib.SweepSpool(dir)
+		}
 
+		journal, err := lib.OpenJournal(config.Journal)
+		if err != nil {
+			log.LogE(err).Error("Error in opening the journal")
+			return
+		}
+		defer journal.Close()
+
+		var receiver *lib.WebhookReceiver
+		if config.Webhook.Enabled() {
+			receiver = lib.NewWebhookReceiver(config.Webhook)
+		}
+
+		// all the interrupted ingestions are resumed before any portal
+		// starts, the transactions left open by the crash are aborted and
+		// they must not be confused with the ones of the running portals
+		type resumed struct {
+			configuration lib.BucketConfiguration
+			couple        lib.S3BucketCouple
+			repo          cvmfs.Repo
+		}
+		portals := []resumed{}
+		for _, bucketConfiguration := range config.Credentials {
 			couple, err := lib.NewS3BucketCouple(bucketConfiguration)
 			repo := cvmfs.NewRepo(bucketConfiguration.CVMFSRepo)
 			if err != nil {
 				log.LogE(err).Error("Error in generating the Couple of Buckets")
 				continue
 			}
+			if bucketConfiguration.CreateBuckets {
+				actions, err := lib.EnsureBuckets(couple, bucketConfiguration)
+				for _, action := range actions {
+					log.Log().WithField("bucket", action.Bucket).Info(action.String())
+				}
+				if err != nil {
+					log.LogE(err).Error("Error in creating the buckets")
+					continue
+				}
+			}
+			lib.ResumeInterrupted(journal, couple, &repo)
+			portals = append(portals, resumed{bucketConfiguration, couple, repo})
+		}
+
+		var wg sync.WaitGroup
+		for _, r := range portals {
+			r := r
 
+			portal := lib.NewPortal(&r.configuration, r.couple, &r.repo, journal)
+			if receiver != nil {
+				receiver.Register(portal)
+			}
 			wg.Add(1)
 			go func() {
+				defer wg.Done()
+				portal.Run()
+			}()
+			go lib.UploadPingToStatusBucket(r.couple, portal.Health)
+		}
 
-				for {
-					inputChan, outputChan := lib.NewPipeline()
-
-					b := couple.Data
-					objectChan := make(chan s3.Object, 10)
-
-					b.SpoolAllObject(nil, objectChan)
-
-					go func() {
-						for object := range objectChan {
-							fmt.Println(*object.Key)
-							keySplitted := strings.Split(*object.Key, ".")
-							if keySplitted[len(keySplitted)-1] == "tar" {
-								s3o := lib.NewS3Object(
-									couple.Data.BucketName,
-									couple.Status.BucketName,
-									object,
-									&couple.Status.Session,
-									&repo)
-								inputChan <- s3o
-							}
-						}
-						close(inputChan)
-					}()
-
-					for output := range outputChan {
-						fmt.Println(output)
-					}
+		if receiver != nil {
+			go func() {
+				if err := receiver.ListenAndServe(); err != nil {
+					log.LogE(err).Error("Error in the webhook, relying only on the full listings")
 				}
 			}()
-
 		}
 		wg.Wait()
-
 	},
 }
@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/cvmfs/portals/lib"
+	"github.com/cvmfs/portals/log"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	rollbackRepo   string
+	rollbackKey    string
+	rollbackHash   string
+	rollbackDryRun bool
+	rollbackYes    bool
+)
+
+func init() {
+	rollbackCmd.Flags().StringVar(&rollbackRepo, "repo", "", "CVMFS repository to rollback")
+	rollbackCmd.Flags().StringVar(&rollbackKey, "key", "", "key of the object whose ingestion should be reverted")
+	rollbackCmd.Flags().StringVar(&rollbackHash, "hash", "", "hash of the ingestion, if the key was ingested more times, default to the most recent")
+	rollbackCmd.Flags().BoolVar(&rollbackDryRun, "dry-run", false, "only show what would be rolled back")
+	rollbackCmd.Flags().BoolVarP(&rollbackYes, "yes", "y", false, "do not ask for confirmation")
+	rollbackCmd.MarkFlagRequired("repo")
+	rollbackCmd.MarkFlagRequired("key")
+	rootCmd.AddCommand(rollbackCmd)
+}
+
+var rollbackCmd = &cobra.Command{
+	Use:   "rollback",
+	Short: "Revert the repository to before the ingestion of an object",
+	Args:  cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, arg []string) {
+		config, err := loadConfig(arg[0])
+		if err != nil {
+			log.LogE(err).Fatal("Error in parsing the configuration file")
+		}
+
+		var bucketConfiguration *lib.BucketConfiguration
+		for i, bc := range config.Credentials {
+			if bc.CVMFSRepo == rollbackRepo {
+				bucketConfiguration = &config.Credentials[i]
+				break
+			}
+		}
+		if bucketConfiguration == nil {
+			log.Log().Fatal("No portal configured for the repository ", rollbackRepo)
+		}
+
+		couple, err := lib.NewS3BucketCouple(*bucketConfiguration)
+		if err != nil {
+			log.LogE(err).Fatal("Error in generating the Couple of Buckets")
+		}
+
+		plan, err := lib.PlanRollback(couple, rollbackRepo, rollbackKey, rollbackHash)
+		if err != nil {
+			log.LogE(err).Fatal("Error in planning the rollback")
+		}
+
+		fmt.Print(plan)
+		if rollbackDryRun {
+			return
+		}
+		if !rollbackYes && !askConfirmation("Proceed with the rollback?") {
+			fmt.Println("Rollback aborted")
+			return
+		}
+
+		err = plan.Execute(couple)
+		if err != nil {
+			log.LogE(err).Fatal("Error in executing the rollback")
+		}
+		fmt.Println("Rollback completed")
+	},
+}
+
+func askConfirmation(question string) bool {
+	fmt.Printf("%s [y/N] ", question)
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return false
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
@@ -1,6 +1,8 @@
 package cmd
 
 import (
+	"github.com/cvmfs/portals/lib"
+
 	"github.com/spf13/cobra"
 )
 
@@ -15,3 +17,11 @@ var rootCmd = &cobra.Command{
 func EntryPoint() {
 	rootCmd.Execute()
 }
+
+// loadConfig parses the configuration file and keeps its secrets out of the
+// logs, also when the configuration has problems
+func loadConfig(path string) (lib.Config, error) {
+	config, err := lib.ParseConfig(path)
+	config.RegisterSecrets()
+	return config, err
+}
@@ -0,0 +1,50 @@
+package cvmfs
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+)
+
+// CheckRepository verifies that the repository is a stratum 0 on this
+// machine and that the current user can open transactions on it
+func CheckRepository(CVMFSRepo string) error {
+	if CVMFSRepo == "" {
+		return fmt.Errorf("No repository configured")
+	}
+	serverConf := filepath.Join("/", "etc", "cvmfs", "repositories.d", CVMFSRepo, "server.conf")
+	f, err := os.Open(serverConf)
+	if err != nil {
+		return fmt.Errorf("The repository %s is not hosted on this machine: %s", CVMFSRepo, err)
+	}
+	defer f.Close()
+
+	owner := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "CVMFS_USER=") {
+			owner = strings.Trim(strings.TrimPrefix(line, "CVMFS_USER="), `"'`)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return fmt.Errorf("Error in reading %s: %s", serverConf, err)
+	}
+
+	if _, err = os.Stat(filepath.Join("/", "cvmfs", CVMFSRepo)); err != nil {
+		return fmt.Errorf("The repository %s is not mounted: %s", CVMFSRepo, err)
+	}
+
+	current, err := user.Current()
+	if err != nil {
+		return fmt.Errorf("Impossible to know the current user: %s", err)
+	}
+	if owner != "" && current.Uid != "0" && current.Username != owner {
+		return fmt.Errorf("The repository %s is owned by %s, the portals run as %s",
+			CVMFSRepo, owner, current.Username)
+	}
+	return nil
+}
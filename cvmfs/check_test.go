@@ -0,0 +1,22 @@
+package cvmfs
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckRepository(t *testing.T) {
+	tests := []struct {
+		repo string
+		err  string
+	}{
+		{"", "No repository configured"},
+		{"missing.portals.test", "is not hosted on this machine"},
+	}
+	for _, test := range tests {
+		err := CheckRepository(test.repo)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%q: expected an error containing %q, got %v", test.repo, test.err, err)
+		}
+	}
+}
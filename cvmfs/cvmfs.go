@@ -8,7 +8,6 @@ import (
 	"os/exec"
 	"path/filepath"
 	"strings"
-	"sync"
 
 	"github.com/cvmfs/portals/log"
 
@@ -128,30 +127,37 @@ func ExecCommand(input ...string) *execCmd {
 }
 
 func (e *execCmd) Start() error {
+	_, err := e.Output()
+	return err
+}
+
+// Output runs the command, as Start does, and returns what the command wrote
+// on its STDOUT
+func (e *execCmd) Output() ([]byte, error) {
 	l := log.Decorate(map[string]string{
 		"Action": "executing command",
 	})
 	if e == nil {
 		err := fmt.Errorf("Use of nil execCmd")
 		l(log.LogE(err)).Error("Call start with nil cmd, maybe error in the constructor")
-		return err
+		return nil, err
 	}
 
 	err := e.cmd.Start()
 	if err != nil {
 		l(log.LogE(err)).Error("Error in starting the command")
-		return err
+		return nil, err
 	}
 
 	slurpOut, errOUT := ioutil.ReadAll(e.out)
 	if errOUT != nil {
 		l(log.LogE(errOUT)).Warning("Impossible to read the STDOUT")
-		return err
+		return nil, err
 	}
 	slurpErr, errERR := ioutil.ReadAll(e.err)
 	if errERR != nil {
 		l(log.LogE(errERR)).Warning("Impossible to read the STDERR")
-		return err
+		return nil, err
 	}
 
 	err = e.cmd.Wait()
@@ -159,9 +165,9 @@ func (e *execCmd) Start() error {
 		l(log.LogE(err)).Error("Error in executing the command")
 		l(log.Log()).WithFields(logrus.Fields{"pipe": "STDOUT"}).Info(string(slurpOut))
 		l(log.Log()).WithFields(logrus.Fields{"pipe": "STDERR"}).Info(string(slurpErr))
-		return err
+		return slurpOut, err
 	}
-	return nil
+	return slurpOut, nil
 }
 
 type RemoteTar interface {
@@ -222,10 +228,11 @@ func IngestTar(CVMFSRepo string, tar IngestableTar) IngestionResult {
 
 type Repo struct {
 	Name string
-	Lock sync.Mutex
+	// serializes the operations on the repository, the higher priority
+	// waiters get it first
+	Lock *PriorityLock
 }
 
 func NewRepo(name string) Repo {
-	m := &sync.Mutex{}
-	return Repo{name, *m}
+	return Repo{name, NewPriorityLock()}
 }
@@ -0,0 +1,78 @@
+package cvmfs
+
+import (
+	"container/heap"
+	"sync"
+)
+
+// PriorityLock is a mutex that, when released, is handed to the waiter with
+// the highest priority, waiters with the same priority get it in the order
+// they asked for it
+type PriorityLock struct {
+	mutex   sync.Mutex
+	locked  bool
+	waiters lockWaiters
+	counter uint64
+}
+
+type lockWaiter struct {
+	priority int
+	sequence uint64
+	ready    chan struct{}
+}
+
+type lockWaiters []lockWaiter
+
+func (w lockWaiters) Len() int { return len(w) }
+func (w lockWaiters) Less(i, j int) bool {
+	if w[i].priority != w[j].priority {
+		return w[i].priority > w[j].priority
+	}
+	return w[i].sequence < w[j].sequence
+}
+func (w lockWaiters) Swap(i, j int)       { w[i], w[j] = w[j], w[i] }
+func (w *lockWaiters) Push(x interface{}) { *w = append(*w, x.(lockWaiter)) }
+func (w *lockWaiters) Pop() interface{} {
+	old := *w
+	n := len(old)
+	x := old[n-1]
+	*w = old[:n-1]
+	return x
+}
+
+func NewPriorityLock() *PriorityLock {
+	return &PriorityLock{}
+}
+
+// Lock acquires the lock with the default priority, zero
+func (l *PriorityLock) Lock() {
+	l.LockWithPriority(0)
+}
+
+func (l *PriorityLock) LockWithPriority(priority int) {
+	l.mutex.Lock()
+	if !l.locked {
+		l.locked = true
+		l.mutex.Unlock()
+		return
+	}
+	waiter := lockWaiter{priority: priority, sequence: l.counter, ready: make(chan struct{})}
+	l.counter++
+	heap.Push(&l.waiters, waiter)
+	l.mutex.Unlock()
+
+	// the lock is handed to us already locked
+	<-waiter.ready
+}
+
+func (l *PriorityLock) Unlock() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.waiters.Len() == 0 {
+		l.locked = false
+		return
+	}
+	waiter := heap.Pop(&l.waiters).(lockWaiter)
+	close(waiter.ready)
+}
@@ -0,0 +1,96 @@
+package cvmfs
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"syscall"
+
+	"github.com/cvmfs/portals/log"
+)
+
+// StreamingIngest is a `cvmfs_server ingest` reading the tarball from its
+// STDIN, the caller writes the tarball into it and then either finishes or
+// aborts the ingestion
+type StreamingIngest struct {
+	repo   string
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	output bytes.Buffer
+}
+
+func StartStreamingIngest(CVMFSRepo, baseDir, tagName, tagDescription string) (*StreamingIngest, error) {
+	input := []string{"cvmfs_server", "ingest",
+		"-t", "-",
+		"-b", baseDir,
+		"-a", tagName,
+		"-m", tagDescription,
+		CVMFSRepo}
+	l := log.Decorate(map[string]string{
+		"Action":  "streaming ingest",
+		"Command": strings.Join(input, " "),
+	})
+	l(log.Log()).Info("Start")
+
+	s := &StreamingIngest{repo: CVMFSRepo, cmd: exec.Command(input[0], input[1:]...)}
+	// both pipes in the same buffer, they are read while we write the
+	// STDIN so the command never blocks on its output
+	s.cmd.Stdout = &s.output
+	s.cmd.Stderr = &s.output
+	// cvmfs_server is a script, in its own process group all its children
+	// can be killed together
+	s.cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	stdin, err := s.cmd.StdinPipe()
+	if err != nil {
+		l(log.LogE(err)).Error("Impossible to obtain the STDIN pipe")
+		return nil, err
+	}
+	s.stdin = stdin
+	if err = s.cmd.Start(); err != nil {
+		l(log.LogE(err)).Error("Error in starting the command")
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *StreamingIngest) Write(p []byte) (int, error) {
+	return s.stdin.Write(p)
+}
+
+// Finish closes the STDIN and waits for the ingestion to complete
+func (s *StreamingIngest) Finish() error {
+	s.stdin.Close()
+	return s.wait()
+}
+
+// Abort kills the ingestion while the tarball is still incomplete and then
+// aborts the transaction that the ingestion may have left open, so that
+// nothing is published.
+// If the ingestion completed anyway its revision is rolled back, and Abort
+// returns an error in any case
+func (s *StreamingIngest) Abort() error {
+	s.stdin.Close()
+	// it fails only if the processes already exited
+	syscall.Kill(-s.cmd.Process.Pid, syscall.SIGKILL)
+	if err := s.cmd.Wait(); err != nil {
+		return ExecCommand("cvmfs_server", "abort", "-f", s.repo).Start()
+	}
+
+	// the repository is locked during the ingestion, trunk-previous is the
+	// revision just before it
+	if err := Rollback(s.repo, "trunk-previous"); err != nil {
+		return fmt.Errorf("The ingestion completed before it could be aborted and it could not be rolled back: %s", err)
+	}
+	return fmt.Errorf("The ingestion completed before it could be aborted, it was rolled back")
+}
+
+func (s *StreamingIngest) wait() error {
+	err := s.cmd.Wait()
+	if err != nil {
+		l := log.Decorate(map[string]string{"Action": "streaming ingest"})
+		l(log.LogE(err)).WithField("output", s.output.String()).Error("Error in executing the command")
+	}
+	return err
+}
@@ -0,0 +1,100 @@
+package cvmfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeCVMFSServer puts in the PATH a cvmfs_server that runs ingest as
+// provided and records every other command in the log file
+func fakeCVMFSServer(t *testing.T, ingest string) (log string, cleanup func()) {
+	dir, err := ioutil.TempDir("", "fake-cvmfs-server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	log = filepath.Join(dir, "log")
+	script := "#!/bin/sh\n" +
+		"if [ \"$1\" = ingest ]; then\n" + ingest + "\nfi\n" +
+		"echo \"$@\" >> " + log + "\n"
+	err = ioutil.WriteFile(filepath.Join(dir, "cvmfs_server"), []byte(script), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+path)
+	return log, func() {
+		os.Setenv("PATH", path)
+		os.RemoveAll(dir)
+	}
+}
+
+func TestStreamingIngestFinish(t *testing.T) {
+	log, cleanup := fakeCVMFSServer(t, "cat > /dev/null; exit 0")
+	defer cleanup()
+
+	s, err := StartStreamingIngest("repo.example.org", "/", "tag", "description")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Write([]byte("tarball"))
+	if err := s.Finish(); err != nil {
+		t.Errorf("unexpected error %s", err)
+	}
+	if content, _ := ioutil.ReadFile(log); len(content) != 0 {
+		t.Errorf("unexpected commands %q", content)
+	}
+}
+
+func TestStreamingIngestAbort(t *testing.T) {
+	tests := []struct {
+		name   string
+		ingest string
+		err    bool
+		abort  bool
+		// the ingestion completed, its revision is rolled back
+		rollback bool
+	}{
+		// an ingestion that would go on even without its STDIN
+		{"stuck", "sleep 60", false, true, false},
+		{"failing", "cat > /dev/null; exit 1", false, true, false},
+		{"completed", "touch " + "$(dirname $0)/completed; exit 0", true, false, true},
+	}
+	for _, test := range tests {
+		log, cleanup := fakeCVMFSServer(t, test.ingest)
+		s, err := StartStreamingIngest("repo.example.org", "/", "tag", "description")
+		if err != nil {
+			cleanup()
+			t.Fatal(err)
+		}
+		if test.name == "completed" {
+			// let it complete before the abort
+			completed := filepath.Join(filepath.Dir(log), "completed")
+			for i := 0; i < 100; i++ {
+				if _, err := os.Stat(completed); err == nil {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		err = s.Abort()
+		content, _ := ioutil.ReadFile(log)
+		cleanup()
+
+		if (err != nil) != test.err {
+			t.Errorf("%s: expected error %t, got %v", test.name, test.err, err)
+		}
+		aborted := strings.Contains(string(content), "abort -f repo.example.org")
+		if aborted != test.abort {
+			t.Errorf("%s: expected the transaction aborted %t, commands %q", test.name, test.abort, content)
+		}
+		rolledBack := strings.Contains(string(content), "rollback -t trunk-previous -f repo.example.org")
+		if rolledBack != test.rollback {
+			t.Errorf("%s: expected the ingestion rolled back %t, commands %q", test.name, test.rollback, content)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package cvmfs
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Tag is a named snapshot of a CVMFS repository, as reported by
+// `cvmfs_server tag -l -x`
+type Tag struct {
+	Name        string
+	RootHash    string
+	Size        int64
+	Revision    int
+	Timestamp   int64
+	Channel     string
+	Description string
+}
+
+var invalidTagCharacters = regexp.MustCompile(`[^a-zA-Z0-9_.\-]`)
+
+// SanitizeTagName replaces all the characters that CVMFS does not accept in a
+// tag name with an underscore
+func SanitizeTagName(name string) string {
+	return invalidTagCharacters.ReplaceAllString(name, "_")
+}
+
+// ListTags returns all the tags of the repository
+func ListTags(CVMFSRepo string) ([]Tag, error) {
+	out, err := ExecCommand("cvmfs_server", "tag", "-l", "-x", CVMFSRepo).Output()
+	if err != nil {
+		return nil, err
+	}
+	tags := []Tag{}
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		tag, err := parseMachineReadableTag(line)
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+	return tags, nil
+}
+
+// GetTag returns the tag of the repository with the name provided
+func GetTag(CVMFSRepo, name string) (Tag, error) {
+	tags, err := ListTags(CVMFSRepo)
+	if err != nil {
+		return Tag{}, err
+	}
+	for _, tag := range tags {
+		if tag.Name == name {
+			return tag, nil
+		}
+	}
+	return Tag{}, fmt.Errorf("Tag %s not found in repository %s", name, CVMFSRepo)
+}
+
+// the machine readable format is:
+// name root_hash size revision timestamp channel description
+// where only the description may contain spaces
+func parseMachineReadableTag(line string) (tag Tag, err error) {
+	fields := strings.SplitN(strings.TrimSpace(line), " ", 7)
+	if len(fields) < 6 {
+		err = fmt.Errorf("Impossible to parse the tag line: %s", line)
+		return
+	}
+	tag.Name = fields[0]
+	tag.RootHash = fields[1]
+	tag.Size, err = strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		err = fmt.Errorf("Impossible to parse the size of the tag %s: %s", tag.Name, err)
+		return
+	}
+	tag.Revision, err = strconv.Atoi(fields[3])
+	if err != nil {
+		err = fmt.Errorf("Impossible to parse the revision of the tag %s: %s", tag.Name, err)
+		return
+	}
+	tag.Timestamp, err = strconv.ParseInt(fields[4], 10, 64)
+	if err != nil {
+		err = fmt.Errorf("Impossible to parse the timestamp of the tag %s: %s", tag.Name, err)
+		return
+	}
+	tag.Channel = fields[5]
+	if len(fields) == 7 {
+		tag.Description = fields[6]
+	}
+	return
+}
+
+// Rollback re-publishes the revision of the repository pointed by the tag,
+// all the tags after it are removed
+func Rollback(CVMFSRepo, tagName string) error {
+	return ExecCommand("cvmfs_server", "rollback", "-t", tagName, "-f", CVMFSRepo).Start()
+}
@@ -0,0 +1,58 @@
+package cvmfs
+
+import "testing"
+
+func TestSanitizeTagName(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{"portal-foo.tar-abc", "portal-foo.tar-abc"},
+		{"portal-dir/foo.tar", "portal-dir_foo.tar"},
+		{"with space:and+plus", "with_space_and_plus"},
+		{"", ""},
+	}
+	for _, test := range tests {
+		if got := SanitizeTagName(test.name); got != test.expected {
+			t.Errorf("SanitizeTagName(%q) = %q, expected %q", test.name, got, test.expected)
+		}
+	}
+}
+
+func TestParseMachineReadableTag(t *testing.T) {
+	tests := []struct {
+		line     string
+		expected Tag
+		fails    bool
+	}{
+		{
+			line: "portal-a 1a2b3c 4096 7 1546300800 0 Ingestion of a.tar",
+			expected: Tag{Name: "portal-a", RootHash: "1a2b3c", Size: 4096, Revision: 7,
+				Timestamp: 1546300800, Channel: "0", Description: "Ingestion of a.tar"},
+		},
+		{
+			line: "trunk 1a2b3c 4096 8 1546300801 0",
+			expected: Tag{Name: "trunk", RootHash: "1a2b3c", Size: 4096, Revision: 8,
+				Timestamp: 1546300801, Channel: "0"},
+		},
+		{line: "trunk 1a2b3c 4096", fails: true},
+		{line: "trunk 1a2b3c size 8 1546300801 0", fails: true},
+		{line: "trunk 1a2b3c 4096 eight 1546300801 0", fails: true},
+	}
+	for _, test := range tests {
+		tag, err := parseMachineReadableTag(test.line)
+		if test.fails {
+			if err == nil {
+				t.Errorf("parseMachineReadableTag(%q) did not fail", test.line)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseMachineReadableTag(%q) failed: %s", test.line, err)
+			continue
+		}
+		if tag != test.expected {
+			t.Errorf("parseMachineReadableTag(%q) = %+v, expected %+v", test.line, tag, test.expected)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package cvmfs
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/cvmfs/portals/log"
+)
+
+// TarToExtract is a tarball and the directory of the repository where to
+// extract it
+type TarToExtract struct {
+	Path    string
+	BaseDir string
+}
+
+// IngestInTransaction extracts all the tarballs, in order, in a single
+// transaction that is published with the tag provided, if anything goes
+// wrong the transaction is aborted and nothing is published
+func IngestInTransaction(CVMFSRepo string, tars []TarToExtract, tagName, tagDescription string) error {
+	l := log.Decorate(map[string]string{
+		"Action":     "ingest in transaction",
+		"repository": CVMFSRepo,
+	})
+	err := ExecCommand("cvmfs_server", "transaction", CVMFSRepo).Start()
+	if err != nil {
+		l(log.LogE(err)).Error("Error in opening the transaction")
+		return err
+	}
+
+	for _, tar := range tars {
+		destination := filepath.Join("/", "cvmfs", CVMFSRepo, tar.BaseDir)
+		err = os.MkdirAll(destination, 0755)
+		if err == nil {
+			err = ExecCommand("tar", "-xf", tar.Path, "-C", destination).Start()
+		}
+		if err != nil {
+			l(log.LogE(err)).WithField("tar", tar.Path).Error("Error in extracting the tar, aborting the transaction")
+			ExecCommand("cvmfs_server", "abort", "-f", CVMFSRepo).Start()
+			return err
+		}
+	}
+
+	err = ExecCommand("cvmfs_server", "publish", "-a", tagName, "-m", tagDescription, CVMFSRepo).Start()
+	if err != nil {
+		l(log.LogE(err)).Error("Error in publishing the transaction, aborting it")
+		ExecCommand("cvmfs_server", "abort", "-f", CVMFSRepo).Start()
+		return err
+	}
+	return nil
+}
+
+// AbortTransaction aborts the transaction open on the repository, like the
+// one left open by an ingestion interrupted by a crash, it fails if there is
+// no transaction to abort
+func AbortTransaction(CVMFSRepo string) error {
+	return ExecCommand("cvmfs_server", "abort", "-f", CVMFSRepo).Start()
+}
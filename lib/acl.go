@@ -0,0 +1,143 @@
+package lib
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// ACLRule restricts where in the repository the objects are allowed to be
+// ingested.
+//
+// A rule applies to an object if the owner of the object is Owner (either
+// the ID or the display name) and if the key of the object starts with
+// Prefix, an empty Owner or Prefix matches everything.
+// The objects the rule applies to can be ingested only inside one of the
+// Paths subtrees of the repository.
+type ACLRule struct {
+	Owner  string   `toml:"owner"`
+	Prefix string   `toml:"prefix"`
+	Paths  []string `toml:"paths"`
+}
+
+func (rule ACLRule) String() string {
+	return fmt.Sprintf("owner=%q prefix=%q paths=%q", rule.Owner, rule.Prefix, rule.Paths)
+}
+
+func (rule ACLRule) Validate() error {
+	if len(rule.Paths) == 0 {
+		return fmt.Errorf("ACL rule without paths: %s", rule)
+	}
+	for _, p := range rule.Paths {
+		if err := validateRelativePath(strings.TrimPrefix(p, "/")); err != nil {
+			return fmt.Errorf("Invalid path in ACL rule %s: %s", rule, err)
+		}
+	}
+	return nil
+}
+
+func (rule ACLRule) appliesTo(owner ObjectOwner, key string) bool {
+	if rule.Owner != "" && rule.Owner != owner.ID && rule.Owner != owner.DisplayName {
+		return false
+	}
+	return strings.HasPrefix(key, rule.Prefix)
+}
+
+func (rule ACLRule) allows(cvmfsPath string) bool {
+	for _, p := range rule.Paths {
+		allowed := cleanDirectory(strings.Trim(p, "/"))
+		if allowed == "" || cvmfsPath == allowed || strings.HasPrefix(cvmfsPath, allowed+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// ObjectOwner is who uploaded the object, it comes from the Owner field of
+// the listing or, if the backend does not provide it, from the owner
+// metadata of the object
+type ObjectOwner struct {
+	ID          string
+	DisplayName string
+}
+
+func NewObjectOwner(owner *s3.Owner) ObjectOwner {
+	o := ObjectOwner{}
+	if owner == nil {
+		return o
+	}
+	if owner.ID != nil {
+		o.ID = *owner.ID
+	}
+	if owner.DisplayName != nil {
+		o.DisplayName = *owner.DisplayName
+	}
+	return o
+}
+
+// readOwner asks the bucket for the owner of the object, for the objects that
+// do not come from a listing
+func readOwner(session *session.Session, bucket, key string) (*s3.Owner, error) {
+	acl, err := s3.New(session).GetObjectAcl(&s3.GetObjectAclInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Error in reading the ACL of the object: %s", err)
+	}
+	if NewObjectOwner(acl.Owner).IsEmpty() {
+		return nil, fmt.Errorf("The ACL of the object has no owner")
+	}
+	return acl.Owner, nil
+}
+
+// hasOwnerRules is true if some rule depends on the owner of the objects
+func hasOwnerRules(rules []ACLRule) bool {
+	for _, rule := range rules {
+		if rule.Owner != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func (o ObjectOwner) IsEmpty() bool {
+	return o.ID == "" && o.DisplayName == ""
+}
+
+func (o ObjectOwner) String() string {
+	if o.DisplayName != "" && o.DisplayName != o.ID {
+		return fmt.Sprintf("%s (%s)", o.DisplayName, o.ID)
+	}
+	return o.ID
+}
+
+// CheckACL returns an error stating the violated rule if the object cannot be
+// ingested in cvmfsPath, without rules everything is allowed
+func CheckACL(rules []ACLRule, owner ObjectOwner, key, cvmfsPath string) error {
+	if len(rules) == 0 {
+		return nil
+	}
+	applied := []ACLRule{}
+	for _, rule := range rules {
+		if !rule.appliesTo(owner, key) {
+			continue
+		}
+		if rule.allows(cvmfsPath) {
+			return nil
+		}
+		applied = append(applied, rule)
+	}
+	if len(applied) == 0 {
+		return fmt.Errorf("No ACL rule allows the owner %s to write the key %s", owner, key)
+	}
+	violated := []string{}
+	for _, rule := range applied {
+		violated = append(violated, rule.String())
+	}
+	return fmt.Errorf("The object %s of the owner %s would be ingested in /%s, not allowed by the ACL rules: %s",
+		key, owner, cvmfsPath, strings.Join(violated, "; "))
+}
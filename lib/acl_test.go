@@ -0,0 +1,83 @@
+package lib
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestCheckACL(t *testing.T) {
+	rules := []ACLRule{
+		{Owner: "alice", Prefix: "alice/", Paths: []string{"/sw/alice"}},
+		{Owner: "id-bob", Prefix: "", Paths: []string{"sw/bob", "/data/bob/"}},
+		{Owner: "", Prefix: "public/", Paths: []string{"public"}},
+	}
+	alice := ObjectOwner{ID: "id-alice", DisplayName: "alice"}
+	bob := ObjectOwner{ID: "id-bob", DisplayName: "bob"}
+	eve := ObjectOwner{ID: "id-eve", DisplayName: "eve"}
+
+	tests := []struct {
+		owner     ObjectOwner
+		key       string
+		cvmfsPath string
+		allowed   bool
+	}{
+		{alice, "alice/a.tar", "sw/alice", true},
+		{alice, "alice/a.tar", "sw/alice/deep/dir", true},
+		{alice, "alice/a.tar", "sw/alice-other", false},
+		{alice, "alice/a.tar", "sw", false},
+		{alice, "other/a.tar", "sw/alice", false},
+		{bob, "anything/b.tar", "sw/bob/x", true},
+		{bob, "anything/b.tar", "data/bob", true},
+		{bob, "anything/b.tar", "data", false},
+		{eve, "public/e.tar", "public/e", true},
+		{eve, "public/e.tar", "sw/alice", false},
+		{eve, "private/e.tar", "public", false},
+	}
+	for _, test := range tests {
+		err := CheckACL(rules, test.owner, test.key, test.cvmfsPath)
+		if (err == nil) != test.allowed {
+			t.Errorf("CheckACL(%s, %q, %q) = %v, expected allowed %v",
+				test.owner, test.key, test.cvmfsPath, err, test.allowed)
+		}
+	}
+
+	if err := CheckACL(nil, eve, "a.tar", "anywhere"); err != nil {
+		t.Errorf("Without rules everything should be allowed, got %s", err)
+	}
+}
+
+func TestACLRuleValidate(t *testing.T) {
+	tests := []struct {
+		rule  ACLRule
+		valid bool
+	}{
+		{ACLRule{Owner: "a", Paths: []string{"/sw/a"}}, true},
+		{ACLRule{Owner: "a", Paths: []string{"sw/a", "/"}}, true},
+		{ACLRule{Owner: "a"}, false},
+		{ACLRule{Owner: "a", Paths: []string{"/sw/../etc"}}, false},
+	}
+	for _, test := range tests {
+		err := test.rule.Validate()
+		if (err == nil) != test.valid {
+			t.Errorf("Validate(%s) = %v, expected valid %v", test.rule, err, test.valid)
+		}
+	}
+}
+
+func TestNewObjectOwner(t *testing.T) {
+	tests := []struct {
+		owner    *s3.Owner
+		expected ObjectOwner
+	}{
+		{nil, ObjectOwner{}},
+		{&s3.Owner{ID: aws.String("id")}, ObjectOwner{ID: "id"}},
+		{&s3.Owner{ID: aws.String("id"), DisplayName: aws.String("name")}, ObjectOwner{ID: "id", DisplayName: "name"}},
+	}
+	for _, test := range tests {
+		if got := NewObjectOwner(test.owner); got != test.expected {
+			t.Errorf("NewObjectOwner(%v) = %+v, expected %+v", test.owner, got, test.expected)
+		}
+	}
+}
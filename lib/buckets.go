@@ -0,0 +1,171 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+/*
+The buckets of a portal can be created by the portal itself, either with
+`portals init` or, with create-buckets, when the daemon starts.
+
+Only the buckets that we create get our policy and lifecycle rules, the ones
+already existing are never modified.
+*/
+
+// RunObject is the object of the status bucket that tells the daemon to
+// process the portal
+const RunObject = "RUN"
+
+// days after which the multipart uploads never completed are removed
+const abortMultipartDays = 7
+
+// BucketAction is one of the steps done to set up the buckets
+type BucketAction struct {
+	Bucket      string
+	Description string
+	Err         error
+}
+
+func (a BucketAction) String() string {
+	if a.Err != nil {
+		return fmt.Sprintf("%s: %s FAILED: %s", a.Bucket, a.Description, a.Err)
+	}
+	return fmt.Sprintf("%s: %s", a.Bucket, a.Description)
+}
+
+// EnsureBuckets creates the data and the status bucket if they are missing
+// and makes sure that the RUN object exists, it returns everything it did
+func EnsureBuckets(couple S3BucketCouple, bc BucketConfiguration) (actions []BucketAction, err error) {
+	for _, bucket := range []S3Bucket{couple.Data, couple.Status} {
+		isStatus := bucket.BucketName == couple.Status.BucketName
+		bucketActions, err := ensureBucket(bucket, bc, isStatus)
+		actions = append(actions, bucketActions...)
+		if err != nil {
+			return actions, err
+		}
+	}
+
+	client := s3.New(&couple.Status.Session)
+	_, err = client.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(couple.Status.BucketName),
+		Key:    aws.String(RunObject),
+	})
+	if err == nil {
+		actions = append(actions, BucketAction{Bucket: couple.Status.BucketName,
+			Description: "RUN object already present"})
+		return actions, nil
+	}
+	_, err = client.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(couple.Status.BucketName),
+		Key:    aws.String(RunObject),
+		Body:   bytes.NewReader([]byte(time.Now().Format(time.RFC3339))),
+	})
+	actions = append(actions, BucketAction{Bucket: couple.Status.BucketName,
+		Description: "uploaded the RUN object", Err: err})
+	return actions, err
+}
+
+func ensureBucket(bucket S3Bucket, bc BucketConfiguration, isStatus bool) ([]BucketAction, error) {
+	client := s3.New(&bucket.Session)
+	name := bucket.BucketName
+	actions := []BucketAction{}
+
+	_, err := client.HeadBucket(&s3.HeadBucketInput{Bucket: aws.String(name)})
+	if err == nil {
+		actions = append(actions, BucketAction{Bucket: name, Description: "already exists, left untouched"})
+		return actions, nil
+	}
+	if aerr, ok := err.(awserr.Error); !ok || (aerr.Code() != "NotFound" && aerr.Code() != s3.ErrCodeNoSuchBucket) {
+		actions = append(actions, BucketAction{Bucket: name, Description: "check if it exists", Err: err})
+		return actions, err
+	}
+
+	input := &s3.CreateBucketInput{Bucket: aws.String(name)}
+	// us-east-1 is the default and it must not be set explicitly
+	if bc.Region != "" && bc.Region != "us-east-1" {
+		input.CreateBucketConfiguration = &s3.CreateBucketConfiguration{
+			LocationConstraint: aws.String(bc.Region),
+		}
+	}
+	_, err = client.CreateBucket(input)
+	actions = append(actions, BucketAction{Bucket: name, Description: "created", Err: err})
+	if err != nil {
+		return actions, err
+	}
+
+	// the bucket is usable even without policy and lifecycle rules, their
+	// failures are only reported, the policy is not set for the endpoints
+	// in plain http, it would lock out the portal
+	if strings.HasPrefix(bc.HostURL, "http://") {
+		actions = append(actions, BucketAction{Bucket: name,
+			Description: "no policy denying unencrypted access, the host-url is not https"})
+	} else {
+		_, err = client.PutBucketPolicy(&s3.PutBucketPolicyInput{
+			Bucket: aws.String(name),
+			Policy: aws.String(bucketPolicy(name)),
+		})
+		actions = append(actions, BucketAction{Bucket: name,
+			Description: "set the policy denying unencrypted access", Err: err})
+	}
+
+	rules := []*s3.LifecycleRule{{
+		ID:     aws.String("abort-incomplete-uploads"),
+		Status: aws.String(s3.ExpirationStatusEnabled),
+		Filter: &s3.LifecycleRuleFilter{Prefix: aws.String("")},
+		AbortIncompleteMultipartUpload: &s3.AbortIncompleteMultipartUpload{
+			DaysAfterInitiation: aws.Int64(abortMultipartDays),
+		},
+	}}
+	description := fmt.Sprintf("set the lifecycle rule aborting uploads older than %d days", abortMultipartDays)
+	if isStatus && bc.StatusExpiration.Duration > 0 {
+		days := int64(math.Ceil(bc.StatusExpiration.Hours() / 24))
+		rules = append(rules, &s3.LifecycleRule{
+			ID:     aws.String("expire-failures"),
+			Status: aws.String(s3.ExpirationStatusEnabled),
+			Filter: &s3.LifecycleRuleFilter{Tag: &s3.Tag{
+				Key:   aws.String(statusTagKey),
+				Value: aws.String(expiringStatus),
+			}},
+			Expiration: &s3.LifecycleExpiration{Days: aws.Int64(days)},
+		})
+		description += fmt.Sprintf(" and expiring the %s status files after %d days", expiringStatus, days)
+	}
+	_, err = client.PutBucketLifecycleConfiguration(&s3.PutBucketLifecycleConfigurationInput{
+		Bucket:                 aws.String(name),
+		LifecycleConfiguration: &s3.BucketLifecycleConfiguration{Rules: rules},
+	})
+	actions = append(actions, BucketAction{Bucket: name, Description: description, Err: err})
+
+	return actions, nil
+}
+
+// bucketPolicy denies every access to the bucket that is not over TLS
+func bucketPolicy(bucket string) string {
+	policy := map[string]interface{}{
+		"Version": "2012-10-17",
+		"Statement": []map[string]interface{}{{
+			"Sid":       "DenyInsecureTransport",
+			"Effect":    "Deny",
+			"Principal": "*",
+			"Action":    "s3:*",
+			"Resource": []string{
+				"arn:aws:s3:::" + bucket,
+				"arn:aws:s3:::" + bucket + "/*",
+			},
+			"Condition": map[string]interface{}{
+				"Bool": map[string]string{"aws:SecureTransport": "false"},
+			},
+		}},
+	}
+	content, _ := json.Marshal(policy)
+	return string(content)
+}
@@ -0,0 +1,200 @@
+package lib
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeBuckets serves the buckets in exists, and records what is done to the
+// ones created
+type fakeBuckets struct {
+	mutex    sync.Mutex
+	exists   map[string]bool
+	requests []string
+	// lifecycle configuration of each bucket created
+	lifecycles map[string]lifecycleConfiguration
+	// tagging of each object uploaded
+	tagging map[string]string
+}
+
+type lifecycleConfiguration struct {
+	Rules []struct {
+		ID     string `xml:"ID"`
+		Filter struct {
+			Prefix *string `xml:"Prefix"`
+			Tag    *struct {
+				Key   string `xml:"Key"`
+				Value string `xml:"Value"`
+			} `xml:"Tag"`
+		} `xml:"Filter"`
+		Expiration *struct {
+			Days int `xml:"Days"`
+		} `xml:"Expiration"`
+	} `xml:"Rule"`
+}
+
+func newFakeBuckets(exists ...string) *fakeBuckets {
+	f := &fakeBuckets{
+		exists:     map[string]bool{},
+		lifecycles: map[string]lifecycleConfiguration{},
+		tagging:    map[string]string{},
+	}
+	for _, bucket := range exists {
+		f.exists[bucket] = true
+	}
+	return f
+}
+
+func (f *fakeBuckets) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	path := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	bucket, key := path[0], ""
+	if len(path) > 1 {
+		key = path[1]
+	}
+	query := ""
+	for _, subresource := range []string{"policy", "lifecycle"} {
+		if _, ok := r.URL.Query()[subresource]; ok {
+			query = "?" + subresource
+		}
+	}
+	f.requests = append(f.requests, r.Method+" "+strings.TrimSuffix(bucket+"/"+key, "/")+query)
+
+	switch {
+	case key == "" && query == "" && r.Method == http.MethodHead:
+		if !f.exists[bucket] {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	case key == "" && query == "" && r.Method == http.MethodPut:
+		f.exists[bucket] = true
+	case query == "?lifecycle":
+		var lifecycle lifecycleConfiguration
+		body, _ := ioutil.ReadAll(r.Body)
+		if err := xml.Unmarshal(body, &lifecycle); err != nil {
+			s3Error(w, http.StatusBadRequest, "MalformedXML")
+			return
+		}
+		f.lifecycles[bucket] = lifecycle
+	case query == "?policy":
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodHead:
+		// no object exists
+		w.WriteHeader(http.StatusNotFound)
+	case r.Method == http.MethodPut:
+		f.tagging[key] = r.Header.Get("X-Amz-Tagging")
+		w.Header().Set("ETag", `"etag"`)
+	default:
+		s3Error(w, http.StatusBadRequest, "UnexpectedRequest")
+	}
+}
+
+func TestEnsureBuckets(t *testing.T) {
+	tests := []struct {
+		name       string
+		exists     []string
+		hostURL    string
+		expiration time.Duration
+		requests   string
+		// expiration of the FAILURE status files, in days, 0 for none
+		days int
+	}{
+		{
+			name:       "both created",
+			hostURL:    "https://s3.example.org",
+			expiration: 36 * time.Hour,
+			requests: "HEAD data,PUT data,PUT data?policy,PUT data?lifecycle," +
+				"HEAD data.status,PUT data.status,PUT data.status?policy,PUT data.status?lifecycle," +
+				"HEAD data.status/RUN,PUT data.status/RUN",
+			days: 2,
+		},
+		{
+			name:    "without expiration over plain http",
+			hostURL: "http://s3.example.org",
+			requests: "HEAD data,PUT data,PUT data?lifecycle,HEAD data.status,PUT data.status,PUT data.status?lifecycle," +
+				"HEAD data.status/RUN,PUT data.status/RUN",
+		},
+		{
+			name:       "existing buckets left untouched",
+			exists:     []string{"data", "data.status"},
+			expiration: 24 * time.Hour,
+			requests:   "HEAD data,HEAD data.status,HEAD data.status/RUN,PUT data.status/RUN",
+		},
+	}
+	for _, test := range tests {
+		buckets := newFakeBuckets(test.exists...)
+		sess, stop := fakeS3(t, buckets.ServeHTTP)
+		couple := S3BucketCouple{
+			Data:   S3Bucket{BucketName: "data", Session: *sess},
+			Status: S3Bucket{BucketName: "data.status", Session: *sess},
+		}
+		bc := BucketConfiguration{HostURL: test.hostURL, StatusExpiration: Duration{test.expiration}}
+		actions, err := EnsureBuckets(couple, bc)
+		stop()
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", test.name, err)
+			continue
+		}
+		for _, action := range actions {
+			if action.Err != nil {
+				t.Errorf("%s: failed action %s", test.name, action)
+			}
+		}
+		if requests := strings.Join(buckets.requests, ","); requests != test.requests {
+			t.Errorf("%s:\nexpected %s\ngot      %s", test.name, test.requests, requests)
+		}
+
+		for bucket, lifecycle := range buckets.lifecycles {
+			days := 0
+			for _, rule := range lifecycle.Rules {
+				if rule.Expiration == nil {
+					continue
+				}
+				tag := rule.Filter.Tag
+				if rule.Filter.Prefix != nil || tag == nil || tag.Key != "portal-status" || tag.Value != "FAILURE" {
+					t.Errorf("%s: the rule %s of %s does not expire only the FAILURE statuses", test.name, rule.ID, bucket)
+				}
+				days = rule.Expiration.Days
+			}
+			expected := 0
+			if bucket == "data.status" {
+				expected = test.days
+			}
+			if days != expected {
+				t.Errorf("%s: expected %s to expire after %d days, got %d", test.name, bucket, expected, days)
+			}
+		}
+	}
+}
+
+func TestStatusReportTagging(t *testing.T) {
+	buckets := newFakeBuckets("status")
+	sess, stop := fakeS3(t, buckets.ServeHTTP)
+	defer stop()
+
+	tests := []struct {
+		status  string
+		tagging string
+	}{
+		{"FAILURE", "portal-status=FAILURE"},
+		{"SUCCESS", ""},
+		{"INGESTING", ""},
+		{"ROLLEDBACK", ""},
+	}
+	for _, test := range tests {
+		report := StatusReport{Status: test.status, Key: "object.tar", Hash: "0123"}
+		if err := UploadStatusReport(sess, "status", report); err != nil {
+			t.Errorf("%s: unexpected error %s", test.status, err)
+			continue
+		}
+		if tagging := buckets.tagging[report.StatusKey()]; tagging != test.tagging {
+			t.Errorf("%s: expected the tagging %q, got %q", test.status, test.tagging, tagging)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package lib
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// ExpectedChecksum is a digest the downloaded object must match
+type ExpectedChecksum struct {
+	// where the checksum comes from: "etag", "metadata" or "sidecar"
+	Source    string
+	Algorithm string
+	Value     string
+}
+
+// ChecksumMismatch is the error returned when the downloaded object does not
+// match one of the expected checksums
+type ChecksumMismatch struct {
+	ExpectedChecksum
+	Actual string
+}
+
+func (e ChecksumMismatch) Error() string {
+	return fmt.Sprintf("The %s checksum of the object does not match the one from the %s: expected %s, got %s",
+		e.Algorithm, e.Source, e.Value, e.Actual)
+}
+
+func (e ChecksumMismatch) Details() map[string]string {
+	return map[string]string{
+		"checksum-source":    e.Source,
+		"checksum-algorithm": e.Algorithm,
+		"checksum-expected":  e.Value,
+		"checksum-actual":    e.Actual,
+	}
+}
+
+// Digests hashes everything written into it with all the algorithms we
+// know to verify
+type Digests struct {
+	md5    hash.Hash
+	sha256 hash.Hash
+}
+
+func NewDigests() *Digests {
+	return &Digests{md5: md5.New(), sha256: sha256.New()}
+}
+
+func (d *Digests) Write(p []byte) (int, error) {
+	d.md5.Write(p)
+	return d.sha256.Write(p)
+}
+
+func (d *Digests) Sum(algorithm string) string {
+	switch algorithm {
+	case "md5":
+		return hex.EncodeToString(d.md5.Sum(nil))
+	case "sha256":
+		return hex.EncodeToString(d.sha256.Sum(nil))
+	}
+	return ""
+}
+
+// Verify compares the digests with all the expected checksums
+func (d *Digests) Verify(expected []ExpectedChecksum) error {
+	for _, checksum := range expected {
+		actual := d.Sum(checksum.Algorithm)
+		if !strings.EqualFold(actual, checksum.Value) {
+			return ChecksumMismatch{ExpectedChecksum: checksum, Actual: actual}
+		}
+	}
+	return nil
+}
+
+func digestFile(path string) (*Digests, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	digests := NewDigests()
+	_, err = io.Copy(digests, f)
+	return digests, err
+}
+
+var md5ETag = regexp.MustCompile(`^[0-9a-fA-F]{32}$`)
+var sha256Hex = regexp.MustCompile(`^[0-9a-fA-F]{64}$`)
+
+// ExpectedChecksums collects the checksums the object should match.
+//
+// The ETag is the MD5 of the object only for non-multipart uploads, the
+// ETag of multipart uploads contains a dash and it is ignored.
+// The SHA256 may be provided by the user either as the x-amz-meta-sha256
+// metadata or as the sidecar object <key>.sha256
+func (s3obj S3Object) ExpectedChecksums() ([]ExpectedChecksum, error) {
+	expected := []ExpectedChecksum{}
+	client := s3.New(s3obj.session)
+
+	if !s3obj.config.SkipETagVerification && md5ETag.MatchString(s3obj.etag) {
+		expected = append(expected, ExpectedChecksum{
+			Source: "etag", Algorithm: "md5", Value: s3obj.etag})
+	}
+
+	if value, ok := s3obj.metadata["Sha256"]; ok && value != nil {
+		if !sha256Hex.MatchString(*value) {
+			return nil, fmt.Errorf("Malformed x-amz-meta-sha256 metadata: %s", *value)
+		}
+		expected = append(expected, ExpectedChecksum{
+			Source: "metadata", Algorithm: "sha256", Value: *value})
+	}
+
+	sidecar := s3obj.key + ".sha256"
+	object, err := client.GetObject(&s3.GetObjectInput{
+		Bucket: &s3obj.bucket,
+		Key:    &sidecar,
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); !ok || aerr.Code() != s3.ErrCodeNoSuchKey {
+			return nil, fmt.Errorf("Error in reading the sidecar %s: %s", sidecar, err)
+		}
+	} else {
+		defer object.Body.Close()
+		// same format of sha256sum: the digest optionally followed by the
+		// file name
+		content := make([]byte, 1024)
+		n, _ := io.ReadFull(object.Body, content)
+		fields := strings.Fields(string(content[:n]))
+		if len(fields) == 0 || !sha256Hex.MatchString(fields[0]) {
+			return nil, fmt.Errorf("Malformed sidecar %s", sidecar)
+		}
+		expected = append(expected, ExpectedChecksum{
+			Source: "sidecar", Algorithm: "sha256", Value: fields[0]})
+	}
+
+	if s3obj.config.RequireChecksum && !hasUserChecksum(expected) {
+		return nil, fmt.Errorf("No SHA256 provided for the object, " +
+			"neither as x-amz-meta-sha256 metadata nor as sidecar object")
+	}
+	return expected, nil
+}
+
+func hasUserChecksum(expected []ExpectedChecksum) bool {
+	for _, checksum := range expected {
+		if checksum.Source != "etag" {
+			return true
+		}
+	}
+	return false
+}
+
+// VerifyChecksum checks the downloaded file against all the expected
+// checksums of the object
+func (s3obj S3Object) VerifyChecksum(path string) error {
+	expected, err := s3obj.ExpectedChecksums()
+	if err != nil {
+		return err
+	}
+	if len(expected) == 0 {
+		return nil
+	}
+	digests, err := digestFile(path)
+	if err != nil {
+		return fmt.Errorf("Error in computing the checksum of the downloaded file: %s", err)
+	}
+	return digests.Verify(expected)
+}
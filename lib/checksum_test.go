@@ -0,0 +1,160 @@
+package lib
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// fakeS3 serves the requests of the SDK with the handler, the bucket is the
+// first element of the path
+func fakeS3(t *testing.T, handler http.HandlerFunc) (*session.Session, func()) {
+	server := httptest.NewServer(handler)
+	sess, err := session.NewSession(aws.NewConfig().
+		WithCredentials(credentials.NewStaticCredentials("access", "secret", "")).
+		WithRegion("us-east-1").
+		WithEndpoint(server.URL).
+		WithS3ForcePathStyle(true).
+		WithMaxRetries(0))
+	if err != nil {
+		server.Close()
+		t.Fatal(err)
+	}
+	return sess, server.Close
+}
+
+func s3Error(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	w.Write([]byte("<Error><Code>" + code + "</Code><Message>" + code + "</Message></Error>"))
+}
+
+func TestDigestsVerify(t *testing.T) {
+	content := []byte("content of the object")
+	md5Sum := md5.Sum(content)
+	sha256Sum := sha256.Sum256(content)
+	md5Hex := hex.EncodeToString(md5Sum[:])
+	sha256Hex := hex.EncodeToString(sha256Sum[:])
+
+	tests := []struct {
+		name     string
+		expected []ExpectedChecksum
+		mismatch string
+	}{
+		{"nothing to verify", nil, ""},
+		{"etag", []ExpectedChecksum{{"etag", "md5", md5Hex}}, ""},
+		{"upper case", []ExpectedChecksum{{"metadata", "sha256", strings.ToUpper(sha256Hex)}}, ""},
+		{"all match", []ExpectedChecksum{{"etag", "md5", md5Hex}, {"sidecar", "sha256", sha256Hex}}, ""},
+		{"wrong md5", []ExpectedChecksum{{"etag", "md5", strings.Repeat("0", 32)}}, "etag"},
+		{"second wrong", []ExpectedChecksum{{"etag", "md5", md5Hex}, {"sidecar", "sha256", md5Hex}}, "sidecar"},
+	}
+	for _, test := range tests {
+		digests := NewDigests()
+		digests.Write(content)
+		err := digests.Verify(test.expected)
+		if test.mismatch == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error %s", test.name, err)
+			}
+			continue
+		}
+		mismatch, ok := err.(ChecksumMismatch)
+		if !ok {
+			t.Errorf("%s: expected a ChecksumMismatch, got %v", test.name, err)
+			continue
+		}
+		if mismatch.Source != test.mismatch {
+			t.Errorf("%s: mismatch of the %s, expected the %s", test.name, mismatch.Source, test.mismatch)
+		}
+		if mismatch.Details()["checksum-actual"] != digests.Sum(mismatch.Algorithm) {
+			t.Errorf("%s: wrong actual checksum in the details %v", test.name, mismatch.Details())
+		}
+	}
+}
+
+func TestExpectedChecksums(t *testing.T) {
+	md5Hex := strings.Repeat("a", 32)
+	sha256Hex := strings.Repeat("b", 64)
+
+	tests := []struct {
+		name     string
+		etag     string
+		metadata string
+		// status and body of the sidecar
+		sidecarStatus int
+		sidecar       string
+		skipETag      bool
+		require       bool
+		sources       []string
+		err           bool
+	}{
+		{"etag only", md5Hex, "", 404, "", false, false, []string{"etag"}, false},
+		{"multipart etag", md5Hex + "-3", "", 404, "", false, false, []string{}, false},
+		{"skip etag", md5Hex, "", 404, "", true, false, []string{}, false},
+		{"metadata", md5Hex, sha256Hex, 404, "", false, false, []string{"etag", "metadata"}, false},
+		{"malformed metadata", md5Hex, "nope", 404, "", false, false, nil, true},
+		{"sidecar", "", "", 200, sha256Hex + "  object.tar\n", false, false, []string{"sidecar"}, false},
+		{"malformed sidecar", "", "", 200, "nope\n", false, false, nil, true},
+		{"empty sidecar", "", "", 200, "", false, false, nil, true},
+		{"sidecar not readable", "", "", 403, "", false, false, nil, true},
+		{"required and missing", md5Hex, "", 404, "", false, true, nil, true},
+		{"required and provided", md5Hex, "", 200, sha256Hex, false, true, []string{"etag", "sidecar"}, false},
+	}
+	for _, test := range tests {
+		sess, stop := fakeS3(t, func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/bucket/object.tar.sha256" {
+				s3Error(w, 400, "UnexpectedRequest")
+				return
+			}
+			switch test.sidecarStatus {
+			case 200:
+				w.Write([]byte(test.sidecar))
+			case 404:
+				s3Error(w, 404, "NoSuchKey")
+			default:
+				s3Error(w, test.sidecarStatus, "AccessDenied")
+			}
+		})
+		s3obj := S3Object{
+			bucket:   "bucket",
+			key:      "object.tar",
+			etag:     test.etag,
+			session:  sess,
+			metadata: map[string]*string{},
+			config: &BucketConfiguration{
+				SkipETagVerification: test.skipETag,
+				RequireChecksum:      test.require,
+			},
+		}
+		if test.metadata != "" {
+			s3obj.metadata["Sha256"] = aws.String(test.metadata)
+		}
+
+		expected, err := s3obj.ExpectedChecksums()
+		stop()
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %v", test.name, expected)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", test.name, err)
+			continue
+		}
+		sources := []string{}
+		for _, checksum := range expected {
+			sources = append(sources, checksum.Source)
+		}
+		if strings.Join(sources, ",") != strings.Join(test.sources, ",") {
+			t.Errorf("%s: expected the checksums %v, got %v", test.name, test.sources, sources)
+		}
+	}
+}
@@ -0,0 +1,464 @@
+package lib
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cvmfs/portals/cvmfs"
+	"github.com/cvmfs/portals/log"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+/*
+When the completion markers are enabled the objects are ingested only once
+the user signals that the whole set of objects under a prefix is uploaded.
+
+The user can upload either:
+1. an empty `.ready` object, all the tarballs under its prefix are ingested in
+   lexical order
+2. a `MANIFEST` object, listing one key per line, relative to its prefix, the
+   listed objects are ingested in the order of the manifest once all of them
+   are in the bucket
+
+All the objects of a set are ingested in a single transaction, either all of
+them are in the repository or none is.
+
+Once the set reached a final status the marker stays in the bucket, the
+objects added or modified later under its prefix are not ingested until the
+user uploads the marker again.
+*/
+
+const (
+	ReadyMarker    = ".ready"
+	ManifestMarker = "MANIFEST"
+
+	// objects of a set downloaded at the same time
+	setDownloadWorkers = 4
+)
+
+// ObjectGroup is a set of objects ready to be ingested together
+type ObjectGroup struct {
+	Marker  s3.Object
+	Objects []s3.Object
+	// set if the group can never be ingested, like a manifest listing an
+	// object that belongs to a closer marker
+	Err error
+}
+
+func isCompletionMarker(key string) bool {
+	base := path.Base(key)
+	return base == ReadyMarker || base == ManifestMarker
+}
+
+// prefix of the marker, including the trailing slash, empty for the top
+// level of the bucket
+func markerPrefix(key string) string {
+	dir := path.Dir(key)
+	if dir == "." {
+		return ""
+	}
+	return dir + "/"
+}
+
+// GroupByCompletionMarker returns the groups whose marker is in the listing
+// and whose objects are all uploaded, the objects without a marker are left
+// out, waiting for it.
+// Every object belongs to its closest marker, even if the group of that
+// marker is not complete yet.
+func (b S3Bucket) GroupByCompletionMarker(objects []s3.Object) ([]ObjectGroup, error) {
+	byKey := make(map[string]s3.Object)
+	markers := []s3.Object{}
+	for _, object := range objects {
+		byKey[*object.Key] = object
+		if isCompletionMarker(*object.Key) {
+			markers = append(markers, object)
+		}
+	}
+	// deepest prefixes first, so that an object belongs to the closest
+	// marker
+	sort.SliceStable(markers, func(i, j int) bool {
+		return len(markerPrefix(*markers[i].Key)) > len(markerPrefix(*markers[j].Key))
+	})
+
+	claimed := make(map[string]bool)
+	groups := []ObjectGroup{}
+	for _, marker := range markers {
+		prefix := markerPrefix(*marker.Key)
+		group := ObjectGroup{Marker: marker}
+		complete := true
+
+		if path.Base(*marker.Key) == ManifestMarker {
+			content, err := b.GetObjectContent(*marker.Key)
+			if err != nil {
+				return nil, fmt.Errorf("Error in reading the manifest %s: %s", *marker.Key, err)
+			}
+			group.Objects, complete, group.Err = manifestObjects(prefix, string(content), byKey, claimed)
+		} else {
+			for _, object := range objects {
+				key := *object.Key
+				if claimed[key] {
+					continue
+				}
+				if !strings.HasPrefix(key, prefix) || !strings.HasSuffix(key, ".tar") {
+					continue
+				}
+				group.Objects = append(group.Objects, object)
+			}
+			sort.Slice(group.Objects, func(i, j int) bool {
+				return *group.Objects[i].Key < *group.Objects[j].Key
+			})
+		}
+
+		// the objects are ingested only with the closest marker, complete
+		// or not
+		for _, object := range group.Objects {
+			claimed[*object.Key] = true
+		}
+
+		if group.Err != nil {
+			groups = append(groups, group)
+			continue
+		}
+		if !complete {
+			l := log.Decorate(map[string]string{"manifest": *marker.Key})
+			l(log.Log()).Info("Waiting for all the objects of the manifest")
+			continue
+		}
+		if len(group.Objects) > 0 {
+			groups = append(groups, group)
+		}
+	}
+	return groups, nil
+}
+
+// manifestObjects returns the objects listed in the manifest, in its order,
+// complete is false if some of them are not uploaded yet
+func manifestObjects(prefix, content string, byKey map[string]s3.Object, claimed map[string]bool) (
+	objects []s3.Object, complete bool, err error) {
+
+	complete = true
+	listed := make(map[string]bool)
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "/") || hasDotDotSegment(line) {
+			return objects, false, fmt.Errorf("The manifest lists %s, outside of its prefix", line)
+		}
+		key := prefix + line
+		if listed[key] {
+			return objects, false, fmt.Errorf("The manifest lists %s twice", line)
+		}
+		listed[key] = true
+		if claimed[key] {
+			return objects, false, fmt.Errorf("The manifest lists %s, that belongs to a closer marker", line)
+		}
+		object, ok := byKey[key]
+		if !ok {
+			complete = false
+			continue
+		}
+		objects = append(objects, object)
+	}
+	return objects, complete, nil
+}
+
+// S3ObjectSet goes through the pipeline as a single element, the status
+// files of the whole set are written using the key of the marker
+type S3ObjectSet struct {
+	marker  S3Object
+	objects []S3Object
+	local   []S3LocalFile
+}
+
+func NewS3ObjectSet(marker S3Object, objects []S3Object) S3ObjectSet {
+	return S3ObjectSet{marker: marker, objects: objects}
+}
+
+// id identifies the set along with the version of all its objects, a set
+// restarted because its objects changed is a new set
+func (set S3ObjectSet) id() string {
+	h := sha256.New()
+	for _, object := range set.objects {
+		h.Write([]byte(object.key + "." + object.hash + "\n"))
+	}
+	return fmt.Sprintf("%s.%s.%x", set.marker.key, set.marker.hash, h.Sum(nil)[:8])
+}
+
+// Processed is true if this version of the marker already reached a final
+// status, the objects that changed since then wait for a new marker: the
+// ones already ingested would be published again with them
+func (set S3ObjectSet) Processed() bool {
+	return set.marker.Processed()
+}
+
+// Priority of the set is the highest among its objects
+func (set S3ObjectSet) Priority() int {
+	priority := set.marker.Priority()
+	for _, object := range set.objects {
+		if object.Priority() > priority {
+			priority = object.Priority()
+		}
+	}
+	return priority
+}
+
+func (set S3ObjectSet) MakeS3RemoteFile() IS3RemoteFile {
+	return set
+}
+
+// DownloadFile brings every object of the set through the download and
+// validation stages, setDownloadWorkers objects at the same time, if any
+// object fails the whole set fails
+func (set S3ObjectSet) DownloadFile() IS3DownloadedFile {
+	set.marker.ReportStatus("DOWNLOADING")
+
+	results := make([]IS3LocalFile, len(set.objects))
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < setDownloadWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				results[i] = downloadSetObject(set.objects[i])
+			}
+		}()
+	}
+	for i := range set.objects {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	var failed error
+	changed := make(map[string]bool)
+	later := false
+	for i, result := range results {
+		switch r := result.(type) {
+		case S3LocalFile:
+			set.local = append(set.local, r)
+		case ErrorObjectChanged:
+			changed[set.objects[i].key] = true
+		case ErrorWithStatus:
+			if failed == nil {
+				failed = fmt.Errorf("The object %s of the set failed", set.objects[i].key)
+			}
+		default:
+			// not a problem of the object, like an error of the
+			// endpoint
+			later = true
+		}
+	}
+	if failed != nil {
+		return ErrorInObjectSet{S3ObjectSet: set, results: results, err: failed}
+	}
+	if later {
+		return ErrorInDownloadingObjectSet{set}
+	}
+	if len(changed) > 0 {
+		return ErrorObjectSetChanged{S3ObjectSet: set, changed: changed}
+	}
+	return set
+}
+
+// the objects of a set are always downloaded, also in streaming mode, they
+// are extracted together in a single transaction
+func downloadSetObject(object S3Object) IS3LocalFile {
+	remote := object.MakeS3RemoteFile()
+	if s3obj, ok := remote.(S3Object); ok {
+		return s3obj.downloadToFile().Validate()
+	}
+	return remote.DownloadFile().Validate()
+}
+
+func (set S3ObjectSet) Validate() IS3LocalFile {
+	return set
+}
+
+func (set S3ObjectSet) Ingest() IS3IngestedFile {
+	tagName, tagDescription, err := set.marker.TagFor(time.Now())
+	if err != nil {
+		return ErrorInObjectSet{S3ObjectSet: set, err: err}
+	}
+
+	tars := []cvmfs.TarToExtract{}
+	for _, local := range set.local {
+		tars = append(tars, cvmfs.TarToExtract{Path: local.tempPath, BaseDir: local.cvmfsPath})
+	}
+	repo := set.marker.cvmfsRepo
+
+	for _, object := range append([]S3Object{set.marker}, set.objects...) {
+		ingesting := NewStatusReport(object, "INGESTING")
+		ingesting.Tag = tagName
+		object.ReportStatusReport(ingesting)
+	}
+
+	changed := make(map[string]bool)
+	err = func() error {
+		repo.Lock.LockWithPriority(set.Priority())
+		defer repo.Lock.Unlock()
+
+		for _, local := range set.local {
+			unchanged, err := local.isUnchanged()
+			if err != nil {
+				return err
+			}
+			if !unchanged {
+				changed[local.key] = true
+			}
+		}
+		if len(changed) > 0 {
+			return errObjectChanged
+		}
+
+		return cvmfs.IngestInTransaction(repo.Name, tars, tagName, tagDescription)
+	}()
+	if err == errObjectChanged {
+		return ErrorObjectSetChanged{S3ObjectSet: set, changed: changed}
+	}
+	if err != nil {
+		return ErrorInObjectSet{S3ObjectSet: set, err: err}
+	}
+
+	tag := publishedTag(repo.Name, tagName)
+	for _, object := range append([]S3Object{set.marker}, set.objects...) {
+		object.UploadStatusReport(NewSuccessReport(object, tag))
+	}
+	return set
+}
+
+func (set S3ObjectSet) Cleanup() PipelineOutput {
+	for _, local := range set.local {
+		os.Remove(local.tempPath)
+	}
+	set.marker.ReportStatus("DELETING")
+	return PipelineOutput{}
+}
+
+// ErrorInDownloadingObjectSet cleans up a set that could not be downloaded,
+// without writing any status, the next listing tries again
+type ErrorInDownloadingObjectSet struct {
+	S3ObjectSet
+}
+
+func (e ErrorInDownloadingObjectSet) Validate() IS3LocalFile {
+	return e
+}
+
+func (e ErrorInDownloadingObjectSet) Ingest() IS3IngestedFile {
+	return e
+}
+
+func (e ErrorInDownloadingObjectSet) Cleanup() PipelineOutput {
+	for _, local := range e.local {
+		os.Remove(local.tempPath)
+	}
+	return PipelineOutput{}
+}
+
+// ErrorInObjectSet cleans up all the objects of a set that failed and writes
+// the FAILURE status for the marker and for all the objects
+type ErrorInObjectSet struct {
+	S3ObjectSet
+	results []IS3LocalFile
+	err     error
+}
+
+func (e ErrorInObjectSet) Validate() IS3LocalFile {
+	return e
+}
+
+func (e ErrorInObjectSet) Ingest() IS3IngestedFile {
+	return e
+}
+
+func (e ErrorInObjectSet) Cleanup() PipelineOutput {
+	failed := make(map[string]bool)
+	for _, result := range e.results {
+		switch result.(type) {
+		case S3LocalFile, ErrorObjectChanged:
+			// nothing on disk but the temporary files of the set, and
+			// the objects that changed fail with the set
+			continue
+		}
+		// the object that failed writes its own status
+		result.Ingest().Cleanup()
+		if failure, ok := result.(ErrorWithStatus); ok {
+			failed[failure.key] = true
+		}
+	}
+	for _, local := range e.local {
+		os.Remove(local.tempPath)
+	}
+
+	l := log.Decorate(map[string]string{"marker": e.marker.key})
+	l(log.LogE(e.err)).Error("Impossible to ingest the set of objects")
+	for _, object := range append([]S3Object{e.marker}, e.objects...) {
+		if failed[object.key] {
+			continue
+		}
+		report := NewStatusReport(object, "FAILURE")
+		report.Error = e.err.Error()
+		object.UploadStatusReport(report)
+	}
+	return PipelineOutput{}
+}
+
+// ErrorObjectSetChanged skips the stages of a set whose objects changed while
+// it was processed, at the cleanup the set is sent back into the pipeline
+// with the new version of those objects
+type ErrorObjectSetChanged struct {
+	S3ObjectSet
+	changed map[string]bool
+}
+
+func (e ErrorObjectSetChanged) Validate() IS3LocalFile {
+	return e
+}
+
+func (e ErrorObjectSetChanged) Ingest() IS3IngestedFile {
+	return e
+}
+
+func (e ErrorObjectSetChanged) Cleanup() PipelineOutput {
+	for _, local := range e.local {
+		os.Remove(local.tempPath)
+	}
+	e.local = nil
+
+	report := NewStatusReport(e.marker, "RESTARTED")
+	report.Error = errObjectChanged.Error()
+	e.marker.UploadStatusReport(report)
+
+	if e.marker.restarts >= maxRestarts {
+		return ErrorInObjectSet{S3ObjectSet: e.S3ObjectSet,
+			err: fmt.Errorf("The objects of the set changed %d times while they were processed",
+				e.marker.restarts+1)}.Cleanup()
+	}
+	objects := []S3Object{}
+	for _, object := range e.objects {
+		if e.changed[object.key] {
+			current, err := object.currentVersion()
+			if err != nil {
+				// the next listing tries again
+				l := log.Decorate(map[string]string{"marker": e.marker.key, "file": object.key})
+				l(log.LogE(err)).Error("Error in reading the new version of the object")
+				return PipelineOutput{}
+			}
+			object = object.refreshed(current)
+		}
+		objects = append(objects, object)
+	}
+	marker := e.marker
+	marker.restarts++
+	return PipelineOutput{Restart: NewS3ObjectSet(marker, objects)}
+}
@@ -0,0 +1,194 @@
+package lib
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestMarkerPrefix(t *testing.T) {
+	tests := []struct {
+		key    string
+		prefix string
+		marker bool
+	}{
+		{".ready", "", true},
+		{"MANIFEST", "", true},
+		{"a/b/.ready", "a/b/", true},
+		{"a/MANIFEST", "a/", true},
+		{"a/b.tar", "a/", false},
+		{"a/not.ready", "a/", false},
+	}
+	for _, test := range tests {
+		if prefix := markerPrefix(test.key); prefix != test.prefix {
+			t.Errorf("%s: expected the prefix %q, got %q", test.key, test.prefix, prefix)
+		}
+		if marker := isCompletionMarker(test.key); marker != test.marker {
+			t.Errorf("%s: expected marker %t, got %t", test.key, test.marker, marker)
+		}
+	}
+}
+
+func TestGroupByCompletionMarker(t *testing.T) {
+	tests := []struct {
+		name      string
+		keys      []string
+		manifests map[string]string
+		// marker: keys of the group, in order, or "error"
+		groups map[string]string
+	}{
+		{
+			name:   "ready",
+			keys:   []string{"a/2.tar", "a/1.tar", "a/notes.txt", "a/.ready", "b/3.tar"},
+			groups: map[string]string{"a/.ready": "a/1.tar,a/2.tar"},
+		},
+		{
+			name:   "no marker",
+			keys:   []string{"a/1.tar"},
+			groups: map[string]string{},
+		},
+		{
+			name:   "nested ready",
+			keys:   []string{".ready", "1.tar", "a/2.tar", "a/.ready"},
+			groups: map[string]string{".ready": "1.tar", "a/.ready": "a/2.tar"},
+		},
+		{
+			name:      "manifest in its order",
+			keys:      []string{"a/MANIFEST", "a/1.tar", "a/2.tar", "a/3.tar"},
+			manifests: map[string]string{"a/MANIFEST": "# comment\n3.tar\n\n1.tar\n"},
+			groups:    map[string]string{"a/MANIFEST": "a/3.tar,a/1.tar"},
+		},
+		{
+			name:      "incomplete manifest",
+			keys:      []string{"a/MANIFEST", "a/1.tar"},
+			manifests: map[string]string{"a/MANIFEST": "1.tar\n2.tar\n"},
+			groups:    map[string]string{},
+		},
+		{
+			name:      "incomplete manifest keeps its objects",
+			keys:      []string{".ready", "0.tar", "a/MANIFEST", "a/1.tar"},
+			manifests: map[string]string{"a/MANIFEST": "1.tar\n2.tar\n"},
+			groups:    map[string]string{".ready": "0.tar"},
+		},
+		{
+			name:      "manifest outside of its prefix",
+			keys:      []string{"a/MANIFEST", "b.tar"},
+			manifests: map[string]string{"a/MANIFEST": "../b.tar\n"},
+			groups:    map[string]string{"a/MANIFEST": "error"},
+		},
+		{
+			name:      "manifest listing twice",
+			keys:      []string{"a/MANIFEST", "a/1.tar"},
+			manifests: map[string]string{"a/MANIFEST": "1.tar\n1.tar\n"},
+			groups:    map[string]string{"a/MANIFEST": "error"},
+		},
+		{
+			name:      "manifest listing the objects of a closer marker",
+			keys:      []string{"MANIFEST", "a/.ready", "a/1.tar"},
+			manifests: map[string]string{"MANIFEST": "a/1.tar\n"},
+			groups:    map[string]string{"MANIFEST": "error", "a/.ready": "a/1.tar"},
+		},
+	}
+	for _, test := range tests {
+		sess, stop := fakeS3(t, func(w http.ResponseWriter, r *http.Request) {
+			content, ok := test.manifests[strings.TrimPrefix(r.URL.Path, "/bucket/")]
+			if !ok {
+				s3Error(w, http.StatusNotFound, "NoSuchKey")
+				return
+			}
+			w.Write([]byte(content))
+		})
+		bucket := S3Bucket{BucketName: "bucket", Session: *sess}
+		objects := []s3.Object{}
+		for _, key := range test.keys {
+			objects = append(objects, s3.Object{Key: aws.String(key)})
+		}
+
+		groups, err := bucket.GroupByCompletionMarker(objects)
+		stop()
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", test.name, err)
+			continue
+		}
+		found := map[string]string{}
+		for _, group := range groups {
+			keys := []string{}
+			for _, object := range group.Objects {
+				keys = append(keys, *object.Key)
+			}
+			found[*group.Marker.Key] = strings.Join(keys, ",")
+			if group.Err != nil {
+				found[*group.Marker.Key] = "error"
+			}
+		}
+		if len(found) != len(test.groups) {
+			t.Errorf("%s: expected the groups %v, got %v", test.name, test.groups, found)
+			continue
+		}
+		for marker, keys := range test.groups {
+			if found[marker] != keys {
+				t.Errorf("%s: expected the group %s to be %q, got %q", test.name, marker, keys, found[marker])
+			}
+		}
+	}
+}
+
+func TestGroupByCompletionMarkerUnreadableManifest(t *testing.T) {
+	sess, stop := fakeS3(t, func(w http.ResponseWriter, r *http.Request) {
+		s3Error(w, http.StatusForbidden, "AccessDenied")
+	})
+	defer stop()
+	bucket := S3Bucket{BucketName: "bucket", Session: *sess}
+
+	_, err := bucket.GroupByCompletionMarker([]s3.Object{{Key: aws.String("MANIFEST")}})
+	if err == nil {
+		t.Errorf("expected an error for the unreadable manifest")
+	}
+}
+
+func TestObjectSetProcessed(t *testing.T) {
+	path, cleanup := newTestJournal(t)
+	defer cleanup()
+	journal, err := OpenJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer journal.Close()
+
+	ingested := time.Now().Add(-time.Hour)
+	object := func(key string, modified time.Time) S3Object {
+		return NewS3Object("data", "status", s3.Object{Key: aws.String(key), LastModified: aws.Time(modified)},
+			nil, nil, &BucketConfiguration{}, journal)
+	}
+	marker := object("set/.ready", ingested)
+	members := []S3Object{object("set/a.tar", ingested), object("set/b.tar", ingested)}
+	for _, o := range append([]S3Object{marker}, members...) {
+		if err := journal.Record("data", NewStatusReport(o, "SUCCESS")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name      string
+		marker    S3Object
+		members   []S3Object
+		processed bool
+	}{
+		{"ingested", marker, members, true},
+		// the new object waits for a new marker
+		{"object added later", marker, append(members, object("set/c.tar", time.Now())), true},
+		{"object modified later", marker, []S3Object{members[0], object("set/b.tar", time.Now())}, true},
+		{"marker uploaded again", object("set/.ready", time.Now()),
+			append(members, object("set/c.tar", time.Now())), false},
+	}
+	for _, test := range tests {
+		set := NewS3ObjectSet(test.marker, test.members)
+		if processed := set.Processed(); processed != test.processed {
+			t.Errorf("%s: expected processed %t, got %t", test.name, test.processed, processed)
+		}
+	}
+}
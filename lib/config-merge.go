@@ -0,0 +1,115 @@
+package lib
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/BurntSushi/toml"
+)
+
+/*
+The settings shared by many portals can be written only once:
+
+	[defaults]
+	region = "us-east-1"
+
+	[backends.ceph]
+	host-url = "https://s3.example.org"
+	access-key = "..."
+	secret-key = "..."
+
+	[[credentials]]
+	backend = "ceph"
+	bucket = "repo-a"
+	cvmfs-repo = "a.example.org"
+
+Each portal is the merge of the defaults, of its backend and of its own keys,
+in this order, the later ones win. Tables are merged key by key, arrays are
+replaced.
+The file is merged as raw TOML and decoded only afterwards, so every setting
+can be in any section.
+*/
+
+const (
+	defaultsSection = "defaults"
+	backendsSection = "backends"
+)
+
+// expandSections merges the defaults and the backends into the portals, the
+// configurations without them are returned as they are
+func expandSections(content string) (string, ConfigProblems, error) {
+	problems := ConfigProblems{}
+	raw := make(map[string]interface{})
+	if _, err := toml.Decode(content, &raw); err != nil {
+		return "", problems, err
+	}
+	_, hasDefaults := raw[defaultsSection]
+	_, hasBackends := raw[backendsSection]
+	if !hasDefaults && !hasBackends {
+		return content, problems, nil
+	}
+
+	defaults, ok := asTable(raw[defaultsSection])
+	if !ok {
+		problems.add("[%s] must be a table", defaultsSection)
+	}
+	backends, ok := asTable(raw[backendsSection])
+	if !ok {
+		problems.add("[%s] must be a table of backends", backendsSection)
+	}
+	portals, ok := raw["credentials"].([]map[string]interface{})
+	if !ok && raw["credentials"] != nil {
+		problems.add("credentials must be an array of tables, [[credentials]]")
+	}
+
+	merged := []map[string]interface{}{}
+	for i, portal := range portals {
+		result := mergeTables(map[string]interface{}{}, defaults)
+		if name, ok := portal["backend"]; ok {
+			backend, found := asTable(backends[fmt.Sprint(name)])
+			if _, exists := backends[fmt.Sprint(name)]; !exists || !found {
+				problems.add("The portal %d refers to the backend %v, but there is no [%s.%v]",
+					i+1, name, backendsSection, name)
+			}
+			result = mergeTables(result, backend)
+		}
+		merged = append(merged, mergeTables(result, portal))
+	}
+
+	delete(raw, defaultsSection)
+	delete(raw, backendsSection)
+	raw["credentials"] = merged
+
+	var buffer bytes.Buffer
+	if err := toml.NewEncoder(&buffer).Encode(raw); err != nil {
+		return "", problems, fmt.Errorf("Error in merging the defaults and the backends: %s", err)
+	}
+	return buffer.String(), problems, nil
+}
+
+func asTable(value interface{}) (map[string]interface{}, bool) {
+	if value == nil {
+		return map[string]interface{}{}, true
+	}
+	table, ok := value.(map[string]interface{})
+	return table, ok
+}
+
+// mergeTables copies src into dst, the tables present in both are merged,
+// everything else in src replaces what is in dst
+func mergeTables(dst, src map[string]interface{}) map[string]interface{} {
+	for key, value := range src {
+		srcTable, srcIsTable := value.(map[string]interface{})
+		dstTable, dstIsTable := dst[key].(map[string]interface{})
+		if srcIsTable && dstIsTable {
+			dst[key] = mergeTables(mergeTables(map[string]interface{}{}, dstTable), srcTable)
+			continue
+		}
+		if srcIsTable {
+			dst[key] = mergeTables(map[string]interface{}{}, srcTable)
+			continue
+		}
+		dst[key] = value
+	}
+	return dst
+}
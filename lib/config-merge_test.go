@@ -0,0 +1,182 @@
+package lib
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMergeTables(t *testing.T) {
+	dst := map[string]interface{}{
+		"region": "us-east-1",
+		"acl":    []interface{}{"a"},
+		"signature": map[string]interface{}{
+			"keyring":  "/etc/keyring",
+			"required": false,
+		},
+	}
+	src := map[string]interface{}{
+		"region": "eu-west-1",
+		"acl":    []interface{}{"b", "c"},
+		"signature": map[string]interface{}{
+			"required": true,
+		},
+		"bucket": "data",
+	}
+	merged := mergeTables(map[string]interface{}{}, dst)
+	merged = mergeTables(merged, src)
+
+	expected := map[string]interface{}{
+		"region": "eu-west-1",
+		// arrays are replaced, not merged
+		"acl": []interface{}{"b", "c"},
+		"signature": map[string]interface{}{
+			"keyring":  "/etc/keyring",
+			"required": true,
+		},
+		"bucket": "data",
+	}
+	if !reflect.DeepEqual(merged, expected) {
+		t.Errorf("expected %v, got %v", expected, merged)
+	}
+	if dst["signature"].(map[string]interface{})["required"] != false {
+		t.Errorf("the tables merged are modified")
+	}
+}
+
+func TestConfigSections(t *testing.T) {
+	const sections = `
+[defaults]
+region = "eu-west-1"
+quiet-period = "1m"
+
+[backends.ceph]
+host-url = "https://ceph.example.org"
+access-key = "CEPHKEY"
+secret-key = "CEPHSECRET"
+
+[backends.minio]
+host-url = "http://minio.example.org"
+region = "local"
+access-key = "MINIOKEY"
+secret-key = "MINIOSECRET"
+`
+	tests := []struct {
+		name    string
+		content string
+		check   func(t *testing.T, credentials []BucketConfiguration)
+		err     string
+	}{
+		{
+			name: "backend and defaults",
+			content: sections + `
+[[credentials]]
+backend = "ceph"
+bucket = "a"
+cvmfs-repo = "a.example.org"
+`,
+			check: func(t *testing.T, credentials []BucketConfiguration) {
+				bc := credentials[0]
+				if bc.HostURL != "https://ceph.example.org" || bc.AccessKey != "CEPHKEY" ||
+					bc.Region != "eu-west-1" || bc.QuietPeriod.String() != "1m0s" {
+					t.Errorf("not merged: %v", bc)
+				}
+			},
+		},
+		{
+			name: "the portal overrides its backend",
+			content: sections + `
+[[credentials]]
+backend = "minio"
+bucket = "b"
+cvmfs-repo = "b.example.org"
+access-key = "OWNKEY"
+`,
+			check: func(t *testing.T, credentials []BucketConfiguration) {
+				bc := credentials[0]
+				// the backend overrides the defaults, the portal both
+				if bc.Region != "local" || bc.AccessKey != "OWNKEY" || bc.SecretKey != "MINIOSECRET" {
+					t.Errorf("wrong precedence: %v", bc)
+				}
+			},
+		},
+		{
+			name: "portals on different backends",
+			content: sections + `
+[[credentials]]
+backend = "ceph"
+bucket = "a"
+cvmfs-repo = "a.example.org"
+
+[[credentials]]
+backend = "minio"
+bucket = "a"
+cvmfs-repo = "b.example.org"
+`,
+			check: func(t *testing.T, credentials []BucketConfiguration) {
+				if len(credentials) != 2 || credentials[0].AccessKey != "CEPHKEY" || credentials[1].AccessKey != "MINIOKEY" {
+					t.Errorf("wrong portals: %v", credentials)
+				}
+			},
+		},
+		{
+			name: "flat configuration",
+			content: `
+[[credentials]]
+bucket = "a"
+cvmfs-repo = "a.example.org"
+access-key = "KEY"
+secret-key = "SECRET"
+`,
+			check: func(t *testing.T, credentials []BucketConfiguration) {
+				if credentials[0].AccessKey != "KEY" || credentials[0].Region != "us-east-1" {
+					t.Errorf("wrong portal: %v", credentials[0])
+				}
+			},
+		},
+		{
+			name: "unknown backend",
+			content: sections + `
+[[credentials]]
+backend = "s3"
+bucket = "a"
+cvmfs-repo = "a.example.org"
+access-key = "KEY"
+secret-key = "SECRET"
+`,
+			err: "refers to the backend s3, but there is no [backends.s3]",
+		},
+		{
+			name: "unknown key in a backend",
+			content: sections + `
+[backends.ceph.signature]
+keyrnig = "/etc/keyring"
+
+[[credentials]]
+backend = "ceph"
+bucket = "a"
+cvmfs-repo = "a.example.org"
+`,
+			err: "Unknown key credentials.signature.keyrnig at line 18",
+		},
+		{
+			name:    "defaults not a table",
+			content: "defaults = 1\n" + validPortal,
+			err:     "[defaults] must be a table",
+		},
+	}
+	for _, test := range tests {
+		config, err := parseTestConfig(t, test.content)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: expected an error containing %q, got %v", test.name, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", test.name, err)
+			continue
+		}
+		test.check(t, config.Credentials)
+	}
+}
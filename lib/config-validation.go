@@ -0,0 +1,156 @@
+package lib
+
+import (
+	"bufio"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// ConfigProblems are all the problems found in the configuration file, they
+// are reported all together so that they can be fixed in one go
+type ConfigProblems []string
+
+func (p ConfigProblems) Error() string {
+	if len(p) == 1 {
+		return p[0]
+	}
+	return fmt.Sprintf("%d problems in the configuration:\n%s", len(p), strings.Join(p, "\n"))
+}
+
+func (p *ConfigProblems) add(format string, args ...interface{}) {
+	*p = append(*p, fmt.Sprintf(format, args...))
+}
+
+// undecodedKeys reports the keys of the file that do not correspond to any
+// setting, they are usually typos
+func undecodedKeys(meta toml.MetaData, content string) ConfigProblems {
+	problems := ConfigProblems{}
+	undecoded := meta.Undecoded()
+	if len(undecoded) == 0 {
+		return problems
+	}
+	lines := keyLines(content)
+	reported := make(map[string]bool)
+	for _, key := range undecoded {
+		name := key.String()
+		// the same key in many portals, or in the defaults, is reported
+		// only once
+		if reported[name] {
+			continue
+		}
+		reported[name] = true
+		if where := keyWhere(lines, name); len(where) > 0 {
+			problems.add("Unknown key %s at line %s", name, strings.Join(where, ", "))
+		} else {
+			problems.add("Unknown key %s", name)
+		}
+	}
+	return problems
+}
+
+// keyWhere finds the lines of a key of a portal, it may be written in the
+// portal itself, in the defaults or in a backend
+func keyWhere(lines map[string][]string, name string) []string {
+	if !strings.HasPrefix(name, "credentials.") {
+		return lines[name]
+	}
+	suffix := strings.TrimPrefix(name, "credentials.")
+	where := append([]string{}, lines[name]...)
+	where = append(where, lines[defaultsSection+"."+suffix]...)
+	for full, at := range lines {
+		if strings.HasPrefix(full, backendsSection+".") &&
+			strings.HasSuffix(full, "."+suffix) &&
+			strings.Count(full, ".") == strings.Count(suffix, ".")+2 {
+			where = append(where, at...)
+		}
+	}
+	sort.Slice(where, func(i, j int) bool {
+		a, _ := strconv.Atoi(where[i])
+		b, _ := strconv.Atoi(where[j])
+		return a < b
+	})
+	return where
+}
+
+// keyLines maps the full name of every key, and table, of the file to the
+// lines where it appears
+func keyLines(content string) map[string][]string {
+	lines := make(map[string][]string)
+	table := ""
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name := ""
+		if strings.HasPrefix(line, "[") {
+			end := strings.Index(line, "]")
+			if end < 0 {
+				continue
+			}
+			table = strings.Trim(line[:end], "[ ")
+			name = table
+		} else if eq := strings.Index(line, "="); eq > 0 {
+			key := strings.Trim(strings.TrimSpace(line[:eq]), `"'`)
+			name = key
+			if table != "" {
+				name = table + "." + key
+			}
+		}
+		if name != "" {
+			lines[name] = append(lines[name], fmt.Sprintf("%d", n))
+		}
+	}
+	return lines
+}
+
+func validateHostURL(hostURL string) error {
+	if hostURL == "" {
+		return nil
+	}
+	u, err := url.Parse(hostURL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("%s must start with http:// or https://", hostURL)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("%s has no host", hostURL)
+	}
+	return nil
+}
+
+// duplicatedBuckets reports the buckets used by more than one portal, either
+// as data or as status bucket
+func duplicatedBuckets(credentials []BucketConfiguration) ConfigProblems {
+	problems := ConfigProblems{}
+	type use struct {
+		portal int
+		role   string
+	}
+	uses := make(map[string]use)
+	check := func(portal int, bc BucketConfiguration, role, bucket string) {
+		if bucket == "" {
+			return
+		}
+		id := bc.HostURL + "/" + bucket
+		if previous, ok := uses[id]; ok {
+			problems.add("The bucket %s is the %s of portal %d and the %s of portal %d",
+				bucket, previous.role, previous.portal, role, portal)
+			return
+		}
+		uses[id] = use{portal, role}
+	}
+	for i, bc := range credentials {
+		check(i+1, bc, "bucket", bc.Bucket)
+		check(i+1, bc, "status-bucket", bc.StatusBucket)
+	}
+	return problems
+}
@@ -0,0 +1,144 @@
+package lib
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+// parseTestConfig parses content as the configuration file
+func parseTestConfig(t *testing.T, content string) (Config, error) {
+	f, err := ioutil.TempFile("", "portals-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(content)
+	f.Close()
+	return ParseConfig(f.Name())
+}
+
+const validPortal = `
+[[credentials]]
+bucket = "data"
+cvmfs-repo = "repo.example.org"
+access-key = "AKID"
+secret-key = "SECRET"
+`
+
+func TestConfigValidation(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		// expected problems, as substrings, none if empty
+		problems []string
+	}{
+		{"valid", validPortal, nil},
+		{"no portal", `spool-dir = "/var/spool/portals"`, []string{"No portal configured"}},
+		{
+			"unknown keys with their lines",
+			"spoolDir = \"/srv\"\n" + validPortal + "regoin = \"eu\"\n",
+			[]string{"Unknown key spoolDir at line 1", "Unknown key credentials.regoin at line 8"},
+		},
+		{
+			"missing bucket and repository",
+			"[[credentials]]\naccess-key = \"AKID\"\nsecret-key = \"SECRET\"\n",
+			[]string{"The bucket of the portal 1 is missing", "The cvmfs-repo of the portal 1 is missing"},
+		},
+		{"host-url without scheme", validPortal + `host-url = "s3.example.org"`, []string{"http:// or https://"}},
+		{"host-url without host", validPortal + `host-url = "https://"`, []string{"has no host"}},
+		{"host-url", validPortal + `host-url = "https://s3.example.org:8443"`, nil},
+		{"static credentials without keys", "[[credentials]]\nbucket = \"data\"\ncvmfs-repo = \"r\"\n", []string{"access-key and secret-key"}},
+		{"relative spool-dir", `spool-dir = "spool"` + "\n" + validPortal, []string{"not an absolute path"}},
+		{"spool-dir in the temporary directory", `spool-dir = "` + os.TempDir() + `"` + "\n" + validPortal, []string{"shared with other processes"}},
+		{"webhook without token", "[webhook]\nlisten = \":8080\"\n" + validPortal, []string{"without a token"}},
+		{"webhook", "[webhook]\nlisten = \":8080\"\ntoken = \"secret-token\"\n" + validPortal, nil},
+		{"poll intervals", validPortal + "poll-interval = \"10m\"\nmax-poll-interval = \"1m\"\n", []string{"must not be shorter"}},
+		{"same bucket twice", validPortal + validPortal, []string{
+			"The bucket data is the bucket of portal 1 and the bucket of portal 2",
+			"The bucket data.status is the status-bucket of portal 1 and the status-bucket of portal 2",
+		}},
+		{
+			"status bucket of another portal",
+			validPortal + "[[credentials]]\nbucket = \"data.status\"\ncvmfs-repo = \"r\"\naccess-key = \"A\"\nsecret-key = \"S\"\n",
+			[]string{"The bucket data.status is the status-bucket of portal 1 and the bucket of portal 2"},
+		},
+		{
+			"same bucket on two hosts",
+			validPortal + "host-url = \"https://a.example.org\"\n" + validPortal + "host-url = \"https://b.example.org\"\n",
+			nil,
+		},
+		{
+			"all the problems together",
+			"[[credentials]]\nhost-url = \"ftp://x\"\n",
+			[]string{"bucket of the portal 1", "cvmfs-repo", "http:// or https://", "access-key and secret-key"},
+		},
+	}
+	for _, test := range tests {
+		_, err := parseTestConfig(t, test.content)
+		if len(test.problems) == 0 {
+			if err != nil {
+				t.Errorf("%s: unexpected error %s", test.name, err)
+			}
+			continue
+		}
+		problems, ok := err.(ConfigProblems)
+		if !ok {
+			t.Errorf("%s: expected ConfigProblems, got %v", test.name, err)
+			continue
+		}
+		if len(problems) != len(test.problems) {
+			t.Errorf("%s: expected %d problems, got %q", test.name, len(test.problems), problems)
+		}
+		for _, expected := range test.problems {
+			if !strings.Contains(problems.Error(), expected) {
+				t.Errorf("%s: expected the problem %q, got %q", test.name, expected, problems)
+			}
+		}
+	}
+}
+
+func TestConfigDefaults(t *testing.T) {
+	config, err := parseTestConfig(t, validPortal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.SpoolDir != DefaultSpoolDir || config.Journal != DefaultJournal {
+		t.Errorf("wrong defaults: spool-dir %s, journal %s", config.SpoolDir, config.Journal)
+	}
+	bc := config.Credentials[0]
+	if bc.StatusBucket != "data.status" || bc.Region != "us-east-1" ||
+		bc.CredentialSource.Type != CredentialsStatic || bc.SpoolDir != DefaultSpoolDir ||
+		bc.TagTemplate != DefaultTagTemplate || bc.Order != OrderOldestFirst {
+		t.Errorf("wrong defaults of the portal: %v", bc)
+	}
+
+	config, err = parseTestConfig(t, validPortal+`region = "eu-west-1"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Credentials[0].Region != "eu-west-1" {
+		t.Errorf("the region is not set: %s", config.Credentials[0].Region)
+	}
+}
+
+func TestValidateHostURL(t *testing.T) {
+	tests := []struct {
+		url   string
+		valid bool
+	}{
+		{"", true},
+		{"http://localhost:9000", true},
+		{"https://s3.example.org", true},
+		{"s3.example.org", false},
+		{"ftp://s3.example.org", false},
+		{"https://", false},
+		{"http://[::1", false},
+	}
+	for _, test := range tests {
+		if err := validateHostURL(test.url); (err == nil) != test.valid {
+			t.Errorf("%q: expected valid %t, got %v", test.url, test.valid, err)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package lib
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/cvmfs/portals/log"
+
+	"github.com/BurntSushi/toml"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+const (
+	// access-key and secret-key from the configuration file
+	CredentialsStatic = "static"
+	// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN
+	CredentialsEnv = "env"
+	// access-key and secret-key from a separate file readable only by its
+	// owner
+	CredentialsFile = "file"
+	// a profile of the AWS shared credentials file
+	CredentialsProfile = "profile"
+)
+
+// CredentialSource selects where the credentials of a bucket come from, with
+// an assume-role section they are used to obtain temporary credentials for
+// the role
+type CredentialSource struct {
+	Type string `toml:"type"`
+	// secrets file of the "file" source
+	Path string `toml:"path"`
+	// profile and shared credentials file of the "profile" source, by
+	// default the ones of the AWS SDK
+	Profile               string `toml:"profile"`
+	SharedCredentialsFile string `toml:"shared-credentials-file"`
+
+	AssumeRole *AssumeRole `toml:"assume-role"`
+}
+
+type AssumeRole struct {
+	RoleARN     string   `toml:"role-arn"`
+	SessionName string   `toml:"session-name"`
+	ExternalID  string   `toml:"external-id"`
+	Duration    Duration `toml:"duration"`
+	// endpoint of STS, by default the one of AWS, S3 compatible stores
+	// usually serve it on the same host-url of S3
+	Endpoint string `toml:"endpoint"`
+}
+
+// Validate checks the source, bc is the bucket configuration that holds it
+func (source CredentialSource) Validate(bc BucketConfiguration) error {
+	switch source.Type {
+	case CredentialsStatic:
+		if bc.AccessKey == "" || bc.SecretKey == "" {
+			return fmt.Errorf("access-key and secret-key are required with static credentials")
+		}
+	case CredentialsEnv, CredentialsProfile:
+	case CredentialsFile:
+		if source.Path == "" {
+			return fmt.Errorf("The path of the secrets file is required")
+		}
+		if _, err := readSecretsFile(source.Path); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("Unknown credential source %q", source.Type)
+	}
+	if source.AssumeRole != nil && source.AssumeRole.RoleARN == "" {
+		return fmt.Errorf("The role-arn is required to assume a role")
+	}
+	return nil
+}
+
+// NewCredentials builds the credentials of the bucket configuration
+func NewCredentials(bc BucketConfiguration) (*credentials.Credentials, error) {
+	source := bc.CredentialSource
+	var provider credentials.Provider
+	switch source.Type {
+	case CredentialsStatic:
+		static, err := NewS3CredentialProvider(bc.AccessKey, bc.SecretKey)
+		if err != nil {
+			return nil, err
+		}
+		provider = static
+	case CredentialsEnv:
+		provider = &credentials.EnvProvider{}
+	case CredentialsFile:
+		provider = &secretsFileProvider{path: source.Path}
+	case CredentialsProfile:
+		provider = &credentials.SharedCredentialsProvider{
+			Filename: source.SharedCredentialsFile,
+			Profile:  source.Profile,
+		}
+	default:
+		return nil, fmt.Errorf("Unknown credential source %q", source.Type)
+	}
+	creds := credentials.NewCredentials(&redactingProvider{Provider: provider})
+	if source.AssumeRole == nil {
+		return creds, nil
+	}
+
+	// STS is reached with the base credentials, the temporary credentials
+	// are refreshed by the SDK before they expire
+	role := source.AssumeRole
+	stsConfig := aws.NewConfig().
+		WithCredentials(creds).
+		WithRegion(bc.Region)
+	if role.Endpoint != "" {
+		stsConfig = stsConfig.WithEndpoint(role.Endpoint)
+	}
+	sess, err := session.NewSession(stsConfig)
+	if err != nil {
+		return nil, fmt.Errorf("Error in creating the STS session: %s", err)
+	}
+	assumeRole := &stscreds.AssumeRoleProvider{
+		Client:   sts.New(sess),
+		RoleARN:  role.RoleARN,
+		Duration: stscreds.DefaultDuration,
+	}
+	if role.SessionName != "" {
+		assumeRole.RoleSessionName = role.SessionName
+	}
+	if role.ExternalID != "" {
+		assumeRole.ExternalID = aws.String(role.ExternalID)
+	}
+	if role.Duration.Duration > 0 {
+		assumeRole.Duration = role.Duration.Duration
+	}
+	return credentials.NewCredentials(&redactingProvider{Provider: assumeRole}), nil
+}
+
+// redactingProvider keeps out of the logs the secrets that the provider
+// retrieves, also the ones of the environment, of the shared profiles and
+// the temporary credentials of STS, that are not in the configuration
+type redactingProvider struct {
+	credentials.Provider
+	// the last credentials retrieved, their secrets are replaced when the
+	// credentials are rotated
+	last credentials.Value
+}
+
+func (p *redactingProvider) Retrieve() (credentials.Value, error) {
+	value, err := p.Provider.Retrieve()
+	if err != nil {
+		return value, err
+	}
+	log.ReplaceSecret(p.last.SecretAccessKey, value.SecretAccessKey)
+	log.ReplaceSecret(p.last.SessionToken, value.SessionToken)
+	p.last = value
+	return value, nil
+}
+
+type secretsFile struct {
+	AccessKey    string `toml:"access-key"`
+	SecretKey    string `toml:"secret-key"`
+	SessionToken string `toml:"session-token"`
+}
+
+// readSecretsFile reads the TOML secrets file, refusing it if anybody but its
+// owner can access it
+func readSecretsFile(path string) (secrets secretsFile, err error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		err = fmt.Errorf("The secrets file %s is accessible by other users (mode %s), it must be 0600 or 0400",
+			path, info.Mode().Perm())
+		return
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	if err = toml.Unmarshal(content, &secrets); err != nil {
+		err = fmt.Errorf("Error in parsing the secrets file %s: %s", path, err)
+		return
+	}
+	if secrets.AccessKey == "" || secrets.SecretKey == "" {
+		err = fmt.Errorf("The secrets file %s must contain access-key and secret-key", path)
+	}
+	return
+}
+
+// secretsFileProvider reads the credentials from the secrets file, they are
+// read again whenever the file changes, so that the keys can be rotated
+// without restarting the daemon
+type secretsFileProvider struct {
+	path string
+
+	mutex   sync.Mutex
+	modTime time.Time
+}
+
+func (p *secretsFileProvider) Retrieve() (credentials.Value, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	info, err := os.Stat(p.path)
+	if err != nil {
+		return credentials.Value{}, err
+	}
+	secrets, err := readSecretsFile(p.path)
+	if err != nil {
+		return credentials.Value{}, err
+	}
+	p.modTime = info.ModTime()
+	return credentials.Value{
+		AccessKeyID:     secrets.AccessKey,
+		SecretAccessKey: secrets.SecretKey,
+		SessionToken:    secrets.SessionToken,
+		ProviderName:    "SecretsFileProvider",
+	}, nil
+}
+
+func (p *secretsFileProvider) IsExpired() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	info, err := os.Stat(p.path)
+	if err != nil {
+		return true
+	}
+	return !info.ModTime().Equal(p.modTime)
+}
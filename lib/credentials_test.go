@@ -0,0 +1,217 @@
+package lib
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cvmfs/portals/log"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+)
+
+func writeSecretsFile(t *testing.T, dir, content string, mode os.FileMode) string {
+	path := filepath.Join(dir, "secrets.toml")
+	if err := ioutil.WriteFile(path, []byte(content), mode); err != nil {
+		t.Fatal(err)
+	}
+	// WriteFile does not change the mode of an existing file
+	if err := os.Chmod(path, mode); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestCredentialSourceValidate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "portals-credentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	private := filepath.Join(dir, "private.toml")
+	ioutil.WriteFile(private, []byte("access-key = \"AKID\"\nsecret-key = \"SECRET\"\n"), 0600)
+	readable := filepath.Join(dir, "readable.toml")
+	ioutil.WriteFile(readable, []byte("access-key = \"AKID\"\nsecret-key = \"SECRET\"\n"), 0644)
+	os.Chmod(readable, 0644)
+	incomplete := filepath.Join(dir, "incomplete.toml")
+	ioutil.WriteFile(incomplete, []byte("access-key = \"AKID\"\n"), 0600)
+
+	static := BucketConfiguration{AccessKey: "AKID", SecretKey: "SECRET"}
+	tests := []struct {
+		name   string
+		bc     BucketConfiguration
+		source CredentialSource
+		err    string
+	}{
+		{"static", static, CredentialSource{Type: CredentialsStatic}, ""},
+		{"static without keys", BucketConfiguration{}, CredentialSource{Type: CredentialsStatic}, "access-key and secret-key"},
+		{"env", BucketConfiguration{}, CredentialSource{Type: CredentialsEnv}, ""},
+		{"profile", BucketConfiguration{}, CredentialSource{Type: CredentialsProfile, Profile: "portals"}, ""},
+		{"file", BucketConfiguration{}, CredentialSource{Type: CredentialsFile, Path: private}, ""},
+		{"file without path", BucketConfiguration{}, CredentialSource{Type: CredentialsFile}, "path of the secrets file"},
+		{"file readable by others", BucketConfiguration{}, CredentialSource{Type: CredentialsFile, Path: readable}, "accessible by other users"},
+		{"incomplete file", BucketConfiguration{}, CredentialSource{Type: CredentialsFile, Path: incomplete}, "must contain"},
+		{"missing file", BucketConfiguration{}, CredentialSource{Type: CredentialsFile, Path: filepath.Join(dir, "missing")}, "no such file"},
+		{"unknown", BucketConfiguration{}, CredentialSource{Type: "vault"}, "Unknown credential source"},
+		{"assume role", static, CredentialSource{Type: CredentialsStatic, AssumeRole: &AssumeRole{RoleARN: "arn:aws:iam::1:role/r"}}, ""},
+		{"assume role without arn", static, CredentialSource{Type: CredentialsStatic, AssumeRole: &AssumeRole{}}, "role-arn"},
+	}
+	for _, test := range tests {
+		err := test.source.Validate(test.bc)
+		if test.err == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error %s", test.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: expected an error containing %q, got %v", test.name, test.err, err)
+		}
+	}
+}
+
+func TestNewCredentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "portals-credentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	secrets := writeSecretsFile(t, dir, "access-key = \"FILEKEY\"\nsecret-key = \"FILESECRET\"\nsession-token = \"FILETOKEN\"\n", 0600)
+	profiles := filepath.Join(dir, "credentials")
+	ioutil.WriteFile(profiles, []byte("[portals]\naws_access_key_id = PROFILEKEY\naws_secret_access_key = PROFILESECRET\n"), 0600)
+
+	for key, value := range map[string]string{
+		"AWS_ACCESS_KEY_ID":     "ENVKEY",
+		"AWS_SECRET_ACCESS_KEY": "ENVSECRET",
+		"AWS_SESSION_TOKEN":     "ENVTOKEN",
+	} {
+		defer os.Setenv(key, os.Getenv(key))
+		os.Setenv(key, value)
+	}
+
+	tests := []struct {
+		name   string
+		bc     BucketConfiguration
+		key    string
+		secret string
+		token  string
+	}{
+		{"static", BucketConfiguration{AccessKey: "STATICKEY", SecretKey: "STATICSECRET",
+			CredentialSource: CredentialSource{Type: CredentialsStatic}}, "STATICKEY", "STATICSECRET", ""},
+		{"env", BucketConfiguration{CredentialSource: CredentialSource{Type: CredentialsEnv}}, "ENVKEY", "ENVSECRET", "ENVTOKEN"},
+		{"file", BucketConfiguration{CredentialSource: CredentialSource{Type: CredentialsFile, Path: secrets}},
+			"FILEKEY", "FILESECRET", "FILETOKEN"},
+		{"profile", BucketConfiguration{CredentialSource: CredentialSource{Type: CredentialsProfile,
+			Profile: "portals", SharedCredentialsFile: profiles}}, "PROFILEKEY", "PROFILESECRET", ""},
+	}
+	for _, test := range tests {
+		creds, err := NewCredentials(test.bc)
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", test.name, err)
+			continue
+		}
+		value, err := creds.Get()
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", test.name, err)
+			continue
+		}
+		if value.AccessKeyID != test.key || value.SecretAccessKey != test.secret || value.SessionToken != test.token {
+			t.Errorf("%s: wrong credentials %s %s %s", test.name, value.AccessKeyID, value.SecretAccessKey, value.SessionToken)
+		}
+		for _, secret := range []string{test.secret, test.token} {
+			if secret != "" && log.RedactString(secret) == secret {
+				t.Errorf("%s: the secret %s is not kept out of the logs", test.name, secret)
+			}
+		}
+	}
+
+	if _, err := NewCredentials(BucketConfiguration{CredentialSource: CredentialSource{Type: CredentialsStatic}}); err == nil {
+		t.Errorf("expected an error for the static credentials without keys")
+	}
+}
+
+// rotatingProvider returns new temporary credentials at every retrieve
+type rotatingProvider struct {
+	retrieved int
+}
+
+func (p *rotatingProvider) Retrieve() (credentials.Value, error) {
+	p.retrieved++
+	return credentials.Value{
+		AccessKeyID:     "TEMPKEY",
+		SecretAccessKey: fmt.Sprintf("temporary-secret-%d", p.retrieved),
+		SessionToken:    fmt.Sprintf("temporary-token-%d", p.retrieved),
+	}, nil
+}
+
+func (p *rotatingProvider) IsExpired() bool {
+	return true
+}
+
+func TestRedactingProvider(t *testing.T) {
+	provider := &redactingProvider{Provider: &rotatingProvider{}}
+	for i := 0; i < 2; i++ {
+		if _, err := provider.Retrieve(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		secret   string
+		redacted bool
+	}{
+		{"temporary-secret-2", true},
+		{"temporary-token-2", true},
+		// replaced by the rotation
+		{"temporary-secret-1", false},
+		{"temporary-token-1", false},
+	}
+	for _, test := range tests {
+		if redacted := log.RedactString(test.secret) != test.secret; redacted != test.redacted {
+			t.Errorf("%s: expected redacted %t, got %t", test.secret, test.redacted, redacted)
+		}
+	}
+}
+
+func TestSecretsFileRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "portals-credentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := writeSecretsFile(t, dir, "access-key = \"OLDKEY\"\nsecret-key = \"OLDSECRET\"\n", 0600)
+
+	provider := &secretsFileProvider{path: path}
+	value, err := provider.Retrieve()
+	if err != nil || value.AccessKeyID != "OLDKEY" {
+		t.Fatalf("wrong credentials %v %v", value, err)
+	}
+	if provider.IsExpired() {
+		t.Errorf("expired without changes to the file")
+	}
+
+	writeSecretsFile(t, dir, "access-key = \"NEWKEY\"\nsecret-key = \"NEWSECRET\"\n", 0600)
+	// the modification time may not change within the resolution of the
+	// filesystem
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(path, later, later)
+	if !provider.IsExpired() {
+		t.Errorf("not expired after the rotation of the keys")
+	}
+	if value, err = provider.Retrieve(); err != nil || value.AccessKeyID != "NEWKEY" {
+		t.Errorf("the rotated keys are not read: %v %v", value, err)
+	}
+
+	os.Chmod(path, 0644)
+	if _, err := provider.Retrieve(); err == nil {
+		t.Errorf("the secrets file readable by others is accepted")
+	}
+	os.Remove(path)
+	if !provider.IsExpired() {
+		t.Errorf("not expired without the secrets file")
+	}
+}
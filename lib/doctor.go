@@ -0,0 +1,273 @@
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/cvmfs/portals/cvmfs"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// the checks done by the doctor, in order, each check is skipped if one of
+// the checks it depends on failed
+var DoctorChecks = []string{
+	"endpoint",
+	"credentials",
+	"bucket",
+	"status-bucket",
+	"list",
+	"get",
+	"status-list",
+	"status-put",
+	"status-get",
+	"status-delete",
+	"cvmfs-repo",
+	"spool",
+}
+
+var doctorDependencies = map[string][]string{
+	"credentials":   {"endpoint"},
+	"bucket":        {"credentials"},
+	"status-bucket": {"credentials"},
+	"list":          {"bucket"},
+	"get":           {"bucket"},
+	"status-list":   {"status-bucket"},
+	"status-put":    {"status-bucket"},
+	"status-get":    {"status-put"},
+	"status-delete": {"status-put"},
+}
+
+const doctorTimeout = 10 * time.Second
+
+type DoctorCheck struct {
+	Name    string
+	Err     error
+	Skipped bool
+}
+
+func (c DoctorCheck) Result() string {
+	switch {
+	case c.Skipped:
+		return "SKIP"
+	case c.Err != nil:
+		return "FAIL"
+	}
+	return "PASS"
+}
+
+type DoctorReport struct {
+	Config BucketConfiguration
+	Checks []DoctorCheck
+}
+
+// Failed is true if any check did not pass
+func (r DoctorReport) Failed() bool {
+	for _, check := range r.Checks {
+		if check.Result() != "PASS" {
+			return true
+		}
+	}
+	return false
+}
+
+type doctor struct {
+	bc     BucketConfiguration
+	couple S3BucketCouple
+	report DoctorReport
+	passed map[string]bool
+	// key of the object written in the status bucket to check the
+	// permissions
+	probeKey string
+	// an object of the data bucket, if there is any
+	dataKey string
+}
+
+// RunDoctor checks that everything the portal needs is in place
+func RunDoctor(bc BucketConfiguration) DoctorReport {
+	hostname, _ := os.Hostname()
+	d := &doctor{
+		bc:       bc,
+		report:   DoctorReport{Config: bc},
+		passed:   make(map[string]bool),
+		probeKey: fmt.Sprintf("portals-doctor/%s-%d", hostname, time.Now().UnixNano()),
+	}
+	checks := map[string]func() error{
+		"endpoint":      d.checkEndpoint,
+		"credentials":   d.checkCredentials,
+		"bucket":        func() error { return d.checkBucket(d.couple.Data) },
+		"status-bucket": func() error { return d.checkBucket(d.couple.Status) },
+		"list":          d.checkList,
+		"get":           d.checkGet,
+		"status-list":   d.checkStatusList,
+		"status-put":    d.checkStatusPut,
+		"status-get":    d.checkStatusGet,
+		"status-delete": d.checkStatusDelete,
+		"cvmfs-repo":    func() error { return cvmfs.CheckRepository(bc.CVMFSRepo) },
+		"spool":         d.checkSpool,
+	}
+	for _, name := range DoctorChecks {
+		d.run(name, checks[name])
+	}
+	return d.report
+}
+
+func (d *doctor) run(name string, check func() error) {
+	for _, dependency := range doctorDependencies[name] {
+		if !d.passed[dependency] {
+			d.report.Checks = append(d.report.Checks, DoctorCheck{Name: name, Skipped: true,
+				Err: fmt.Errorf("Skipped since %s did not pass", dependency)})
+			return
+		}
+	}
+	err := check()
+	d.passed[name] = err == nil
+	d.report.Checks = append(d.report.Checks, DoctorCheck{Name: name, Err: err})
+}
+
+func (d *doctor) endpoint() (string, error) {
+	if d.bc.HostURL != "" {
+		return d.bc.HostURL, nil
+	}
+	resolved, err := endpoints.DefaultResolver().EndpointFor("s3", d.bc.Region)
+	if err != nil {
+		return "", err
+	}
+	return resolved.URL, nil
+}
+
+func (d *doctor) checkEndpoint() error {
+	endpoint, err := d.endpoint()
+	if err != nil {
+		return err
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return err
+	}
+	host := u.Host
+	if u.Port() == "" {
+		port := "443"
+		if u.Scheme == "http" {
+			port = "80"
+		}
+		host = net.JoinHostPort(u.Hostname(), port)
+	}
+	conn, err := net.DialTimeout("tcp", host, doctorTimeout)
+	if err != nil {
+		return fmt.Errorf("%s is not reachable: %s", endpoint, err)
+	}
+	conn.Close()
+	return nil
+}
+
+func (d *doctor) checkCredentials() (err error) {
+	d.couple, err = NewS3BucketCouple(d.bc)
+	if err != nil {
+		return err
+	}
+	if _, err = d.couple.Data.Session.Config.Credentials.Get(); err != nil {
+		return fmt.Errorf("Error in retrieving the credentials: %s", err)
+	}
+	return nil
+}
+
+// explain turns the S3 errors into something actionable
+func explain(err error) error {
+	if aerr, ok := err.(awserr.Error); ok {
+		switch aerr.Code() {
+		case "NotFound", s3.ErrCodeNoSuchBucket:
+			return fmt.Errorf("Does not exist")
+		case "Forbidden", "AccessDenied":
+			return fmt.Errorf("Permission denied")
+		case "InvalidAccessKeyId", "SignatureDoesNotMatch":
+			return fmt.Errorf("Credentials refused: %s", aerr.Code())
+		}
+	}
+	return err
+}
+
+func (d *doctor) checkBucket(bucket S3Bucket) error {
+	_, err := s3.New(&bucket.Session).HeadBucket(&s3.HeadBucketInput{
+		Bucket: aws.String(bucket.BucketName),
+	})
+	return explain(err)
+}
+
+func (d *doctor) checkList() error {
+	output, err := s3.New(&d.couple.Data.Session).ListObjectsV2(&s3.ListObjectsV2Input{
+		Bucket:  aws.String(d.couple.Data.BucketName),
+		MaxKeys: aws.Int64(1),
+	})
+	if err != nil {
+		return explain(err)
+	}
+	if len(output.Contents) > 0 {
+		d.dataKey = *output.Contents[0].Key
+	}
+	return nil
+}
+
+func (d *doctor) checkGet() error {
+	key := d.dataKey
+	if key == "" {
+		key = d.probeKey
+	}
+	_, err := s3.New(&d.couple.Data.Session).HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(d.couple.Data.BucketName),
+		Key:    aws.String(key),
+	})
+	// a missing object means that we are allowed to read it
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "NotFound" && d.dataKey == "" {
+		return nil
+	}
+	return explain(err)
+}
+
+func (d *doctor) checkStatusList() error {
+	_, err := s3.New(&d.couple.Status.Session).ListObjectsV2(&s3.ListObjectsV2Input{
+		Bucket:  aws.String(d.couple.Status.BucketName),
+		MaxKeys: aws.Int64(1),
+	})
+	return explain(err)
+}
+
+func (d *doctor) checkStatusPut() error {
+	_, err := s3.New(&d.couple.Status.Session).PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(d.couple.Status.BucketName),
+		Key:    aws.String(d.probeKey),
+		Body:   bytes.NewReader([]byte("portals doctor")),
+	})
+	return explain(err)
+}
+
+func (d *doctor) checkStatusGet() error {
+	_, err := d.couple.Status.GetObjectContent(d.probeKey)
+	return explain(err)
+}
+
+func (d *doctor) checkStatusDelete() error {
+	_, err := s3.New(&d.couple.Status.Session).DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(d.couple.Status.BucketName),
+		Key:    aws.String(d.probeKey),
+	})
+	return explain(err)
+}
+
+func (d *doctor) checkSpool() error {
+	f, err := CreateSpoolFile(d.bc.SpoolDir, "s3temp")
+	if err != nil {
+		return fmt.Errorf("The spool directory %s is not writable: %s", d.bc.SpoolDir, err)
+	}
+	f.Close()
+	os.Remove(f.Name())
+	// at least a part of a download must fit
+	return CheckSpoolSpace(d.bc.SpoolDir, d.bc.DownloadPartSize)
+}
@@ -0,0 +1,165 @@
+package lib
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+// results returns the result of every check, in order
+func results(report DoctorReport) string {
+	r := []string{}
+	for _, check := range report.Checks {
+		r = append(r, check.Name+"="+check.Result())
+	}
+	return strings.Join(r, " ")
+}
+
+func TestDoctorDependencies(t *testing.T) {
+	tests := []struct {
+		name    string
+		failing []string
+		// the results that are not PASS
+		expected map[string]string
+	}{
+		{"all pass", nil, map[string]string{}},
+		{"endpoint unreachable", []string{"endpoint"}, map[string]string{
+			"endpoint": "FAIL", "credentials": "SKIP", "bucket": "SKIP", "status-bucket": "SKIP",
+			"list": "SKIP", "get": "SKIP", "status-list": "SKIP", "status-put": "SKIP",
+			"status-get": "SKIP", "status-delete": "SKIP",
+		}},
+		{"no data bucket", []string{"bucket"}, map[string]string{
+			"bucket": "FAIL", "list": "SKIP", "get": "SKIP",
+		}},
+		{"status bucket read only", []string{"status-put"}, map[string]string{
+			"status-put": "FAIL", "status-get": "SKIP", "status-delete": "SKIP",
+		}},
+		{"independent checks", []string{"cvmfs-repo", "spool"}, map[string]string{
+			"cvmfs-repo": "FAIL", "spool": "FAIL",
+		}},
+	}
+	for _, test := range tests {
+		failing := map[string]bool{}
+		for _, name := range test.failing {
+			failing[name] = true
+		}
+		d := &doctor{passed: make(map[string]bool)}
+		for _, name := range DoctorChecks {
+			name := name
+			d.run(name, func() error {
+				if failing[name] {
+					return fmt.Errorf("%s failed", name)
+				}
+				return nil
+			})
+		}
+
+		if len(d.report.Checks) != len(DoctorChecks) {
+			t.Errorf("%s: expected all the checks, got %s", test.name, results(d.report))
+			continue
+		}
+		for _, check := range d.report.Checks {
+			expected, ok := test.expected[check.Name]
+			if !ok {
+				expected = "PASS"
+			}
+			if check.Result() != expected {
+				t.Errorf("%s: expected %s to %s, got %s", test.name, check.Name, expected, results(d.report))
+			}
+		}
+		if failed := d.report.Failed(); failed != (len(test.expected) > 0) {
+			t.Errorf("%s: wrong failed %t", test.name, failed)
+		}
+	}
+}
+
+func TestExplain(t *testing.T) {
+	tests := []struct {
+		code        string
+		explanation string
+	}{
+		{"NotFound", "Does not exist"},
+		{"NoSuchBucket", "Does not exist"},
+		{"AccessDenied", "Permission denied"},
+		{"Forbidden", "Permission denied"},
+		{"InvalidAccessKeyId", "Credentials refused: InvalidAccessKeyId"},
+		{"SignatureDoesNotMatch", "Credentials refused: SignatureDoesNotMatch"},
+		{"SlowDown", "SlowDown: message"},
+	}
+	for _, test := range tests {
+		err := explain(awserr.New(test.code, "message", nil))
+		if err == nil || err.Error() != test.explanation {
+			t.Errorf("%s: expected %q, got %v", test.code, test.explanation, err)
+		}
+	}
+	if explain(nil) != nil {
+		t.Errorf("expected no error for nil")
+	}
+}
+
+func TestDoctorPermissions(t *testing.T) {
+	tests := []struct {
+		name string
+		// method and bucket refused with AccessDenied
+		denied   map[string]bool
+		expected string
+	}{
+		{"all allowed", map[string]bool{}, "bucket=PASS status-bucket=PASS list=PASS get=PASS " +
+			"status-list=PASS status-put=PASS status-get=PASS status-delete=PASS"},
+		{"data not readable", map[string]bool{"GET data": true}, "bucket=PASS status-bucket=PASS list=FAIL get=PASS " +
+			"status-list=PASS status-put=PASS status-get=PASS status-delete=PASS"},
+		{"status not writable", map[string]bool{"PUT status": true}, "bucket=PASS status-bucket=PASS list=PASS get=PASS " +
+			"status-list=PASS status-put=FAIL status-get=SKIP status-delete=SKIP"},
+		{"no status bucket", map[string]bool{"HEAD status": true}, "bucket=PASS status-bucket=FAIL list=PASS get=PASS " +
+			"status-list=SKIP status-put=SKIP status-get=SKIP status-delete=SKIP"},
+	}
+	for _, test := range tests {
+		sess, stop := fakeS3(t, func(w http.ResponseWriter, r *http.Request) {
+			bucket := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)[0]
+			if test.denied[r.Method+" "+bucket] {
+				s3Error(w, http.StatusForbidden, "AccessDenied")
+				return
+			}
+			switch {
+			case r.Method == http.MethodGet && r.URL.Query().Get("list-type") == "2":
+				w.Write([]byte(`<ListBucketResult><KeyCount>1</KeyCount>` +
+					`<Contents><Key>object.tar</Key></Contents></ListBucketResult>`))
+			case r.Method == http.MethodGet:
+				w.Write([]byte("portals doctor"))
+			case r.Method == http.MethodDelete:
+				w.WriteHeader(http.StatusNoContent)
+			}
+		})
+		d := &doctor{
+			couple: S3BucketCouple{
+				Data:   S3Bucket{BucketName: "data", Session: *sess},
+				Status: S3Bucket{BucketName: "status", Session: *sess},
+			},
+			passed:   map[string]bool{"credentials": true},
+			probeKey: "portals-doctor/probe",
+		}
+		checks := map[string]func() error{
+			"bucket":        func() error { return d.checkBucket(d.couple.Data) },
+			"status-bucket": func() error { return d.checkBucket(d.couple.Status) },
+			"list":          d.checkList,
+			"get":           d.checkGet,
+			"status-list":   d.checkStatusList,
+			"status-put":    d.checkStatusPut,
+			"status-get":    d.checkStatusGet,
+			"status-delete": d.checkStatusDelete,
+		}
+		for _, name := range DoctorChecks {
+			if check, ok := checks[name]; ok {
+				d.run(name, check)
+			}
+		}
+		stop()
+
+		if got := results(d.report); got != test.expected {
+			t.Errorf("%s:\nexpected %s\ngot      %s", test.name, test.expected, got)
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package lib
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/cvmfs/portals/cvmfs"
+	"github.com/cvmfs/portals/log"
+)
+
+/*
+The journal is a local, append-only, file where every status of every object
+is recorded, one JSON object per line, before being uploaded into the status
+bucket.
+
+The status bucket is only a mirror for the users, the daemon relies on the
+journal to know which objects are already processed and which ingestions
+were interrupted by a crash.
+*/
+
+// DefaultJournal is in a persistent directory, the journal must survive the
+// reboots as the repository does
+const DefaultJournal = "/var/lib/portals/state.journal"
+
+// statuses after which an object is not processed again
+var finalStatuses = map[string]bool{
+	"SUCCESS":    true,
+	"FAILURE":    true,
+	"ROLLEDBACK": true,
+}
+
+type JournalEntry struct {
+	Timestamp string `json:"timestamp"`
+	Bucket    string `json:"bucket"`
+	Key       string `json:"key"`
+	Hash      string `json:"hash"`
+	Status    string `json:"status"`
+	Tag       string `json:"tag,omitempty"`
+}
+
+type journalKey struct {
+	bucket string
+	key    string
+	hash   string
+}
+
+type journalState struct {
+	last  JournalEntry
+	final *JournalEntry
+}
+
+type Journal struct {
+	mutex sync.Mutex
+	path  string
+	file  *os.File
+	state map[journalKey]*journalState
+}
+
+// OpenJournal loads the journal at path, creating it if needed, and compacts
+// it to the last entry of each object
+func OpenJournal(path string) (*Journal, error) {
+	j := &Journal{path: path, state: make(map[journalKey]*journalState)}
+	if err := j.load(); err != nil {
+		return nil, fmt.Errorf("Error in reading the journal %s: %s", path, err)
+	}
+	if err := j.compact(); err != nil {
+		return nil, fmt.Errorf("Error in compacting the journal %s: %s", path, err)
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	j.file = file
+	return j, nil
+}
+
+func (j *Journal) load() error {
+	f, err := os.Open(j.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry JournalEntry
+		// a line truncated by a crash is ignored, the object is simply
+		// processed again
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		j.apply(entry)
+	}
+	return scanner.Err()
+}
+
+func (j *Journal) apply(entry JournalEntry) {
+	k := journalKey{entry.Bucket, entry.Key, entry.Hash}
+	state, ok := j.state[k]
+	if !ok {
+		state = &journalState{}
+		j.state[k] = state
+	}
+	state.last = entry
+	if finalStatuses[entry.Status] {
+		final := entry
+		state.final = &final
+	}
+}
+
+// compact rewrites the journal with only the entries that matter: the final
+// status, if any, and the last status of each object
+func (j *Journal) compact() error {
+	dir := filepath.Dir(j.path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, ".journal")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	encoder := json.NewEncoder(w)
+	for _, state := range j.state {
+		if state.final != nil && *state.final != state.last {
+			encoder.Encode(state.final)
+		}
+		encoder.Encode(state.last)
+	}
+	if err = w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	tmp.Close()
+	return os.Rename(tmp.Name(), j.path)
+}
+
+// Record appends the status report of an object of bucket, it returns only
+// once the entry is on disk
+func (j *Journal) Record(bucket string, report StatusReport) error {
+	entry := JournalEntry{
+		Timestamp: report.Timestamp,
+		Bucket:    bucket,
+		Key:       report.Key,
+		Hash:      report.Hash,
+		Status:    report.Status,
+		Tag:       report.Tag,
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	if _, err = j.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if err = j.file.Sync(); err != nil {
+		return err
+	}
+	j.apply(entry)
+	return nil
+}
+
+// Processed is true if the object already reached a final status
+func (j *Journal) Processed(bucket, key, hash string) bool {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	state, ok := j.state[journalKey{bucket, key, hash}]
+	return ok && state.final != nil
+}
+
+// Interrupted returns the objects of bucket whose ingestion started but never
+// reached a final status
+func (j *Journal) Interrupted(bucket string) []JournalEntry {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	interrupted := []JournalEntry{}
+	for k, state := range j.state {
+		if k.bucket == bucket && state.final == nil && state.last.Status == "INGESTING" {
+			interrupted = append(interrupted, state.last)
+		}
+	}
+	return interrupted
+}
+
+func (j *Journal) Close() error {
+	return j.file.Close()
+}
+
+// ResumeInterrupted completes the bookkeeping of the ingestions interrupted
+// by a crash: if the tag of the ingestion is in the repository the ingestion
+// went through and it is marked as SUCCESS, otherwise the object is left to
+// be processed again and the transaction the ingestion may have left open is
+// aborted.
+// It must be called before any ingestion on the repository starts
+func ResumeInterrupted(journal *Journal, couple S3BucketCouple, repo *cvmfs.Repo) {
+	abort := false
+	for _, entry := range journal.Interrupted(couple.Data.BucketName) {
+		l := log.Decorate(map[string]string{
+			"Action": "resume",
+			"Key":    entry.Key,
+			"Hash":   entry.Hash,
+			"Tag":    entry.Tag,
+		})
+		if entry.Tag == "" {
+			l(log.Log()).Info("Interrupted ingestion, the object will be processed again")
+			abort = true
+			continue
+		}
+		tag, err := cvmfs.GetTag(repo.Name, entry.Tag)
+		if err != nil {
+			l(log.LogE(err)).Info("Interrupted ingestion, the object will be processed again")
+			abort = true
+			continue
+		}
+
+		report := StatusReport{
+			Status:    "SUCCESS",
+			Timestamp: time.Now().Format(time.RFC3339),
+			Key:       entry.Key,
+			Hash:      entry.Hash,
+			Tag:       tag.Name,
+			Revision:  tag.Revision,
+			RootHash:  tag.RootHash,
+		}
+		if err := journal.Record(couple.Data.BucketName, report); err != nil {
+			l(log.LogE(err)).Error("Error in recording the interrupted ingestion")
+			continue
+		}
+		UploadStatusReport(&couple.Status.Session, couple.Status.BucketName, report)
+		l(log.Log()).Info("Interrupted ingestion completed before the crash")
+	}
+
+	if abort {
+		l := log.Decorate(map[string]string{"Action": "resume", "repository": repo.Name})
+		if err := cvmfs.AbortTransaction(repo.Name); err != nil {
+			l(log.LogE(err)).Info("No transaction left open by the interrupted ingestions")
+		} else {
+			l(log.Log()).Info("Aborted the transaction left open by the interrupted ingestions")
+		}
+	}
+}
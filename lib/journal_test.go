@@ -0,0 +1,215 @@
+package lib
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/cvmfs/portals/cvmfs"
+)
+
+func newTestJournal(t *testing.T) (path string, cleanup func()) {
+	dir, err := ioutil.TempDir("", "portals-journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the directory of the journal is created when needed
+	return filepath.Join(dir, "state", "state.journal"), func() { os.RemoveAll(dir) }
+}
+
+func TestJournal(t *testing.T) {
+	path, cleanup := newTestJournal(t)
+	defer cleanup()
+
+	journal, err := OpenJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := []struct {
+		bucket string
+		report StatusReport
+	}{
+		{"data", StatusReport{Key: "done.tar", Hash: "1", Status: "INGESTING", Tag: "done"}},
+		{"data", StatusReport{Key: "done.tar", Hash: "1", Status: "SUCCESS", Tag: "done"}},
+		{"data", StatusReport{Key: "done.tar", Hash: "1", Status: "DOWNLOADING"}},
+		{"data", StatusReport{Key: "crashed.tar", Hash: "2", Status: "INGESTING", Tag: "crashed"}},
+		{"data", StatusReport{Key: "downloading.tar", Hash: "3", Status: "DOWNLOADING"}},
+		{"other", StatusReport{Key: "crashed.tar", Hash: "2", Status: "INGESTING"}},
+	}
+	for _, record := range records {
+		if err := journal.Record(record.bucket, record.report); err != nil {
+			t.Fatal(err)
+		}
+	}
+	journal.Close()
+
+	// a line truncated by a crash
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte(`{"bucket":"data","key":"downloading.tar","hash":"3","status":"SUCC`))
+	f.Close()
+
+	journal, err = OpenJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer journal.Close()
+
+	processed := []struct {
+		bucket, key, hash string
+		processed         bool
+	}{
+		{"data", "done.tar", "1", true},
+		{"data", "done.tar", "other", false},
+		{"data", "crashed.tar", "2", false},
+		{"data", "downloading.tar", "3", false},
+		{"other", "done.tar", "1", false},
+	}
+	for _, test := range processed {
+		if p := journal.Processed(test.bucket, test.key, test.hash); p != test.processed {
+			t.Errorf("%s/%s.%s: expected processed %t, got %t", test.bucket, test.key, test.hash, test.processed, p)
+		}
+	}
+
+	interrupted := journal.Interrupted("data")
+	if len(interrupted) != 1 || interrupted[0].Key != "crashed.tar" || interrupted[0].Tag != "crashed" {
+		t.Errorf("expected only crashed.tar to be interrupted, got %v", interrupted)
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the final status and the last status of done.tar, one line for the
+	// other objects
+	if lines := strings.Count(string(content), "\n"); lines != 5 {
+		t.Errorf("expected the journal to be compacted to 5 lines, got %d:\n%s", lines, content)
+	}
+}
+
+// fakeCVMFSServer puts in the PATH a cvmfs_server that lists the tags provided
+// and records every other command in the log file
+func fakeCVMFSServer(t *testing.T, tags []string) (log string, cleanup func()) {
+	dir, err := ioutil.TempDir("", "fake-cvmfs-server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	log = filepath.Join(dir, "log")
+	script := "#!/bin/sh\n" +
+		"if [ \"$1\" = tag ]; then\n"
+	for _, tag := range tags {
+		script += "echo '" + tag + " 0123abcd 1024 7 1577934245 0 description'\n"
+	}
+	script += "exit 0\nfi\n" +
+		"echo \"$@\" >> " + log + "\n"
+	err = ioutil.WriteFile(filepath.Join(dir, "cvmfs_server"), []byte(script), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+path)
+	return log, func() {
+		os.Setenv("PATH", path)
+		os.RemoveAll(dir)
+	}
+}
+
+func TestResumeInterrupted(t *testing.T) {
+	tests := []struct {
+		name        string
+		interrupted []StatusReport
+		tags        []string
+		success     []string
+		abort       bool
+	}{
+		{
+			name:        "published",
+			interrupted: []StatusReport{{Key: "a.tar", Hash: "1", Tag: "a"}},
+			tags:        []string{"a"},
+			success:     []string{"a.tar"},
+		},
+		{
+			name:        "not published",
+			interrupted: []StatusReport{{Key: "a.tar", Hash: "1", Tag: "a"}},
+			abort:       true,
+		},
+		{
+			name:        "without a tag",
+			interrupted: []StatusReport{{Key: "a.tar", Hash: "1"}},
+			tags:        []string{"a"},
+			abort:       true,
+		},
+		{
+			name: "one published, one not",
+			interrupted: []StatusReport{
+				{Key: "a.tar", Hash: "1", Tag: "a"},
+				{Key: "b.tar", Hash: "2", Tag: "b"},
+			},
+			tags:    []string{"a"},
+			success: []string{"a.tar"},
+			abort:   true,
+		},
+		{
+			name: "nothing interrupted",
+		},
+	}
+	for _, test := range tests {
+		path, cleanup := newTestJournal(t)
+		log, stopServer := fakeCVMFSServer(t, test.tags)
+		recorder := &statusRecorder{}
+		sess, stop := fakeS3(t, recorder.ServeHTTP)
+
+		journal, err := OpenJournal(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, report := range test.interrupted {
+			report.Status = "INGESTING"
+			journal.Record("data", report)
+		}
+		couple := S3BucketCouple{
+			Data:   S3Bucket{BucketName: "data", Session: *sess},
+			Status: S3Bucket{BucketName: "status", Session: *sess},
+		}
+		repo := cvmfs.NewRepo("repo.example.org")
+		ResumeInterrupted(journal, couple, &repo)
+
+		success := []string{}
+		for _, report := range test.interrupted {
+			if journal.Processed("data", report.Key, report.Hash) {
+				success = append(success, report.Key)
+			}
+		}
+		if strings.Join(success, ",") != strings.Join(test.success, ",") {
+			t.Errorf("%s: expected %v to be completed, got %v", test.name, test.success, success)
+		}
+		uploaded := recorder.recorded()
+		sort.Strings(uploaded)
+		expected := []string{}
+		for _, report := range test.interrupted {
+			for _, key := range test.success {
+				if report.Key == key {
+					report.Status = "SUCCESS"
+					expected = append(expected, report.StatusKey())
+				}
+			}
+		}
+		if strings.Join(uploaded, ",") != strings.Join(expected, ",") {
+			t.Errorf("%s: expected the status files %v, got %v", test.name, expected, uploaded)
+		}
+		content, _ := ioutil.ReadFile(log)
+		if aborted := string(content) == "abort -f repo.example.org\n"; aborted != test.abort {
+			t.Errorf("%s: expected abort %t, got the commands %q", test.name, test.abort, content)
+		}
+
+		journal.Close()
+		stop()
+		stopServer()
+		cleanup()
+	}
+}
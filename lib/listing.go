@@ -0,0 +1,192 @@
+package lib
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/cvmfs/portals/log"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+/*
+Listing the whole bucket at every poll is expensive when the bucket keeps
+many historical objects, the listings are incremental instead:
+1. The lister remembers the fingerprint of every object it returned and the
+   last key of the previous listing
+2. The next listing starts after that key and returns only the objects never
+   seen before, or modified since
+3. Every full-rescan-interval the whole bucket is listed, to catch the new
+   objects with a key before the last one and the objects modified
+4. The objects returned but not ingested, like the ones still in the quiet
+   period, are forgotten, so that the next listing returns them again
+
+A failed listing leaves everything as it was, the failures are counted in the
+ListingHealth of the lister, which ends up in the PING of the portal.
+*/
+
+const DefaultFullRescanInterval = time.Hour
+
+// ListingHealth tells how the listings of a bucket are going
+type ListingHealth struct {
+	LastListing       time.Time
+	Errors            int
+	ConsecutiveErrors int
+	LastError         error
+	LastErrorAt       time.Time
+}
+
+func (h ListingHealth) String() string {
+	lastListing := "never"
+	if !h.LastListing.IsZero() {
+		lastListing = h.LastListing.Format(time.RFC3339)
+	}
+	s := fmt.Sprintf("last-listing: %s\nlisting-errors: %d\nconsecutive-listing-errors: %d\n",
+		lastListing, h.Errors, h.ConsecutiveErrors)
+	if h.LastError != nil {
+		// the errors of the SDK span many lines
+		message := strings.Join(strings.Fields(h.LastError.Error()), " ")
+		s += fmt.Sprintf("last-listing-error: %s %s\n",
+			h.LastErrorAt.Format(time.RFC3339), log.RedactString(message))
+	}
+	return s
+}
+
+type IncrementalLister struct {
+	bucket     S3Bucket
+	fullRescan time.Duration
+
+	mutex    sync.Mutex
+	lastFull time.Time
+	// the listing starts after this key
+	position string
+	// set when an object is forgotten during a listing, the listing must not
+	// move the position after rewindTo
+	rewound  bool
+	rewindTo string
+	seen     map[string]string
+	health   ListingHealth
+}
+
+func NewIncrementalLister(bucket S3Bucket, fullRescan time.Duration) *IncrementalLister {
+	return &IncrementalLister{
+		bucket:     bucket,
+		fullRescan: fullRescan,
+		seen:       make(map[string]string),
+	}
+}
+
+func fingerprint(object s3.Object) string {
+	return fmt.Sprintf("%s|%d|%d",
+		aws.StringValue(object.ETag),
+		aws.TimeValue(object.LastModified).UnixNano(),
+		aws.Int64Value(object.Size))
+}
+
+// keyBefore returns a key that sorts before key, with no other key between
+// them but the ones starting with it
+func keyBefore(key string) string {
+	_, size := utf8.DecodeLastRuneInString(key)
+	return key[:len(key)-size]
+}
+
+// List returns the objects new or modified since the previous listing
+func (l *IncrementalLister) List() ([]s3.Object, error) {
+	l.mutex.Lock()
+	full := l.lastFull.IsZero() || time.Since(l.lastFull) >= l.fullRescan
+	startAfter := l.position
+	if full {
+		startAfter = ""
+	}
+	l.rewound = false
+	l.mutex.Unlock()
+
+	input := &s3.ListObjectsV2Input{
+		Bucket:     aws.String(l.bucket.BucketName),
+		FetchOwner: aws.Bool(true),
+	}
+	if startAfter != "" {
+		input.StartAfter = aws.String(startAfter)
+	}
+	start := time.Now()
+	objectChan := make(chan s3.Object, 10)
+	result := l.bucket.SpoolAllObject(input, objectChan)
+	listed := []s3.Object{}
+	for object := range objectChan {
+		listed = append(listed, object)
+	}
+	err := <-result
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if err != nil {
+		l.health.Errors++
+		l.health.ConsecutiveErrors++
+		l.health.LastError = err
+		l.health.LastErrorAt = time.Now()
+		return nil, err
+	}
+	l.health.LastListing = start
+	l.health.ConsecutiveErrors = 0
+
+	objects := []s3.Object{}
+	position := startAfter
+	seen := l.seen
+	if full {
+		// a new map forgets the objects removed from the bucket, and it
+		// does not keep the room of all the keys it ever held
+		seen = make(map[string]string, len(listed))
+	}
+	for _, object := range listed {
+		key := aws.StringValue(object.Key)
+		if key > position {
+			position = key
+		}
+		if l.seen[key] != fingerprint(object) {
+			objects = append(objects, object)
+		}
+		seen[key] = fingerprint(object)
+	}
+	l.seen = seen
+	if full {
+		l.lastFull = start
+	}
+	if l.rewound && l.rewindTo < position {
+		position = l.rewindTo
+	}
+	l.position = position
+
+	log.Log().WithField("bucket", l.bucket.BucketName).
+		WithField("full", full).
+		WithField("listed", len(listed)).
+		WithField("new", len(objects)).
+		Debug("Bucket listed")
+	return objects, nil
+}
+
+func (l *IncrementalLister) Health() ListingHealth {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.health
+}
+
+// Forget makes the next listing return the object again
+func (l *IncrementalLister) Forget(key string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	delete(l.seen, key)
+	before := keyBefore(key)
+	if before < l.position {
+		l.position = before
+	}
+	if !l.rewound || before < l.rewindTo {
+		l.rewound = true
+		l.rewindTo = before
+	}
+}
@@ -0,0 +1,197 @@
+package lib
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeyBefore(t *testing.T) {
+	tests := []struct {
+		key    string
+		before string
+	}{
+		{"b.tar", "b.ta"},
+		{"a", ""},
+		{"dir/é", "dir/"},
+	}
+	for _, test := range tests {
+		before := keyBefore(test.key)
+		if before != test.before {
+			t.Errorf("%q: expected %q, got %q", test.key, test.before, before)
+		}
+		if before >= test.key {
+			t.Errorf("%q: %q does not sort before it", test.key, before)
+		}
+	}
+}
+
+func TestIncrementalLister(t *testing.T) {
+	listing := newFakeListing(2, "a.tar", "b.tar", "c.tar")
+	sess, stop := fakeS3(t, listing.ServeHTTP)
+	defer stop()
+	lister := NewIncrementalLister(S3Bucket{BucketName: "bucket", Session: *sess}, time.Hour)
+
+	steps := []struct {
+		name   string
+		before func()
+		// keys returned by the listing
+		listed string
+		// start-after of the first request of the listing
+		startAfter string
+		// keys the lister remembers after the listing
+		seen int
+	}{
+		{"first listing is full", nil, "a.tar,b.tar,c.tar", "", 3},
+		{"nothing new", nil, "", "c.tar", 3},
+		{"new objects", func() { listing.put("d.tar"); listing.put("0.tar") }, "d.tar", "c.tar", 4},
+		{"forgotten", func() { lister.Forget("b.tar") }, "b.tar", "b.ta", 4},
+		{"back to the last key", nil, "", "d.tar", 4},
+		{"full rescan", func() {
+			lister.lastFull = time.Time{}
+			listing.remove("c.tar")
+			listing.putAt("a.tar", time.Now().Add(time.Hour))
+		}, "0.tar,a.tar", "", 4},
+		{"removed objects forgotten", func() {
+			lister.lastFull = time.Time{}
+			listing.remove("a.tar")
+			listing.remove("b.tar")
+		}, "", "", 2},
+	}
+	for _, step := range steps {
+		if step.before != nil {
+			step.before()
+		}
+		requests := len(listing.served())
+		objects, err := lister.List()
+		if err != nil {
+			t.Fatalf("%s: unexpected error %s", step.name, err)
+		}
+		keys := []string{}
+		for _, object := range objects {
+			keys = append(keys, *object.Key)
+		}
+		sort.Strings(keys)
+		if strings.Join(keys, ",") != step.listed {
+			t.Errorf("%s: expected %q, got %q", step.name, step.listed, keys)
+		}
+		if served := listing.served(); len(served) <= requests || served[requests] != step.startAfter {
+			t.Errorf("%s: expected the listing to start after %q, got the requests %q",
+				step.name, step.startAfter, served[requests:])
+		}
+		if len(lister.seen) != step.seen {
+			t.Errorf("%s: expected %d keys remembered, got %d", step.name, step.seen, len(lister.seen))
+		}
+	}
+}
+
+func TestIncrementalListerForgetDuringListing(t *testing.T) {
+	listing := newFakeListing(10, "a.tar", "b.tar")
+	var lister *IncrementalLister
+	forget := ""
+	sess, stop := fakeS3(t, func(w http.ResponseWriter, r *http.Request) {
+		// the pipeline forgets the object while the bucket is listed
+		if forget != "" {
+			lister.Forget(forget)
+		}
+		listing.ServeHTTP(w, r)
+	})
+	defer stop()
+	lister = NewIncrementalLister(S3Bucket{BucketName: "bucket", Session: *sess}, time.Hour)
+
+	if _, err := lister.List(); err != nil {
+		t.Fatal(err)
+	}
+	listing.put("c.tar")
+	forget = "a.tar"
+	objects, err := lister.List()
+	if err != nil || len(objects) != 1 || *objects[0].Key != "c.tar" {
+		t.Fatalf("expected c.tar, got %v %v", objects, err)
+	}
+	if lister.position != keyBefore("a.tar") {
+		t.Errorf("the position %q moved after the object forgotten", lister.position)
+	}
+
+	forget = ""
+	objects, err = lister.List()
+	if err != nil || len(objects) != 1 || *objects[0].Key != "a.tar" {
+		t.Errorf("expected only a.tar to be listed again, got %v %v", objects, err)
+	}
+}
+
+func TestListingHealthString(t *testing.T) {
+	at := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		name   string
+		health ListingHealth
+		lines  []string
+	}{
+		{"never listed", ListingHealth{}, []string{
+			"last-listing: never", "listing-errors: 0", "consecutive-listing-errors: 0"}},
+		{"listed", ListingHealth{LastListing: at, Errors: 2}, []string{
+			"last-listing: 2020-01-02T03:04:05Z", "listing-errors: 2", "consecutive-listing-errors: 0"}},
+		{"failing", ListingHealth{LastListing: at, Errors: 3, ConsecutiveErrors: 1, LastErrorAt: at,
+			LastError: fmt.Errorf("AccessDenied: Access Denied\n\tstatus code: 403")}, []string{
+			"last-listing: 2020-01-02T03:04:05Z", "listing-errors: 3", "consecutive-listing-errors: 1",
+			"last-listing-error: 2020-01-02T03:04:05Z AccessDenied: Access Denied status code: 403"}},
+	}
+	for _, test := range tests {
+		expected := strings.Join(test.lines, "\n") + "\n"
+		if s := test.health.String(); s != expected {
+			t.Errorf("%s: expected\n%s\ngot\n%s", test.name, expected, s)
+		}
+	}
+}
+
+func TestListingErrors(t *testing.T) {
+	listing := newFakeListing(10, "a.tar", "b.tar")
+	failing := false
+	sess, stop := fakeS3(t, func(w http.ResponseWriter, r *http.Request) {
+		if failing {
+			s3Error(w, http.StatusForbidden, "AccessDenied")
+			return
+		}
+		listing.ServeHTTP(w, r)
+	})
+	defer stop()
+	lister := NewIncrementalLister(S3Bucket{BucketName: "bucket", Session: *sess}, time.Hour)
+	p := testPortal("bucket")
+	p.lister = lister
+
+	steps := []struct {
+		failing     bool
+		errors      int
+		consecutive int
+		listed      int
+	}{
+		{true, 1, 1, 0},
+		{true, 2, 2, 0},
+		// the failures left nothing behind, the first listing is still full
+		{false, 2, 0, 2},
+		{true, 3, 1, 0},
+	}
+	for i, step := range steps {
+		failing = step.failing
+		objects, err := lister.List()
+		if (err != nil) != step.failing || len(objects) != step.listed {
+			t.Errorf("step %d: expected %d objects and error %t, got %d %v", i, step.listed, step.failing, len(objects), err)
+		}
+		health := p.Health()
+		if health.Errors != step.errors || health.ConsecutiveErrors != step.consecutive {
+			t.Errorf("step %d: wrong health %+v", i, health)
+		}
+		if step.failing && (health.LastError == nil || health.LastErrorAt.IsZero()) {
+			t.Errorf("step %d: the error is not recorded", i)
+		}
+		if !step.failing && health.LastListing.IsZero() {
+			t.Errorf("step %d: the listing is not recorded", i)
+		}
+	}
+
+	if _, err := p.List(); err == nil {
+		t.Errorf("the portal hides the error of the listing")
+	}
+}
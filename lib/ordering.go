@@ -0,0 +1,80 @@
+package lib
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	OrderOldestFirst = "oldest-first"
+	OrderNewestFirst = "newest-first"
+	OrderLexical     = "lexical"
+)
+
+func validateOrder(order string) error {
+	switch order {
+	case OrderOldestFirst, OrderNewestFirst, OrderLexical:
+		return nil
+	}
+	return fmt.Errorf("Unknown order %s, it should be one of: %s, %s, %s",
+		order, OrderOldestFirst, OrderNewestFirst, OrderLexical)
+}
+
+func sortObjects(objects []s3.Object, order string) {
+	sort.SliceStable(objects, func(i, j int) bool {
+		switch order {
+		case OrderOldestFirst:
+			return aws.TimeValue(objects[i].LastModified).Before(aws.TimeValue(objects[j].LastModified))
+		case OrderNewestFirst:
+			return aws.TimeValue(objects[i].LastModified).After(aws.TimeValue(objects[j].LastModified))
+		default:
+			return *objects[i].Key < *objects[j].Key
+		}
+	})
+}
+
+// topLevelPrefix is the first component of the key, empty for the objects
+// at the top level of the bucket
+func topLevelPrefix(key string) string {
+	i := strings.Index(key, "/")
+	if i < 0 {
+		return ""
+	}
+	return key[:i]
+}
+
+// OrderObjects sorts the objects in the order they should be processed.
+//
+// With fair set, the objects are taken round-robin from each top-level
+// prefix, so that a single prefix with thousands of objects does not starve
+// all the others, the order is respected inside each prefix.
+func OrderObjects(objects []s3.Object, order string, fair bool) []s3.Object {
+	sortObjects(objects, order)
+	if !fair {
+		return objects
+	}
+
+	prefixes := []string{}
+	byPrefix := make(map[string][]s3.Object)
+	for _, object := range objects {
+		prefix := topLevelPrefix(*object.Key)
+		if _, ok := byPrefix[prefix]; !ok {
+			prefixes = append(prefixes, prefix)
+		}
+		byPrefix[prefix] = append(byPrefix[prefix], object)
+	}
+
+	ordered := make([]s3.Object, 0, len(objects))
+	for round := 0; len(ordered) < len(objects); round++ {
+		for _, prefix := range prefixes {
+			if round < len(byPrefix[prefix]) {
+				ordered = append(ordered, byPrefix[prefix][round])
+			}
+		}
+	}
+	return ordered
+}
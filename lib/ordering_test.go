@@ -0,0 +1,81 @@
+package lib
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestValidateOrder(t *testing.T) {
+	for _, order := range []string{OrderOldestFirst, OrderNewestFirst, OrderLexical} {
+		if err := validateOrder(order); err != nil {
+			t.Errorf("%s: unexpected error %s", order, err)
+		}
+	}
+	for _, order := range []string{"", "random", "Lexical"} {
+		if err := validateOrder(order); err == nil {
+			t.Errorf("%q: expected an error", order)
+		}
+	}
+}
+
+func TestOrderObjects(t *testing.T) {
+	base := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	// key and minutes after base of the last modification
+	listing := []struct {
+		key     string
+		minutes int
+	}{
+		{"b/1.tar", 3},
+		{"a/1.tar", 5},
+		{"a/2.tar", 1},
+		{"top.tar", 4},
+		{"a/3.tar", 2},
+		{"c/1.tar", 0},
+	}
+
+	tests := []struct {
+		order    string
+		fair     bool
+		expected string
+	}{
+		{OrderLexical, false, "a/1.tar a/2.tar a/3.tar b/1.tar c/1.tar top.tar"},
+		{OrderOldestFirst, false, "c/1.tar a/2.tar a/3.tar b/1.tar top.tar a/1.tar"},
+		{OrderNewestFirst, false, "a/1.tar top.tar b/1.tar a/3.tar a/2.tar c/1.tar"},
+		{OrderLexical, true, "a/1.tar b/1.tar c/1.tar top.tar a/2.tar a/3.tar"},
+		{OrderOldestFirst, true, "c/1.tar a/2.tar b/1.tar top.tar a/3.tar a/1.tar"},
+	}
+	for _, test := range tests {
+		objects := []s3.Object{}
+		for _, o := range listing {
+			objects = append(objects, s3.Object{
+				Key:          aws.String(o.key),
+				LastModified: aws.Time(base.Add(time.Duration(o.minutes) * time.Minute)),
+			})
+		}
+		keys := []string{}
+		for _, object := range OrderObjects(objects, test.order, test.fair) {
+			keys = append(keys, *object.Key)
+		}
+		if strings.Join(keys, " ") != test.expected {
+			t.Errorf("%s fair=%t: expected %s, got %s", test.order, test.fair, test.expected, strings.Join(keys, " "))
+		}
+	}
+}
+
+func TestTopLevelPrefix(t *testing.T) {
+	tests := map[string]string{
+		"a.tar":     "",
+		"a/b.tar":   "a",
+		"a/b/c.tar": "a",
+		"/a.tar":    "",
+	}
+	for key, expected := range tests {
+		if prefix := topLevelPrefix(key); prefix != expected {
+			t.Errorf("%s: expected %q, got %q", key, expected, prefix)
+		}
+	}
+}
@@ -1,47 +1,280 @@
 package lib
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
+	"text/template"
+	"time"
 
 	"github.com/BurntSushi/toml"
 )
 
 type BucketConfiguration struct {
+	// Name of the [backends.<name>] whose settings the portal inherits
+	Backend string `toml:"backend"`
+
 	CVMFSRepo    string `toml:"cvmfs-repo"`
 	AccessKey    string `toml:"access-key"`
 	SecretKey    string `toml:"secret-key"`
 	Bucket       string `toml:"bucket"`
 	StatusBucket string `toml:"status-bucket"`
 	HostURL      string `toml:"host-url"`
-	Region       string `region:"region"`
+	Region       string `toml:"region"`
+
+	// Where the credentials come from, by default the access-key and
+	// secret-key above
+	CredentialSource CredentialSource `toml:"credential-source"`
+
+	// Templates used to name and describe the CVMFS tag created for each
+	// ingestion, they can use {{.Key}}, {{.Hash}}, {{.Timestamp}} and
+	// {{.Bucket}}
+	TagTemplate    string `toml:"tag-template"`
+	TagDescription string `toml:"tag-description"`
+
+	// Rules to map the keys of the objects into directories of the
+	// repository, the first matching rule is used
+	PathMapping []PathRule `toml:"path-mapping"`
+
+	// Rules restricting which owners and prefixes can write where in the
+	// repository, without rules everything is allowed
+	ACL []ACLRule `toml:"acl"`
+
+	// What the tarballs must respect to be ingested
+	TarPolicy TarPolicy `toml:"tar-policy"`
+
+	// The downloaded objects are verified against their ETag, when it is a
+	// MD5, and against the SHA256 provided by the user as metadata or as
+	// sidecar object
+	SkipETagVerification bool `toml:"skip-etag-verification"`
+	RequireChecksum      bool `toml:"require-checksum"`
+
+	// Keys used to verify the signature <key>.sig of the objects, if no key
+	// is configured the signatures are not checked
+	Signature SignaturePolicy `toml:"signature"`
+
+	// Ingest the objects under a prefix only once a .ready or MANIFEST
+	// object is uploaded there, all together in a single transaction
+	CompletionMarker bool `toml:"completion-marker"`
+
+	// The objects modified less than quiet-period ago are not ingested yet,
+	// since they may still be written
+	QuietPeriod Duration `toml:"quiet-period"`
+
+	// Order in which the objects are processed: "oldest-first", the default,
+	// "newest-first" or "lexical", with fair-prefixes the objects are taken
+	// round-robin from each top-level prefix
+	Order        string `toml:"order"`
+	FairPrefixes bool   `toml:"fair-prefixes"`
+
+	// Priority of the objects by prefix, the x-amz-meta-priority metadata of
+	// an object overrides it, the higher priority objects are processed first
+	Priorities []PriorityRule `toml:"priority"`
+	// The x-amz-meta-priority metadata cannot go above
+	// max-metadata-priority, by default 0, so that the uploaders can lower
+	// the priority of their objects but not jump ahead of everybody else
+	MaxMetadataPriority int `toml:"max-metadata-priority"`
+
+	// Pipe the objects directly from S3 into the ingestion, without
+	// downloading them into a temporary file first
+	Streaming bool `toml:"streaming"`
+
+	// Directory where the objects are downloaded, it overrides the
+	// spool-dir of the whole daemon
+	SpoolDir string `toml:"spool-dir"`
+
+	// The objects are downloaded in parts of download-part-size bytes,
+	// download-concurrency parts at the same time, an interrupted download
+	// resumes from the parts already completed
+	DownloadPartSize    int64 `toml:"download-part-size"`
+	DownloadConcurrency int   `toml:"download-concurrency"`
+
+	// Create the buckets when the daemon starts, if they are missing, the
+	// lifecycle rules of the status bucket created remove the FAILURE status
+	// files older than status-expiration, if it is set
+	CreateBuckets    bool     `toml:"create-buckets"`
+	StatusExpiration Duration `toml:"status-expiration"`
+
+	// The bucket is listed again poll-interval after a listing that found
+	// something to do, when it finds nothing the interval doubles up to
+	// max-poll-interval. With the webhook enabled the listings only catch
+	// the lost notifications and poll-interval is by default 10 minutes
+	PollInterval    Duration `toml:"poll-interval"`
+	MaxPollInterval Duration `toml:"max-poll-interval"`
+
+	// The listings return only the objects new or modified since the
+	// previous one, the whole bucket is listed again every
+	// full-rescan-interval, by default every hour
+	FullRescanInterval Duration `toml:"full-rescan-interval"`
+}
+
+// Duration is a time.Duration written in the configuration as "30s", "5m"...
+type Duration struct {
+	time.Duration
 }
 
+func (d *Duration) UnmarshalText(text []byte) (err error) {
+	d.Duration, err = time.ParseDuration(string(text))
+	return
+}
+
+const (
+	DefaultTagTemplate    = "portal-{{.Key}}-{{.Hash}}-{{.Timestamp}}"
+	DefaultTagDescription = "Ingestion of {{.Key}} ({{.Hash}}) from the bucket {{.Bucket}}"
+)
+
 type Config struct {
+	// Directory where the objects are downloaded, by default
+	// /var/spool/portals, it must not be shared with other processes
+	SpoolDir string `toml:"spool-dir"`
+	// Local journal of the status of all the objects, by default
+	// /var/lib/portals/state.journal, it must survive the reboots
+	Journal string `toml:"journal"`
+	// Receiver of the S3 event notifications, disabled by default
+	Webhook     WebhookConfig         `toml:"webhook"`
 	Credentials []BucketConfiguration `toml:"credentials"`
 }
 
+// SpoolDirs returns all the spool directories used by the portals
+func (config Config) SpoolDirs() []string {
+	dirs := []string{}
+	seen := map[string]bool{}
+	for _, bucketConfig := range config.Credentials {
+		if !seen[bucketConfig.SpoolDir] {
+			seen[bucketConfig.SpoolDir] = true
+			dirs = append(dirs, bucketConfig.SpoolDir)
+		}
+	}
+	return dirs
+}
+
 func ParseConfig(path string) (config Config, err error) {
 	f, err := os.Open(path)
 	if err != nil {
 		return
 	}
+	defer f.Close()
 	bytes, err := ioutil.ReadAll(f)
 	if err != nil {
 		return
 	}
 
-	err = toml.Unmarshal(bytes, &config)
+	expanded, problems, err := expandSections(string(bytes))
+	if err != nil {
+		return
+	}
+	meta, err := toml.Decode(expanded, &config)
 	if err != nil {
 		return
 	}
+	problems = append(problems, undecodedKeys(meta, string(bytes))...)
+
+	if config.SpoolDir == "" {
+		config.SpoolDir = DefaultSpoolDir
+	}
+	if config.Journal == "" {
+		config.Journal = DefaultJournal
+	}
+	if config.Webhook.Enabled() && config.Webhook.Token == "" {
+		problems.add("The webhook listens on %s without a token, set the token of [webhook]",
+			config.Webhook.Listen)
+	}
+	if len(config.Credentials) == 0 {
+		problems.add("No portal configured, at least one [[credentials]] is needed")
+	}
 	for i, bucketConfig := range config.Credentials {
-		if bucketConfig.StatusBucket == "" {
+		name := "the bucket " + bucketConfig.Bucket
+		if bucketConfig.Bucket == "" {
+			name = fmt.Sprintf("the portal %d", i+1)
+			problems.add("The bucket of the portal %d is missing", i+1)
+		}
+		if bucketConfig.CVMFSRepo == "" {
+			problems.add("The cvmfs-repo of %s is missing", name)
+		}
+		if err := validateHostURL(bucketConfig.HostURL); err != nil {
+			problems.add("Error in the host-url of %s: %s", name, err)
+		}
+		if bucketConfig.StatusBucket == "" && bucketConfig.Bucket != "" {
 			config.Credentials[i].StatusBucket = bucketConfig.Bucket + ".status"
 		}
 		if bucketConfig.Region == "" {
 			config.Credentials[i].Region = "us-east-1"
 		}
+		if bucketConfig.CredentialSource.Type == "" {
+			config.Credentials[i].CredentialSource.Type = CredentialsStatic
+		}
+		if err := config.Credentials[i].CredentialSource.Validate(config.Credentials[i]); err != nil {
+			problems.add("Error in the credential-source of %s: %s", name, err)
+		}
+		if bucketConfig.Order == "" {
+			config.Credentials[i].Order = OrderOldestFirst
+		}
+		if err := validateOrder(config.Credentials[i].Order); err != nil {
+			problems.add("Error in the order of %s: %s", name, err)
+		}
+		if bucketConfig.TagTemplate == "" {
+			config.Credentials[i].TagTemplate = DefaultTagTemplate
+		}
+		if bucketConfig.TagDescription == "" {
+			config.Credentials[i].TagDescription = DefaultTagDescription
+		}
+		if _, err := template.New("tag").Parse(config.Credentials[i].TagTemplate); err != nil {
+			problems.add("Error in the tag-template of %s: %s", name, err)
+		}
+		if _, err := template.New("description").Parse(config.Credentials[i].TagDescription); err != nil {
+			problems.add("Error in the tag-description of %s: %s", name, err)
+		}
+		for j := range config.Credentials[i].PathMapping {
+			if err := config.Credentials[i].PathMapping[j].Validate(); err != nil {
+				problems.add("Error in the path-mapping of %s: %s", name, err)
+			}
+		}
+		for _, rule := range bucketConfig.ACL {
+			if err := rule.Validate(); err != nil {
+				problems.add("Error in the acl of %s: %s", name, err)
+			}
+		}
+		if err := config.Credentials[i].TarPolicy.Validate(); err != nil {
+			problems.add("Error in the tar-policy of %s: %s", name, err)
+		}
+		if err := config.Credentials[i].Signature.Validate(); err != nil {
+			problems.add("Error in the signature of %s: %s", name, err)
+		}
+		if bucketConfig.SpoolDir == "" {
+			config.Credentials[i].SpoolDir = config.SpoolDir
+		}
+		if bucketConfig.DownloadPartSize <= 0 {
+			config.Credentials[i].DownloadPartSize = DefaultDownloadPartSize
+		}
+		if bucketConfig.DownloadConcurrency <= 0 {
+			config.Credentials[i].DownloadConcurrency = DefaultDownloadConcurrency
+		}
+		if err := validateSpoolDir(config.Credentials[i].SpoolDir); err != nil {
+			problems.add("Error in the spool-dir of %s: %s", name, err)
+		}
+		if bucketConfig.PollInterval.Duration == 0 {
+			config.Credentials[i].PollInterval.Duration = DefaultPollInterval
+			if config.Webhook.Enabled() {
+				config.Credentials[i].PollInterval.Duration = DefaultMaxPollInterval
+			}
+		}
+		if bucketConfig.MaxPollInterval.Duration == 0 {
+			config.Credentials[i].MaxPollInterval.Duration = DefaultMaxPollInterval
+			if config.Credentials[i].PollInterval.Duration > DefaultMaxPollInterval {
+				config.Credentials[i].MaxPollInterval = config.Credentials[i].PollInterval
+			}
+		}
+		if err := validatePollIntervals(config.Credentials[i]); err != nil {
+			problems.add("Error in the polling of %s: %s", name, err)
+		}
+		if bucketConfig.FullRescanInterval.Duration <= 0 {
+			config.Credentials[i].FullRescanInterval.Duration = DefaultFullRescanInterval
+		}
+	}
+	problems = append(problems, duplicatedBuckets(config.Credentials)...)
+
+	if len(problems) > 0 {
+		err = problems
 	}
 	return
 }
@@ -0,0 +1,151 @@
+package lib
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// PathRule maps the key of an object into the directory of the repository
+// where the object is ingested.
+//
+// The supported types are:
+//  1. "prefix": the Prefix of the key is replaced with Replacement, the object
+//     is ingested in the directory of the resulting path
+//  2. "base-directory": every key starting with Prefix is ingested in the fixed
+//     Directory
+//  3. "regex": if the key matches Regex the object is ingested in Target,
+//     where $1, $2, ... are replaced with the capture groups
+//  4. "strip-extension": every key starting with Prefix is ingested in the
+//     directory named as the key without its extension, foo/bar.tar goes into
+//     foo/bar
+type PathRule struct {
+	Type        string `toml:"type"`
+	Prefix      string `toml:"prefix"`
+	Replacement string `toml:"replacement"`
+	Directory   string `toml:"directory"`
+	Regex       string `toml:"regex"`
+	Target      string `toml:"target"`
+
+	regex *regexp.Regexp
+}
+
+// Validate checks the rule and prepares it to be used
+func (rule *PathRule) Validate() error {
+	switch rule.Type {
+	case "prefix":
+		return validateRelativePath(rule.Replacement)
+	case "base-directory":
+		return validateRelativePath(rule.Directory)
+	case "regex":
+		regex, err := regexp.Compile(rule.Regex)
+		if err != nil {
+			return fmt.Errorf("Invalid regex %s: %s", rule.Regex, err)
+		}
+		rule.regex = regex
+		return validateRelativePath(rule.Target)
+	case "strip-extension":
+		return nil
+	default:
+		return fmt.Errorf("Unknown type of path-mapping rule: %s", rule.Type)
+	}
+}
+
+// apply returns the directory for the key and whether the rule matched
+func (rule PathRule) apply(key string) (string, bool) {
+	switch rule.Type {
+	case "prefix":
+		if !strings.HasPrefix(key, rule.Prefix) {
+			return "", false
+		}
+		return path.Dir(path.Join(rule.Replacement, strings.TrimPrefix(key, rule.Prefix))), true
+	case "base-directory":
+		if !strings.HasPrefix(key, rule.Prefix) {
+			return "", false
+		}
+		return rule.Directory, true
+	case "regex":
+		regex := rule.regex
+		if regex == nil {
+			var err error
+			if regex, err = regexp.Compile(rule.Regex); err != nil {
+				return "", false
+			}
+		}
+		match := regex.FindStringSubmatchIndex(key)
+		if match == nil {
+			return "", false
+		}
+		return string(regex.ExpandString(nil, rule.Target, key, match)), true
+	case "strip-extension":
+		if !strings.HasPrefix(key, rule.Prefix) {
+			return "", false
+		}
+		return strings.TrimSuffix(key, path.Ext(key)), true
+	}
+	return "", false
+}
+
+// MapKeyToPath returns the directory of the repository where to ingest the
+// object, the first rule matching the key is used, if no rule match the
+// object is ingested in the same directory of the key.
+func MapKeyToPath(rules []PathRule, key string) (string, error) {
+	// checked before any rule is applied since the rules clean the paths
+	if hasDotDotSegment(key) {
+		return "", fmt.Errorf("Key with .. segment not allowed: %s", key)
+	}
+	for _, rule := range rules {
+		if dir, ok := rule.apply(key); ok {
+			if err := validateRelativePath(dir); err != nil {
+				return "", fmt.Errorf("Rule %s mapped the key %s outside the repository: %s",
+					rule.Type, key, err)
+			}
+			return cleanDirectory(dir), nil
+		}
+	}
+	dir := path.Dir(key)
+	if err := validateRelativePath(dir); err != nil {
+		return "", fmt.Errorf("Key %s points outside the repository: %s", key, err)
+	}
+	return cleanDirectory(dir), nil
+}
+
+// validateRelativePath rejects absolute paths and paths containing ..
+// segments, so that the objects cannot land outside of the subtree they
+// are allowed in
+func validateRelativePath(p string) error {
+	if strings.HasPrefix(p, "/") {
+		return fmt.Errorf("Absolute path not allowed: %s", p)
+	}
+	if hasDotDotSegment(p) {
+		return fmt.Errorf("Path with .. segment not allowed: %s", p)
+	}
+	return nil
+}
+
+func hasDotDotSegment(p string) bool {
+	for _, segment := range strings.Split(p, "/") {
+		if segment == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// ingestBaseDir is the base directory given to `cvmfs_server ingest`, the
+// objects mapped to the top level go into the root of the repository
+func ingestBaseDir(dir string) string {
+	if dir == "" {
+		return "/"
+	}
+	return dir
+}
+
+func cleanDirectory(dir string) string {
+	dir = path.Clean(dir)
+	if dir == "." {
+		return ""
+	}
+	return dir
+}
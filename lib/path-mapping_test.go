@@ -0,0 +1,105 @@
+package lib
+
+import "testing"
+
+func TestMapKeyToPath(t *testing.T) {
+	rules := []PathRule{
+		{Type: "prefix", Prefix: "team/", Replacement: "sw"},
+		{Type: "prefix", Prefix: "flat/", Replacement: ""},
+		{Type: "base-directory", Prefix: "conf/", Directory: "etc/portal"},
+		{Type: "regex", Regex: `^releases/(\w+)-(\d+)\.tar$`, Target: "releases/$1/$2"},
+		{Type: "strip-extension", Prefix: "pkg/"},
+	}
+	for i := range rules {
+		if err := rules[i].Validate(); err != nil {
+			t.Fatalf("Rule %d is not valid: %s", i, err)
+		}
+	}
+
+	tests := []struct {
+		key      string
+		expected string
+		fails    bool
+	}{
+		{key: "team/x/y.tar", expected: "sw/x"},
+		{key: "team/y.tar", expected: "sw"},
+		{key: "flat/x/y.tar", expected: "x"},
+		{key: "flat/y.tar", expected: ""},
+		{key: "conf/deep/a.tar", expected: "etc/portal"},
+		{key: "releases/gcc-8.tar", expected: "releases/gcc/8"},
+		{key: "pkg/tools/root.tar", expected: "pkg/tools/root"},
+		// no rule matches, same directory of the key
+		{key: "other/dir/a.tar", expected: "other/dir"},
+		{key: "a.tar", expected: ""},
+		// the keys must not escape the subtree of their rule
+		{key: "team/../other/x.tar", fails: true},
+		{key: "team/x/../../../etc/x.tar", fails: true},
+		{key: "../a.tar", fails: true},
+		{key: "other/../../a.tar", fails: true},
+	}
+	for _, test := range tests {
+		dir, err := MapKeyToPath(rules, test.key)
+		if test.fails {
+			if err == nil {
+				t.Errorf("MapKeyToPath(%q) = %q, expected an error", test.key, dir)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("MapKeyToPath(%q) failed: %s", test.key, err)
+			continue
+		}
+		if dir != test.expected {
+			t.Errorf("MapKeyToPath(%q) = %q, expected %q", test.key, dir, test.expected)
+		}
+	}
+}
+
+func TestMapKeyToPathRegexEscape(t *testing.T) {
+	rules := []PathRule{{Type: "regex", Regex: `^up/(.*)\.tar$`, Target: "$1"}}
+	if err := rules[0].Validate(); err != nil {
+		t.Fatalf("Rule is not valid: %s", err)
+	}
+	// the capture group is not a path segment but the key is checked
+	// before the rule is applied
+	if dir, err := MapKeyToPath(rules, "up/../../etc.tar"); err == nil {
+		t.Errorf("MapKeyToPath escaped the repository into %q", dir)
+	}
+}
+
+func TestPathRuleValidate(t *testing.T) {
+	tests := []struct {
+		rule  PathRule
+		valid bool
+	}{
+		{PathRule{Type: "prefix", Prefix: "a/", Replacement: "b"}, true},
+		{PathRule{Type: "prefix", Prefix: "a/", Replacement: "/b"}, false},
+		{PathRule{Type: "prefix", Prefix: "a/", Replacement: "b/../.."}, false},
+		{PathRule{Type: "base-directory", Prefix: "a/", Directory: "../b"}, false},
+		{PathRule{Type: "regex", Regex: "(", Target: "b"}, false},
+		{PathRule{Type: "regex", Regex: "(.*)", Target: "/$1"}, false},
+		{PathRule{Type: "strip-extension"}, true},
+		{PathRule{Type: "unknown"}, false},
+	}
+	for _, test := range tests {
+		err := test.rule.Validate()
+		if (err == nil) != test.valid {
+			t.Errorf("Validate(%+v) = %v, expected valid %v", test.rule, err, test.valid)
+		}
+	}
+}
+
+func TestIngestBaseDir(t *testing.T) {
+	tests := []struct {
+		dir      string
+		expected string
+	}{
+		{"", "/"},
+		{"sw/x", "sw/x"},
+	}
+	for _, test := range tests {
+		if got := ingestBaseDir(test.dir); got != test.expected {
+			t.Errorf("ingestBaseDir(%q) = %q, expected %q", test.dir, got, test.expected)
+		}
+	}
+}
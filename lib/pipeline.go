@@ -1,12 +1,9 @@
 package lib
 
 import (
-	"bytes"
 	"crypto/sha256"
 	"fmt"
-	"io/ioutil"
 	"os"
-	"path/filepath"
 	"strings"
 	"sync"
 	"time"
@@ -15,18 +12,19 @@ import (
 	"github.com/cvmfs/portals/log"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 )
 
 /*
 The idea here is to have a pipeline, where:
 1. Element enter
 2. They are downloaded into local storange
-3. They are ingested into CVMFS
-4. Local resource are cleaned up
-5. Element exits
+3. The content is validated
+4. They are ingested into CVMFS
+5. Local resource are cleaned up
+6. Element exits
 
 What happen in case of failure?  We can return a structure that implement the
 interface of the next pipeline, on this structure we can simply shortcut all
@@ -38,7 +36,11 @@ type PipelineInput interface {
 }
 
 type IS3RemoteFile interface {
-	DownloadFile() IS3LocalFile
+	DownloadFile() IS3DownloadedFile
+}
+
+type IS3DownloadedFile interface {
+	Validate() IS3LocalFile
 }
 
 type IS3LocalFile interface {
@@ -49,58 +51,102 @@ type IS3IngestedFile interface {
 	Cleanup() PipelineOutput
 }
 
-type PipelineOutput struct{}
+type PipelineOutput struct {
+	// the element that entered the pipeline and produced this output
+	Input PipelineInput
+	// the element to send into the pipeline again, if any
+	Restart PipelineInput
+}
+
+// tracked carries, through all the stages, the element that entered the
+// pipeline along with what it became
+type tracked struct {
+	input PipelineInput
+	value interface{}
+}
+
+func (t tracked) Priority() int {
+	return priorityOf(t.value)
+}
 
 func NewPipeline() (chan<- PipelineInput, <-chan PipelineOutput) {
-	// Each channel has a buffer of size $buffer, and we have $workers running
+	// Each queue has a capacity of $buffer, and we have $workers running
 	// at the same time, it means that in the worst case there are $buffer
 	// + $workers job on the fly.
+	// The queues are priority queues, at every stage the elements with the
+	// highest priority are processed first.
 	buffer := 10
 	workers := 10
 	chanInput := make(chan PipelineInput, buffer)
 	chanOutput := make(chan PipelineOutput, buffer)
 
 	go func() {
-		downloadChan := make(chan IS3RemoteFile, buffer)
-		var downloadChanWG sync.WaitGroup
+		inputQueue := newPriorityQueue(buffer)
+
+		downloadQueue := newPriorityQueue(buffer)
+		var downloadQueueWG sync.WaitGroup
 
-		ingestChan := make(chan IS3LocalFile, buffer)
-		var ingestChanWG sync.WaitGroup
+		validateQueue := newPriorityQueue(buffer)
+		var validateQueueWG sync.WaitGroup
 
-		cleanupChan := make(chan IS3IngestedFile, buffer)
-		var cleanupChanWG sync.WaitGroup
+		ingestQueue := newPriorityQueue(buffer)
+		var ingestQueueWG sync.WaitGroup
+
+		cleanupQueue := newPriorityQueue(buffer)
+		var cleanupQueueWG sync.WaitGroup
 
 		var chanOutputWG sync.WaitGroup
 
+		go func() {
+			for pipelineInput := range chanInput {
+				inputQueue.Push(tracked{pipelineInput, pipelineInput})
+			}
+			inputQueue.Close()
+		}()
+
 		for w := 1; w <= workers; w++ {
-			downloadChanWG.Add(1)
+			downloadQueueWG.Add(1)
 			go func() {
-				defer downloadChanWG.Done()
+				defer downloadQueueWG.Done()
 
-				for pipelineInput := range chanInput {
+				for item, ok := inputQueue.Pop(); ok; item, ok = inputQueue.Pop() {
+					t := item.(tracked)
 					remoteFileToDownload :=
-						pipelineInput.MakeS3RemoteFile()
-					downloadChan <- remoteFileToDownload
+						t.value.(PipelineInput).MakeS3RemoteFile()
+					downloadQueue.Push(tracked{t.input, remoteFileToDownload})
+				}
+			}()
+
+			validateQueueWG.Add(1)
+			go func() {
+				defer validateQueueWG.Done()
+
+				for item, ok := downloadQueue.Pop(); ok; item, ok = downloadQueue.Pop() {
+					t := item.(tracked)
+					downloadedFileToValidate := t.value.(IS3RemoteFile).DownloadFile()
+					validateQueue.Push(tracked{t.input, downloadedFileToValidate})
 				}
 			}()
 
-			ingestChanWG.Add(1)
+			ingestQueueWG.Add(1)
 			go func() {
-				defer ingestChanWG.Done()
+				defer ingestQueueWG.Done()
 
-				for s3RemoteFile := range downloadChan {
-					localFileToIngest := s3RemoteFile.DownloadFile()
-					ingestChan <- localFileToIngest
+				for item, ok := validateQueue.Pop(); ok; item, ok = validateQueue.Pop() {
+					t := item.(tracked)
+					localFileToIngest := t.value.(IS3DownloadedFile).Validate()
+					ingestQueue.Push(tracked{t.input, localFileToIngest})
 				}
 			}()
 
-			cleanupChanWG.Add(1)
+			cleanupQueueWG.Add(1)
 			go func() {
-				defer cleanupChanWG.Done()
+				defer cleanupQueueWG.Done()
 
-				for s3LocalFile := range ingestChan {
-					ingestedFileToCleanup := s3LocalFile.Ingest()
-					cleanupChan <- ingestedFileToCleanup
+				for item, ok := ingestQueue.Pop(); ok; item, ok = ingestQueue.Pop() {
+					t := item.(tracked)
+					ingestedFileToCleanup := t.value.(IS3LocalFile).Ingest()
+					cleanupQueue.Push(tracked{t.input, ingestedFileToCleanup})
 				}
 			}()
 
@@ -108,22 +154,27 @@ func NewPipeline() (chan<- PipelineInput, <-chan PipelineOutput) {
 			go func() {
 				defer chanOutputWG.Done()
 
-				for s3IngestedFile := range cleanupChan {
-					cleanedupFileToReturn := s3IngestedFile.Cleanup()
+				for item, ok := cleanupQueue.Pop(); ok; item, ok = cleanupQueue.Pop() {
+					t := item.(tracked)
+					cleanedupFileToReturn := t.value.(IS3IngestedFile).Cleanup()
+					cleanedupFileToReturn.Input = t.input
 					chanOutput <- cleanedupFileToReturn
 				}
 			}()
 		}
 
 		go func() {
-			downloadChanWG.Wait()
-			close(downloadChan)
+			downloadQueueWG.Wait()
+			downloadQueue.Close()
+
+			validateQueueWG.Wait()
+			validateQueue.Close()
 
-			ingestChanWG.Wait()
-			close(ingestChan)
+			ingestQueueWG.Wait()
+			ingestQueue.Close()
 
-			cleanupChanWG.Wait()
-			close(cleanupChan)
+			cleanupQueueWG.Wait()
+			cleanupQueue.Close()
 
 			chanOutputWG.Wait()
 			close(chanOutput)
@@ -139,7 +190,11 @@ func NewPipeline() (chan<- PipelineInput, <-chan PipelineOutput) {
 
 type GenericError struct{}
 
-func (e GenericError) DownloadFile() IS3LocalFile {
+func (e GenericError) DownloadFile() IS3DownloadedFile {
+	return GenericError{}
+}
+
+func (e GenericError) Validate() IS3LocalFile {
 	return GenericError{}
 }
 
@@ -159,6 +214,10 @@ type ErrorInDownloadingFile struct {
 	GenericError
 }
 
+type ErrorInReadingMetadata struct {
+	GenericError
+}
+
 type ErrorInIngesting struct {
 	fileTempPath string
 }
@@ -168,6 +227,46 @@ func (err ErrorInIngesting) Cleanup() PipelineOutput {
 	return PipelineOutput{}
 }
 
+// ErrorWithStatus is used when the object cannot be ingested for a reason
+// that the user needs to know, it skips all the stages and it writes the
+// FAILURE status with the error
+type ErrorWithStatus struct {
+	S3Object
+	err      error
+	details  map[string]string
+	tempPath string
+}
+
+func NewErrorWithStatus(s3o S3Object, err error) ErrorWithStatus {
+	return ErrorWithStatus{S3Object: s3o, err: err}
+}
+
+func (e ErrorWithStatus) DownloadFile() IS3DownloadedFile {
+	return e
+}
+
+func (e ErrorWithStatus) Validate() IS3LocalFile {
+	return e
+}
+
+func (e ErrorWithStatus) Ingest() IS3IngestedFile {
+	return e
+}
+
+func (e ErrorWithStatus) Cleanup() PipelineOutput {
+	if e.tempPath != "" {
+		os.Remove(e.tempPath)
+	}
+	l := log.Decorate(map[string]string{"file": e.key})
+	l(log.LogE(e.err)).Error("Impossible to ingest the object")
+
+	report := NewStatusReport(e.S3Object, "FAILURE")
+	report.Error = e.err.Error()
+	report.Details = e.details
+	e.UploadStatusReport(report)
+	return PipelineOutput{}
+}
+
 type S3Object struct {
 	bucket       string
 	statusBucket string
@@ -175,33 +274,70 @@ type S3Object struct {
 	hash         string
 	session      *session.Session
 	cvmfsRepo    *cvmfs.Repo
+	config       *BucketConfiguration
+	owner        ObjectOwner
+	etag         string
+	lastModified time.Time
+	size         int64
+	metadata     map[string]*string
+	priority     int
+
+	// how many times the object changed while it was processed
+	restarts int
+
+	// directory of the repository where the object is ingested
+	cvmfsPath string
+
+	journal *Journal
 }
 
 func (s3o S3Object) UploadStatus(status string) error {
-	t := time.Now()
-	timestamp := fmt.Sprint(t)
-	body := bytes.NewBuffer(make([]byte, 0))
-	body.WriteString(timestamp)
-
-	key := fmt.Sprintf("%s.%s.%s", s3o.key, s3o.hash, status)
-
-	uploader := s3manager.NewUploader(s3o.session)
-	_, err := uploader.Upload(&s3manager.UploadInput{
-		Bucket: aws.String(s3o.statusBucket),
-		Key:    aws.String(key),
-		Body:   body,
-	})
-	if err != nil {
-		l := log.Decorate(map[string]string{"file": key})
-		l(log.LogE(err)).Error("Error in uploading file")
+	return s3o.UploadStatusReport(NewStatusReport(s3o, status))
+}
+
+// UploadStatusReport records the report in the journal and then mirrors it
+// into the status bucket
+func (s3o S3Object) UploadStatusReport(report StatusReport) error {
+	if err := s3o.recordStatusReport(report); err != nil {
 		return err
 	}
-	return nil
+	return UploadStatusReport(s3o.session, s3o.statusBucket, report)
 }
 
-func NewS3Object(bucket, statusBucket string, s3obj s3.Object, session *session.Session, cvmfsRepo *cvmfs.Repo) S3Object {
+// ReportStatus records the status in the journal, the upload into the status
+// bucket happens in the background
+func (s3o S3Object) ReportStatus(status string) {
+	s3o.ReportStatusReport(NewStatusReport(s3o, status))
+}
+
+func (s3o S3Object) ReportStatusReport(report StatusReport) {
+	if err := s3o.recordStatusReport(report); err != nil {
+		return
+	}
+	go UploadStatusReport(s3o.session, s3o.statusBucket, report)
+}
 
-	toHash := []byte(fmt.Sprintf("%s%d", *s3obj.Key, s3obj.LastModified.Unix()))
+func (s3o S3Object) recordStatusReport(report StatusReport) error {
+	if s3o.journal == nil {
+		return nil
+	}
+	err := s3o.journal.Record(s3o.bucket, report)
+	if err != nil {
+		l := log.Decorate(map[string]string{"file": report.StatusKey()})
+		l(log.LogE(err)).Error("Error in recording the status in the journal")
+	}
+	return err
+}
+
+// Processed is true if the journal says that this version of the object
+// already reached a final status
+func (s3o S3Object) Processed() bool {
+	return s3o.journal != nil && s3o.journal.Processed(s3o.bucket, s3o.key, s3o.hash)
+}
+
+func NewS3Object(bucket, statusBucket string, s3obj s3.Object, session *session.Session, cvmfsRepo *cvmfs.Repo, config *BucketConfiguration, journal *Journal) S3Object {
+
+	toHash := []byte(fmt.Sprintf("%s%d", *s3obj.Key, aws.TimeValue(s3obj.LastModified).Unix()))
 	hash := fmt.Sprintf("%x", sha256.Sum256(toHash))[0:10]
 	return S3Object{
 		bucket:       bucket,
@@ -209,40 +345,170 @@ func NewS3Object(bucket, statusBucket string, s3obj s3.Object, session *session.
 		key:          *s3obj.Key,
 		hash:         hash,
 		session:      session,
-		cvmfsRepo:    cvmfsRepo}
+		cvmfsRepo:    cvmfsRepo,
+		config:       config,
+		owner:        NewObjectOwner(s3obj.Owner),
+		etag:         strings.Trim(aws.StringValue(s3obj.ETag), "\""),
+		lastModified: aws.TimeValue(s3obj.LastModified),
+		size:         aws.Int64Value(s3obj.Size),
+		priority:     priorityFromPrefix(config.Priorities, *s3obj.Key),
+		journal:      journal}
 }
 
 func (s3obj S3Object) MakeS3RemoteFile() IS3RemoteFile {
+	cvmfsPath, err := MapKeyToPath(s3obj.config.PathMapping, s3obj.key)
+	if err != nil {
+		return NewErrorWithStatus(s3obj, err)
+	}
+	s3obj.cvmfsPath = cvmfsPath
+
+	head, err := s3.New(s3obj.session).HeadObject(&s3.HeadObjectInput{
+		Bucket: &s3obj.bucket,
+		Key:    &s3obj.key,
+	})
+	if err != nil {
+		// it is not a problem of the object, the next listing tries again,
+		// or it does not find the object if it was deleted
+		l := log.Decorate(map[string]string{"file": s3obj.key})
+		l(log.LogE(err)).Error("Error in reading the metadata of the object")
+		return ErrorInReadingMetadata{}
+	}
+	s3obj.metadata = head.Metadata
+	if priority, ok := priorityFromMetadata(s3obj.metadata, s3obj.config.MaxMetadataPriority); ok {
+		s3obj.priority = priority
+	}
+
+	if len(s3obj.config.ACL) > 0 {
+		if s3obj.owner.IsEmpty() {
+			s3obj.owner = s3obj.ownerFromMetadata()
+		}
+		err = CheckACL(s3obj.config.ACL, s3obj.owner, s3obj.key, s3obj.cvmfsPath)
+		if err != nil {
+			return NewErrorWithStatus(s3obj, err)
+		}
+	}
 	return s3obj
 }
 
-type S3LocalFile struct {
+// ownerFromMetadata is used for backends that do not report the owner in
+// the listing, the owner is read from the x-amz-meta-owner metadata
+func (s3obj S3Object) ownerFromMetadata() ObjectOwner {
+	owner, ok := s3obj.metadata["Owner"]
+	if !ok || owner == nil {
+		return ObjectOwner{}
+	}
+	return ObjectOwner{ID: *owner}
+}
+
+func (s3obj S3Object) Priority() int {
+	return s3obj.priority
+}
+
+type S3DownloadedFile struct {
 	S3Object
 	tempPath string
 }
 
-func (s3obj S3Object) DownloadFile() IS3LocalFile {
+func (s3obj S3Object) DownloadFile() IS3DownloadedFile {
+	if s3obj.config.Streaming {
+		return S3StreamingFile{s3obj}
+	}
+	return s3obj.downloadToFile()
+}
 
-	f, err := ioutil.TempFile("", "s3temp")
-	defer f.Close()
+func (s3obj S3Object) downloadToFile() IS3DownloadedFile {
+	l := log.Decorate(map[string]string{
+		"Action": "download",
+		"Bucket": s3obj.bucket,
+		"Key":    s3obj.key,
+	})
 
+	download, err := OpenRangedDownload(s3obj)
 	if err != nil {
+		l(log.LogE(err)).Error("Error in preparing the download")
 		return ErrorImpossibleToCreateTempFile{}
 	}
 
-	go s3obj.UploadStatus("DOWNLOADING")
+	// a full spool is not a problem of the object, it is not a FAILURE
+	// and the object is tried again at the next listing
+	release, err := ReserveSpoolSpace(s3obj.config.SpoolDir, download.Remaining())
+	if err != nil {
+		download.Release()
+		l(log.LogE(err)).Error("Not enough space to download the object")
+		return ErrorImpossibleToCreateTempFile{}
+	}
+	defer release()
 
-	downloader := s3manager.NewDownloader(s3obj.session)
-	_, err = downloader.Download(f, &s3.GetObjectInput{
-		Bucket: &s3obj.bucket,
-		Key:    &s3obj.key,
-	})
+	s3obj.ReportStatus("DOWNLOADING")
 
-	if err != nil {
+	if err = download.Download(); err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "PreconditionFailed" {
+			// the object changed, the parts downloaded are useless
+			download.Discard()
+			l(log.Log()).Info("The object changed during the download")
+			return ErrorObjectChanged{S3Object: s3obj}
+		}
+		if isPermanentDownloadError(err) {
+			// the object is not tried again, the parts downloaded are useless
+			download.Discard()
+			return NewErrorWithStatus(s3obj, fmt.Errorf("Error in downloading the object: %s", err))
+		}
+		// the parts downloaded are kept, the next listing resumes
+		download.Release()
+		l(log.LogE(err)).Error("Error in downloading the object")
 		return ErrorInDownloadingFile{}
 	}
 
-	return S3LocalFile{s3obj, f.Name()}
+	tempPath, err := download.Complete()
+	if err != nil {
+		l(log.LogE(err)).Error("Error in completing the download")
+		return ErrorImpossibleToCreateTempFile{}
+	}
+
+	err = s3obj.VerifyChecksum(tempPath)
+	if err != nil {
+		failure := NewErrorWithStatus(s3obj, err)
+		if mismatch, ok := err.(ChecksumMismatch); ok {
+			failure.details = mismatch.Details()
+		}
+		failure.tempPath = tempPath
+		return failure
+	}
+
+	return S3DownloadedFile{s3obj, tempPath}
+}
+
+type S3LocalFile struct {
+	S3Object
+	tempPath string
+}
+
+func (s3downloaded S3DownloadedFile) Validate() IS3LocalFile {
+	if s3downloaded.config.Signature.Enabled() {
+		signer, err := s3downloaded.VerifySignature(s3downloaded.tempPath)
+		if err != nil {
+			failure := NewErrorWithStatus(s3downloaded.S3Object, err)
+			if sigErr, ok := err.(SignatureError); ok {
+				failure.details = sigErr.Details()
+			}
+			failure.tempPath = s3downloaded.tempPath
+			return failure
+		}
+		l := log.Decorate(map[string]string{"file": s3downloaded.key, "signer": signer})
+		l(log.Log()).Info("Valid signature")
+	}
+
+	violations, err := ValidateTarFile(s3downloaded.config.TarPolicy, s3downloaded.tempPath)
+	if err == nil && !violations.Empty() {
+		err = violations
+	}
+	if err != nil {
+		failure := NewErrorWithStatus(s3downloaded.S3Object, err)
+		failure.details = violations.Details()
+		failure.tempPath = s3downloaded.tempPath
+		return failure
+	}
+	return S3LocalFile{s3downloaded.S3Object, s3downloaded.tempPath}
 }
 
 type S3IngestedFile struct {
@@ -251,36 +517,68 @@ type S3IngestedFile struct {
 }
 
 func (s3local S3LocalFile) Ingest() IS3IngestedFile {
-	keyPaths := strings.Split(s3local.key, "/")
-	cvmfsPath := filepath.Join(keyPaths[:len(keyPaths)-1]...)
+	cvmfsPath := ingestBaseDir(s3local.cvmfsPath)
+	repo := s3local.cvmfsRepo.Name
 
-	if cvmfsPath == "" {
-		// TODO does it works?
-		cvmfsPath = "./"
+	tagName, tagDescription, err := s3local.TagFor(time.Now())
+	if err != nil {
+		l := log.Decorate(map[string]string{"file": s3local.key})
+		l(log.LogE(err)).Error("Error in generating the tag")
+		return ErrorInIngesting{s3local.tempPath}
 	}
 
-	repo := s3local.cvmfsRepo.Name
+	ingesting := NewStatusReport(s3local.S3Object, "INGESTING")
+	ingesting.Tag = tagName
+	s3local.ReportStatusReport(ingesting)
 
-	go s3local.UploadStatus("INGESTING")
+	err = func() error {
+		s3local.cvmfsRepo.Lock.LockWithPriority(s3local.priority)
+		defer s3local.cvmfsRepo.Lock.Unlock()
 
-	s3local.cvmfsRepo.Lock.Lock()
-	defer s3local.cvmfsRepo.Lock.Unlock()
+		unchanged, err := s3local.isUnchanged()
+		if err != nil {
+			return err
+		}
+		if !unchanged {
+			return errObjectChanged
+		}
 
-	err := cvmfs.ExecCommand("cvmfs_server", "ingest",
-		"-t", s3local.tempPath,
-		"-b", cvmfsPath,
-		repo).Start()
+		return cvmfs.ExecCommand("cvmfs_server", "ingest",
+			"-t", s3local.tempPath,
+			"-b", cvmfsPath,
+			"-a", tagName,
+			"-m", tagDescription,
+			repo).Start()
+	}()
 
+	if err == errObjectChanged {
+		return ErrorObjectChanged{s3local.S3Object, s3local.tempPath}
+	}
 	if err != nil {
 		return ErrorInIngesting{s3local.tempPath}
 	}
 
+	s3local.UploadStatusReport(NewSuccessReport(s3local.S3Object, publishedTag(repo, tagName)))
+
 	return S3IngestedFile{s3local.S3Object, s3local.tempPath}
 }
 
+// publishedTag returns the tag of an ingestion already published, if the tag
+// cannot be read only its name is known, the ingestion is done anyway and it
+// must not be retried
+func publishedTag(repo, tagName string) cvmfs.Tag {
+	tag, err := cvmfs.GetTag(repo, tagName)
+	if err != nil {
+		l := log.Decorate(map[string]string{"repository": repo, "tag": tagName})
+		l(log.LogE(err)).Error("Error in reading the tag of the ingestion, the revision and the root hash are not reported")
+		return cvmfs.Tag{Name: tagName}
+	}
+	return tag
+}
+
 func (s3ingested S3IngestedFile) Cleanup() PipelineOutput {
 	os.Remove(s3ingested.tempPath)
 
-	go s3ingested.UploadStatus("DELETING")
+	s3ingested.ReportStatus("DELETING")
 	return PipelineOutput{}
 }
@@ -0,0 +1,71 @@
+package lib
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+/*
+The portals poll their buckets, how often depends on what they find:
+1. After a listing with work to do the next one comes after poll-interval
+2. Every listing with nothing to do doubles the interval, up to
+   max-poll-interval
+3. Each interval is randomized by pollJitter, so that the portals on the
+   same endpoint do not list it all at the same moment
+*/
+
+const (
+	DefaultPollInterval    = 30 * time.Second
+	DefaultMaxPollInterval = 10 * time.Minute
+
+	// fraction of the interval added or removed at random
+	pollJitter = 0.2
+)
+
+// Backoff is the interval between two polls, it is not safe for concurrent use
+type Backoff struct {
+	min     time.Duration
+	max     time.Duration
+	current time.Duration
+	random  *rand.Rand
+}
+
+func NewBackoff(min, max time.Duration) *Backoff {
+	return &Backoff{
+		min:     min,
+		max:     max,
+		current: min,
+		random:  rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Reset goes back to the shortest interval
+func (b *Backoff) Reset() {
+	b.current = b.min
+}
+
+// Increase doubles the interval, up to the longest one
+func (b *Backoff) Increase() {
+	b.current *= 2
+	if b.current > b.max {
+		b.current = b.max
+	}
+}
+
+// Duration is the current interval with the jitter applied
+func (b *Backoff) Duration() time.Duration {
+	jitter := (b.random.Float64()*2 - 1) * pollJitter
+	return b.current + time.Duration(float64(b.current)*jitter)
+}
+
+func validatePollIntervals(bc BucketConfiguration) error {
+	if bc.PollInterval.Duration < 0 {
+		return fmt.Errorf("poll-interval must be positive")
+	}
+	if bc.MaxPollInterval.Duration < bc.PollInterval.Duration {
+		return fmt.Errorf("max-poll-interval (%s) must not be shorter than poll-interval (%s)",
+			bc.MaxPollInterval.Duration, bc.PollInterval.Duration)
+	}
+	return nil
+}
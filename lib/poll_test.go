@@ -0,0 +1,61 @@
+package lib
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	b := NewBackoff(time.Second, 10*time.Second)
+	steps := []struct {
+		action  string
+		current time.Duration
+	}{
+		{"", time.Second},
+		{"increase", 2 * time.Second},
+		{"increase", 4 * time.Second},
+		{"increase", 8 * time.Second},
+		{"increase", 10 * time.Second},
+		{"increase", 10 * time.Second},
+		{"reset", time.Second},
+		{"increase", 2 * time.Second},
+	}
+	for i, step := range steps {
+		switch step.action {
+		case "increase":
+			b.Increase()
+		case "reset":
+			b.Reset()
+		}
+		if b.current != step.current {
+			t.Errorf("step %d: expected %s, got %s", i, step.current, b.current)
+		}
+		for j := 0; j < 100; j++ {
+			d := b.Duration()
+			jitter := time.Duration(float64(step.current) * pollJitter)
+			if d < step.current-jitter || d > step.current+jitter {
+				t.Errorf("step %d: %s is out of the jitter of %s", i, d, step.current)
+				break
+			}
+		}
+	}
+}
+
+func TestValidatePollIntervals(t *testing.T) {
+	tests := []struct {
+		poll  time.Duration
+		max   time.Duration
+		valid bool
+	}{
+		{time.Second, time.Minute, true},
+		{time.Minute, time.Minute, true},
+		{time.Minute, time.Second, false},
+		{-time.Second, time.Minute, false},
+	}
+	for _, test := range tests {
+		bc := BucketConfiguration{PollInterval: Duration{test.poll}, MaxPollInterval: Duration{test.max}}
+		if err := validatePollIntervals(bc); (err == nil) != test.valid {
+			t.Errorf("%s/%s: expected valid %t, got %v", test.poll, test.max, test.valid, err)
+		}
+	}
+}
@@ -0,0 +1,361 @@
+package lib
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cvmfs/portals/cvmfs"
+	"github.com/cvmfs/portals/log"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+/*
+A Portal feeds a single, long lived, pipeline with the objects of its bucket.
+
+The objects come from the listings of the bucket and, when the webhook is
+enabled, from the notifications of the bucket. The same object may come from
+both, it enters the pipeline only once.
+The objects that leave the pipeline without being ingested are forgotten by
+the lister, so that the next listing tries them again. The objects that
+changed while they were processed go back into the pipeline right away.
+*/
+
+type Portal struct {
+	config  *BucketConfiguration
+	couple  S3BucketCouple
+	repo    *cvmfs.Repo
+	journal *Journal
+	lister  *IncrementalLister
+
+	input chan<- PipelineInput
+
+	mutex    sync.Mutex
+	idle     *sync.Cond
+	inFlight map[string]bool
+}
+
+func NewPortal(config *BucketConfiguration, couple S3BucketCouple, repo *cvmfs.Repo, journal *Journal) *Portal {
+	p := &Portal{
+		config:   config,
+		couple:   couple,
+		repo:     repo,
+		journal:  journal,
+		lister:   NewIncrementalLister(couple.Data, config.FullRescanInterval.Duration),
+		inFlight: make(map[string]bool),
+	}
+	p.idle = sync.NewCond(&p.mutex)
+
+	input, output := NewPipeline()
+	p.input = input
+	go func() {
+		for out := range output {
+			if out.Restart != nil {
+				p.restart(out.Restart)
+			}
+			p.done(out.Input)
+		}
+	}()
+	return p
+}
+
+func (p *Portal) Bucket() string {
+	return p.couple.Data.BucketName
+}
+
+// Health of the listings of the bucket
+func (p *Portal) Health() ListingHealth {
+	return p.lister.Health()
+}
+
+// Run keeps listing the bucket, it never returns.
+// Every listing waits for the objects of the previous one to go through the
+// pipeline, and for the poll interval to pass, the interval grows while the
+// listings find nothing to do
+func (p *Portal) Run() {
+	backoff := NewBackoff(p.config.PollInterval.Duration, p.config.MaxPollInterval.Duration)
+	for {
+		start := time.Now()
+		pending, err := p.List()
+		p.waitIdle()
+
+		if err != nil {
+			health := p.Health()
+			log.LogE(err).WithField("bucket", p.Bucket()).
+				WithField("errors", health.Errors).
+				WithField("consecutive", health.ConsecutiveErrors).
+				Error("Error in listing the bucket")
+		}
+		if pending > 0 {
+			backoff.Reset()
+		} else {
+			// also after an error, not to hammer an endpoint in trouble
+			backoff.Increase()
+		}
+		wait := backoff.Duration() - time.Since(start)
+		log.Log().WithField("bucket", p.Bucket()).WithField("pending", pending).
+			WithField("next", wait.Round(time.Second).String()).Debug("Listing done")
+		if wait > 0 {
+			time.Sleep(wait)
+		}
+	}
+}
+
+// pipelineID identifies an element of the pipeline, the same version of the
+// same object has always the same identifier
+func pipelineID(input PipelineInput) string {
+	switch i := input.(type) {
+	case S3Object:
+		return i.key + "." + i.hash
+	case S3ObjectSet:
+		return i.id()
+	}
+	return ""
+}
+
+// pipelineKey is the key that the lister returns for the element
+func pipelineKey(input PipelineInput) string {
+	switch i := input.(type) {
+	case S3Object:
+		return i.key
+	case S3ObjectSet:
+		return i.marker.key
+	}
+	return ""
+}
+
+func pipelineProcessed(input PipelineInput) bool {
+	switch i := input.(type) {
+	case S3Object:
+		return i.Processed()
+	case S3ObjectSet:
+		return i.Processed()
+	}
+	return true
+}
+
+// reserve marks the input in flight, it is false if it already is
+func (p *Portal) reserve(input PipelineInput) bool {
+	id := pipelineID(input)
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.inFlight[id] {
+		return false
+	}
+	p.inFlight[id] = true
+	return true
+}
+
+// enqueue sends the input into the pipeline, unless it is already there, it
+// is true if the input is sent
+func (p *Portal) enqueue(input PipelineInput) bool {
+	if !p.reserve(input) {
+		return false
+	}
+	p.input <- input
+	return true
+}
+
+// restart sends the input into the pipeline again, it is marked in flight
+// before the element that produced it is done, so that waitIdle does not
+// return in between
+func (p *Portal) restart(input PipelineInput) {
+	if !p.reserve(input) {
+		return
+	}
+
+	// the output of the pipeline is read by the same goroutine, it must
+	// not block on the input
+	go func() { p.input <- input }()
+}
+
+func (p *Portal) done(input PipelineInput) {
+	if !pipelineProcessed(input) {
+		p.lister.Forget(pipelineKey(input))
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	delete(p.inFlight, pipelineID(input))
+	if len(p.inFlight) == 0 {
+		p.idle.Broadcast()
+	}
+}
+
+func (p *Portal) waitIdle() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for len(p.inFlight) > 0 {
+		p.idle.Wait()
+	}
+}
+
+func (p *Portal) newS3Object(object s3.Object) S3Object {
+	return NewS3Object(
+		p.couple.Data.BucketName,
+		p.couple.Status.BucketName,
+		object,
+		&p.couple.Status.Session,
+		p.repo,
+		p.config,
+		p.journal)
+}
+
+// List lists the bucket and sends into the pipeline the new objects that
+// are ready, it returns how many it sent, the objects still in their quiet
+// period are not counted: they alone do not keep the polling frequent
+func (p *Portal) List() (pending int, err error) {
+	objects, err := p.lister.List()
+	if err != nil {
+		return
+	}
+
+	for _, object := range OrderObjects(objects, p.config.Order, p.config.FairPrefixes) {
+		if p.config.CompletionMarker {
+			// the objects are ingested when their marker is listed
+			if isCompletionMarker(*object.Key) && p.enqueueMarker(*object.Key) {
+				pending++
+			}
+			continue
+		}
+		if p.enqueueObject(object) {
+			pending++
+		}
+	}
+	return
+}
+
+// enqueueObject is true if the object is sent into the pipeline
+func (p *Portal) enqueueObject(object s3.Object) bool {
+	keySplitted := strings.Split(*object.Key, ".")
+	if keySplitted[len(keySplitted)-1] != "tar" {
+		return false
+	}
+	if !p.config.IsStable(object, time.Now()) {
+		log.Log().WithField("key", *object.Key).Info("Object modified during the quiet period, waiting")
+		p.lister.Forget(*object.Key)
+		return false
+	}
+	s3obj := p.newS3Object(object)
+	if s3obj.Processed() {
+		return false
+	}
+	return p.enqueue(s3obj)
+}
+
+// enqueueMarker sends into the pipeline the group of the marker, if it is
+// ready, it is true if the group is sent
+func (p *Portal) enqueueMarker(marker string) bool {
+	objects, err := p.couple.Data.ListAllObjects(markerPrefix(marker))
+	if err != nil {
+		log.LogE(err).WithField("marker", marker).Error("Error in listing the objects of the marker")
+		p.lister.Forget(marker)
+		return false
+	}
+	groups, err := p.couple.Data.GroupByCompletionMarker(objects)
+	if err != nil {
+		log.LogE(err).Error("Error in grouping the objects by completion marker")
+		p.lister.Forget(marker)
+		return false
+	}
+	for _, group := range groups {
+		if *group.Marker.Key != marker {
+			continue
+		}
+		if group.Err != nil {
+			p.rejectMarker(group)
+			return false
+		}
+		if !p.config.IsGroupStable(group, time.Now()) {
+			log.Log().WithField("marker", marker).Info("Objects modified during the quiet period, waiting")
+			p.lister.Forget(marker)
+			return false
+		}
+		members := []S3Object{}
+		for _, object := range group.Objects {
+			members = append(members, p.newS3Object(object))
+		}
+		set := NewS3ObjectSet(p.newS3Object(group.Marker), members)
+		if set.Processed() {
+			for _, member := range members {
+				if !member.Processed() {
+					log.Log().WithField("marker", marker).
+						Info("Objects changed after the set was ingested, they wait for the marker to be uploaded again")
+					break
+				}
+			}
+			return false
+		}
+		return p.enqueue(set)
+	}
+	// the group is not complete yet
+	p.lister.Forget(marker)
+	return false
+}
+
+// rejectMarker writes the FAILURE of a marker whose group can never be
+// ingested, the user must fix it and upload the marker again
+func (p *Portal) rejectMarker(group ObjectGroup) {
+	marker := p.newS3Object(group.Marker)
+	if marker.Processed() {
+		return
+	}
+	l := log.Decorate(map[string]string{"marker": marker.key})
+	l(log.LogE(group.Err)).Error("The objects of the marker can never be ingested")
+	report := NewStatusReport(marker, "FAILURE")
+	report.Error = group.Err.Error()
+	marker.UploadStatusReport(report)
+}
+
+// ObjectCreated handles the notification of a new object in the bucket, if
+// the object is still in its quiet period it returns how long to wait before
+// trying again
+func (p *Portal) ObjectCreated(key string) time.Duration {
+	l := log.Decorate(map[string]string{
+		"Action": "notification",
+		"Bucket": p.Bucket(),
+		"Key":    key,
+	})
+
+	if p.config.CompletionMarker {
+		// only the markers are interesting, the other objects wait
+		// for them
+		if isCompletionMarker(key) {
+			p.enqueueMarker(key)
+		}
+		return 0
+	}
+
+	object, err := headObject(&p.couple.Data.Session, p.Bucket(), key)
+	if err != nil {
+		l(log.LogE(err)).Error("Error in reading the notified object")
+		return 0
+	}
+	// notifications arrive right after the upload
+	if !p.config.IsStable(object, time.Now()) {
+		return p.config.QuietPeriod.Duration - time.Since(aws.TimeValue(object.LastModified))
+	}
+	if hasOwnerRules(p.config.ACL) {
+		// the HEAD does not report the owner, without it the ACL would
+		// trust the owner metadata set by the uploader
+		object.Owner, err = readOwner(&p.couple.Data.Session, p.Bucket(), key)
+		if err != nil {
+			l(log.LogE(err)).Warning("Owner of the notified object unknown, it is left to the next listing")
+			p.retryAtNextListing(key)
+			return 0
+		}
+	}
+	p.enqueueObject(object)
+	return 0
+}
+
+// retryAtNextListing makes sure that the next listing considers the object
+// again
+func (p *Portal) retryAtNextListing(key string) {
+	p.lister.Forget(key)
+}
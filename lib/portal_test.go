@@ -0,0 +1,117 @@
+package lib
+
+import (
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestListPending(t *testing.T) {
+	old := time.Now().Add(-time.Hour)
+	recent := time.Now()
+	tests := []struct {
+		name     string
+		marker   bool
+		objects  map[string]time.Time
+		inFlight []string
+		// keys sent into the pipeline, the markers for the sets
+		enqueued string
+		// keys returned again by the next listing
+		forgotten string
+	}{
+		{
+			name:     "stable objects",
+			objects:  map[string]time.Time{"a.tar": old, "b.tar": old, "c.txt": old},
+			enqueued: "a.tar,b.tar",
+		},
+		{
+			name:      "quiet period",
+			objects:   map[string]time.Time{"a.tar": old, "b.tar": recent},
+			enqueued:  "a.tar",
+			forgotten: "b.tar",
+		},
+		{
+			name:      "only in the quiet period",
+			objects:   map[string]time.Time{"a.tar": recent},
+			forgotten: "a.tar",
+		},
+		{
+			name:     "already in flight",
+			objects:  map[string]time.Time{"a.tar": old, "b.tar": old},
+			inFlight: []string{"a.tar"},
+			enqueued: "b.tar",
+		},
+		{
+			name:     "ready marker",
+			marker:   true,
+			objects:  map[string]time.Time{"a/1.tar": old, "a/.ready": old, "b/2.tar": old},
+			enqueued: "a/.ready",
+		},
+		{
+			name:      "marker in the quiet period",
+			marker:    true,
+			objects:   map[string]time.Time{"a/1.tar": recent, "a/.ready": old},
+			forgotten: "a/.ready",
+		},
+	}
+	for _, test := range tests {
+		listing := newFakeListing(1000)
+		for key, modified := range test.objects {
+			listing.putAt(key, modified)
+		}
+		sess, stop := fakeS3(t, listing.ServeHTTP)
+		input := make(chan PipelineInput, len(test.objects))
+		p := testPortal("bucket")
+		p.config.QuietPeriod = Duration{time.Minute}
+		p.config.CompletionMarker = test.marker
+		p.couple.Data.Session = *sess
+		p.couple.Status = S3Bucket{BucketName: "bucket.status", Session: *sess}
+		p.lister = NewIncrementalLister(p.couple.Data, time.Hour)
+		p.input = input
+		listed, err := p.couple.Data.ListAllObjects("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, object := range listed {
+			for _, key := range test.inFlight {
+				if *object.Key == key {
+					p.reserve(p.newS3Object(object))
+				}
+			}
+		}
+
+		pending, err := p.List()
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", test.name, err)
+			stop()
+			continue
+		}
+		close(input)
+		enqueued := []string{}
+		for in := range input {
+			enqueued = append(enqueued, pipelineKey(in))
+		}
+		sort.Strings(enqueued)
+		if strings.Join(enqueued, ",") != test.enqueued {
+			t.Errorf("%s: expected %q in the pipeline, got %q", test.name, test.enqueued, enqueued)
+		}
+		if pending != len(enqueued) {
+			t.Errorf("%s: expected %d pending, got %d", test.name, len(enqueued), pending)
+		}
+
+		again, err := p.lister.List()
+		stop()
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", test.name, err)
+			continue
+		}
+		forgotten := []string{}
+		for _, object := range again {
+			forgotten = append(forgotten, *object.Key)
+		}
+		if strings.Join(forgotten, ",") != test.forgotten {
+			t.Errorf("%s: expected %q to be listed again, got %q", test.name, test.forgotten, forgotten)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package lib
+
+import (
+	"container/heap"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// PriorityRule gives a priority to all the objects whose key starts with
+// Prefix, the objects with higher priority are processed first
+type PriorityRule struct {
+	Prefix   string `toml:"prefix"`
+	Priority int    `toml:"priority"`
+}
+
+// Prioritized is implemented by the elements of the pipeline, the elements
+// that do not implement it have priority zero
+type Prioritized interface {
+	Priority() int
+}
+
+func priorityOf(item interface{}) int {
+	if p, ok := item.(Prioritized); ok {
+		return p.Priority()
+	}
+	return 0
+}
+
+// priorityFromPrefix returns the priority of the first rule matching the key
+func priorityFromPrefix(rules []PriorityRule, key string) int {
+	for _, rule := range rules {
+		if strings.HasPrefix(key, rule.Prefix) {
+			return rule.Priority
+		}
+	}
+	return 0
+}
+
+// priorityFromMetadata reads the x-amz-meta-priority metadata, clamped to
+// max
+func priorityFromMetadata(metadata map[string]*string, max int) (int, bool) {
+	value, ok := metadata["Priority"]
+	if !ok || value == nil {
+		return 0, false
+	}
+	priority, err := strconv.Atoi(strings.TrimSpace(*value))
+	if err != nil {
+		return 0, false
+	}
+	if priority > max {
+		priority = max
+	}
+	return priority, true
+}
+
+/*
+The stages of the pipeline are connected by priority queues instead of
+channels, each worker picks the element with the highest priority, elements
+with the same priority are picked in the order they were pushed.
+
+As the channels they have a capacity, so a stage slower than the previous one
+slows down the whole pipeline.
+*/
+
+type queueItem struct {
+	value    interface{}
+	priority int
+	sequence uint64
+}
+
+type queueItems []queueItem
+
+func (q queueItems) Len() int { return len(q) }
+func (q queueItems) Less(i, j int) bool {
+	if q[i].priority != q[j].priority {
+		return q[i].priority > q[j].priority
+	}
+	return q[i].sequence < q[j].sequence
+}
+func (q queueItems) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *queueItems) Push(x interface{}) { *q = append(*q, x.(queueItem)) }
+func (q *queueItems) Pop() interface{} {
+	old := *q
+	n := len(old)
+	x := old[n-1]
+	*q = old[:n-1]
+	return x
+}
+
+type priorityQueue struct {
+	mutex    sync.Mutex
+	notEmpty *sync.Cond
+	notFull  *sync.Cond
+	items    queueItems
+	capacity int
+	counter  uint64
+	closed   bool
+}
+
+func newPriorityQueue(capacity int) *priorityQueue {
+	q := &priorityQueue{capacity: capacity}
+	q.notEmpty = sync.NewCond(&q.mutex)
+	q.notFull = sync.NewCond(&q.mutex)
+	return q
+}
+
+// Push blocks while the queue is full
+func (q *priorityQueue) Push(value interface{}) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for len(q.items) >= q.capacity {
+		q.notFull.Wait()
+	}
+	heap.Push(&q.items, queueItem{value: value, priority: priorityOf(value), sequence: q.counter})
+	q.counter++
+	q.notEmpty.Signal()
+}
+
+// Pop blocks while the queue is empty, it returns false once the queue is
+// closed and empty
+func (q *priorityQueue) Pop() (interface{}, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for len(q.items) == 0 {
+		if q.closed {
+			return nil, false
+		}
+		q.notEmpty.Wait()
+	}
+	item := heap.Pop(&q.items).(queueItem)
+	q.notFull.Signal()
+	return item.value, true
+}
+
+// Close wakes up all the workers waiting, they will drain the queue
+func (q *priorityQueue) Close() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.closed = true
+	q.notEmpty.Broadcast()
+}
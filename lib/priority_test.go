@@ -0,0 +1,131 @@
+package lib
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+func TestPriorityFromPrefix(t *testing.T) {
+	rules := []PriorityRule{
+		{Prefix: "urgent/", Priority: 10},
+		{Prefix: "urgent/slow/", Priority: 20},
+		{Prefix: "bulk/", Priority: -5},
+	}
+	tests := map[string]int{
+		"urgent/a.tar":      10,
+		"urgent/slow/a.tar": 10,
+		"bulk/a.tar":        -5,
+		"other/a.tar":       0,
+	}
+	for key, expected := range tests {
+		if priority := priorityFromPrefix(rules, key); priority != expected {
+			t.Errorf("%s: expected %d, got %d", key, expected, priority)
+		}
+	}
+}
+
+func TestPriorityFromMetadata(t *testing.T) {
+	tests := []struct {
+		value    *string
+		max      int
+		priority int
+		ok       bool
+	}{
+		{nil, 0, 0, false},
+		{aws.String("nope"), 0, 0, false},
+		{aws.String(" -3 "), 0, -3, true},
+		{aws.String("5"), 0, 0, true},
+		{aws.String("5"), 10, 5, true},
+		{aws.String("1000000"), 10, 10, true},
+	}
+	for _, test := range tests {
+		metadata := map[string]*string{}
+		if test.value != nil {
+			metadata["Priority"] = test.value
+		}
+		priority, ok := priorityFromMetadata(metadata, test.max)
+		if priority != test.priority || ok != test.ok {
+			t.Errorf("%v max %d: expected %d %t, got %d %t",
+				aws.StringValue(test.value), test.max, test.priority, test.ok, priority, ok)
+		}
+	}
+}
+
+type prioritized struct {
+	name     string
+	priority int
+}
+
+func (p prioritized) Priority() int {
+	return p.priority
+}
+
+func TestPriorityQueue(t *testing.T) {
+	q := newPriorityQueue(10)
+	for _, item := range []interface{}{
+		prioritized{"a", 0}, prioritized{"b", 5}, "no priority", prioritized{"c", 5}, prioritized{"d", -1},
+	} {
+		q.Push(item)
+	}
+	q.Close()
+
+	expected := []string{"b", "c", "a", "no priority", "d"}
+	for _, name := range expected {
+		item, ok := q.Pop()
+		if !ok {
+			t.Fatalf("the queue is closed before %s", name)
+		}
+		got, isPrioritized := item.(prioritized)
+		if isPrioritized && got.name != name || !isPrioritized && item != name {
+			t.Errorf("expected %s, got %v", name, item)
+		}
+	}
+	if item, ok := q.Pop(); ok {
+		t.Errorf("expected the queue to be closed, got %v", item)
+	}
+}
+
+func TestPriorityFromHead(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		metadata string
+		priority int
+		result   string
+	}{
+		{"prefix rule", http.StatusOK, "", 3, "S3Object"},
+		{"lower metadata", http.StatusOK, "-1", -1, "S3Object"},
+		{"higher metadata clamped", http.StatusOK, "99", 7, "S3Object"},
+		{"endpoint error", http.StatusInternalServerError, "", 0, "ErrorInReadingMetadata"},
+		{"deleted object", http.StatusNotFound, "", 0, "ErrorInReadingMetadata"},
+	}
+	for _, test := range tests {
+		sess, stop := fakeS3(t, func(w http.ResponseWriter, r *http.Request) {
+			if test.metadata != "" {
+				w.Header().Set("X-Amz-Meta-Priority", test.metadata)
+			}
+			w.WriteHeader(test.status)
+		})
+		s3obj := S3Object{bucket: "data", key: "a.tar", session: sess, priority: 3,
+			config: &BucketConfiguration{MaxMetadataPriority: 7}}
+		remote := s3obj.MakeS3RemoteFile()
+		stop()
+
+		switch r := remote.(type) {
+		case S3Object:
+			if test.result != "S3Object" {
+				t.Errorf("%s: expected %s, got the object", test.name, test.result)
+			} else if r.Priority() != test.priority {
+				t.Errorf("%s: expected the priority %d, got %d", test.name, test.priority, r.Priority())
+			}
+		case ErrorInReadingMetadata:
+			if test.result != "ErrorInReadingMetadata" {
+				t.Errorf("%s: unexpected error reading the metadata", test.name)
+			}
+		default:
+			t.Errorf("%s: unexpected %T", test.name, remote)
+		}
+	}
+}
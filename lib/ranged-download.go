@@ -0,0 +1,380 @@
+package lib
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+/*
+Large objects are downloaded with ranged GETs, several parts at the same time.
+
+The download of an object goes into the spool directory, in a file whose name
+depends only on the bucket, the key and the ETag of the object, next to it the
+journal <file>.parts records the parts already completed.
+If the download fails, or the daemon crashes, the next attempt on the same
+version of the object downloads only the parts that are missing.
+Each part is tried partAttempts times, if a part still fails the parts
+completed are kept and the next listing resumes the download. Only the errors
+that another attempt cannot fix, like a missing object or a denied access, are
+a FAILURE of the object.
+*/
+
+const (
+	DefaultDownloadPartSize    = 64 * 1024 * 1024
+	DefaultDownloadConcurrency = 4
+
+	// prefix of the files of the ranged downloads, they are kept by the
+	// sweep of the spool directory so that they can be resumed
+	partialPrefix = "s3temp-partial-"
+	// the partial downloads not touched for longer are removed by the sweep
+	partialRetention = 7 * 24 * time.Hour
+
+	// attempts for each part before giving up on the download
+	partAttempts = 3
+)
+
+// the attempts on a part wait partRetryDelay more than the previous one
+var partRetryDelay = time.Second
+
+// partials currently in use, two downloads of the same object must not write
+// the same file at the same time
+var partialsInUse = struct {
+	sync.Mutex
+	paths map[string]bool
+}{paths: map[string]bool{}}
+
+// header of the journal, if it does not match the object the partial
+// download is discarded
+type partialHeader struct {
+	Bucket   string `json:"bucket"`
+	Key      string `json:"key"`
+	ETag     string `json:"etag"`
+	Size     int64  `json:"size"`
+	PartSize int64  `json:"part-size"`
+}
+
+type RangedDownload struct {
+	session     *session.Session
+	header      partialHeader
+	concurrency int
+
+	path      string
+	file      *os.File
+	journal   *os.File
+	journalMu sync.Mutex
+	completed map[int64]bool
+}
+
+func partialPath(dir, bucket, key, etag string) string {
+	id := sha256.Sum256([]byte(bucket + "/" + key + "@" + etag))
+	return filepath.Join(dir, fmt.Sprintf("%s%x", partialPrefix, id[:16]))
+}
+
+// OpenRangedDownload prepares the download of the object into the spool
+// directory, it picks up a partial download of the same object if there is
+// one
+func OpenRangedDownload(s3obj S3Object) (*RangedDownload, error) {
+	partSize := s3obj.config.DownloadPartSize
+	if partSize <= 0 {
+		partSize = DefaultDownloadPartSize
+	}
+	concurrency := s3obj.config.DownloadConcurrency
+	if concurrency <= 0 {
+		concurrency = DefaultDownloadConcurrency
+	}
+	d := &RangedDownload{
+		session: s3obj.session,
+		header: partialHeader{
+			Bucket:   s3obj.bucket,
+			Key:      s3obj.key,
+			ETag:     s3obj.etag,
+			Size:     s3obj.size,
+			PartSize: partSize,
+		},
+		concurrency: concurrency,
+		path:        partialPath(s3obj.config.SpoolDir, s3obj.bucket, s3obj.key, s3obj.etag),
+		completed:   map[int64]bool{},
+	}
+
+	partialsInUse.Lock()
+	defer partialsInUse.Unlock()
+	if partialsInUse.paths[d.path] {
+		return nil, fmt.Errorf("The object is already being downloaded into %s", d.path)
+	}
+
+	if err := d.open(); err != nil {
+		d.close()
+		return nil, err
+	}
+	partialsInUse.paths[d.path] = true
+	return d, nil
+}
+
+func (d *RangedDownload) journalPath() string {
+	return d.path + ".parts"
+}
+
+func (d *RangedDownload) open() (err error) {
+	if !d.readJournal() {
+		os.Remove(d.journalPath())
+		os.Remove(d.path)
+		d.completed = map[int64]bool{}
+	}
+
+	d.file, err = os.OpenFile(d.path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return
+	}
+	if err = d.file.Truncate(d.header.Size); err != nil {
+		return
+	}
+
+	d.journal, err = os.OpenFile(d.journalPath(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return
+	}
+	if len(d.completed) == 0 {
+		if err = d.journal.Truncate(0); err != nil {
+			return
+		}
+		header, _ := json.Marshal(d.header)
+		_, err = d.journal.Write(append(header, '\n'))
+	}
+	return
+}
+
+// readJournal loads the parts already downloaded, it returns false if there
+// is no usable journal for this object
+func (d *RangedDownload) readJournal() bool {
+	f, err := os.Open(d.journalPath())
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	if !scanner.Scan() {
+		return false
+	}
+	var header partialHeader
+	if err := json.Unmarshal(scanner.Bytes(), &header); err != nil || header != d.header {
+		return false
+	}
+	for scanner.Scan() {
+		// a line truncated by a crash is simply ignored, that part is
+		// downloaded again
+		part, err := strconv.ParseInt(strings.TrimSpace(scanner.Text()), 10, 64)
+		if err != nil || part < 0 || part >= d.parts() {
+			continue
+		}
+		d.completed[part] = true
+	}
+	return true
+}
+
+func (d *RangedDownload) parts() int64 {
+	return (d.header.Size + d.header.PartSize - 1) / d.header.PartSize
+}
+
+func (d *RangedDownload) partRange(part int64) (start, end int64) {
+	start = part * d.header.PartSize
+	end = start + d.header.PartSize - 1
+	if end >= d.header.Size {
+		end = d.header.Size - 1
+	}
+	return
+}
+
+// Remaining is the number of bytes still to download
+func (d *RangedDownload) Remaining() int64 {
+	remaining := d.header.Size
+	for part := range d.completed {
+		start, end := d.partRange(part)
+		remaining -= end - start + 1
+	}
+	return remaining
+}
+
+// Download fetches all the missing parts, on error the parts already
+// completed are kept for the next attempt
+func (d *RangedDownload) Download() error {
+	missing := make(chan int64)
+	results := make(chan error, d.concurrency)
+
+	var wg sync.WaitGroup
+	for i := 0; i < d.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var failed error
+			for part := range missing {
+				if failed != nil {
+					continue
+				}
+				failed = d.downloadPart(part)
+			}
+			results <- failed
+		}()
+	}
+	for part := int64(0); part < d.parts(); part++ {
+		if !d.completed[part] {
+			missing <- part
+		}
+	}
+	close(missing)
+	wg.Wait()
+	close(results)
+
+	for err := range results {
+		if err != nil {
+			return err
+		}
+	}
+	if err := d.file.Sync(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (d *RangedDownload) downloadPart(part int64) (err error) {
+	for attempt := 1; attempt <= partAttempts; attempt++ {
+		if err = d.fetchPart(part); err == nil {
+			return d.markCompleted(part)
+		}
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "PreconditionFailed" {
+			// the object changed, retrying is useless
+			return err
+		}
+		if isPermanentDownloadError(err) {
+			return err
+		}
+		time.Sleep(time.Duration(attempt) * partRetryDelay)
+	}
+	start, end := d.partRange(part)
+	return fmt.Errorf("Error in downloading the bytes %d-%d: %s", start, end, err)
+}
+
+// isPermanentDownloadError is true for the errors that another attempt on the
+// same object cannot fix
+func isPermanentDownloadError(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	if !ok {
+		return false
+	}
+	switch aerr.Code() {
+	case "AccessDenied", "Forbidden", "NotFound", s3.ErrCodeNoSuchKey:
+		return true
+	}
+	return false
+}
+
+func (d *RangedDownload) fetchPart(part int64) error {
+	start, end := d.partRange(part)
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(d.header.Bucket),
+		Key:    aws.String(d.header.Key),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", start, end)),
+	}
+	if d.header.ETag != "" {
+		// if the object changes under us the parts would be mixed
+		input.IfMatch = aws.String(d.header.ETag)
+	}
+	object, err := s3.New(d.session).GetObject(input)
+	if err != nil {
+		return err
+	}
+	defer object.Body.Close()
+
+	n, err := io.Copy(&offsetWriter{d.file, start}, object.Body)
+	if err != nil {
+		return err
+	}
+	if n != end-start+1 {
+		return fmt.Errorf("Received %d bytes instead of %d", n, end-start+1)
+	}
+	return nil
+}
+
+type offsetWriter struct {
+	file   *os.File
+	offset int64
+}
+
+func (w *offsetWriter) Write(p []byte) (int, error) {
+	n, err := w.file.WriteAt(p, w.offset)
+	w.offset += int64(n)
+	return n, err
+}
+
+// markCompleted records the part in the journal, only once its content is
+// on disk
+func (d *RangedDownload) markCompleted(part int64) error {
+	if err := d.file.Sync(); err != nil {
+		return err
+	}
+	d.journalMu.Lock()
+	defer d.journalMu.Unlock()
+	_, err := fmt.Fprintf(d.journal, "%d\n", part)
+	return err
+}
+
+func (d *RangedDownload) close() {
+	if d.file != nil {
+		d.file.Close()
+		d.file = nil
+	}
+	if d.journal != nil {
+		d.journal.Close()
+		d.journal = nil
+	}
+}
+
+// Release closes the download, leaving the partial files for a later
+// attempt
+func (d *RangedDownload) Release() {
+	d.close()
+	partialsInUse.Lock()
+	delete(partialsInUse.paths, d.path)
+	partialsInUse.Unlock()
+}
+
+// Complete closes the download and moves the downloaded file to a new
+// temporary file of the spool directory, so that a later download of the
+// same object cannot touch it
+func (d *RangedDownload) Complete() (string, error) {
+	defer d.Release()
+	d.close()
+
+	f, err := CreateSpoolFile(filepath.Dir(d.path), "s3temp")
+	if err != nil {
+		return "", err
+	}
+	f.Close()
+	if err = os.Rename(d.path, f.Name()); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	os.Remove(d.journalPath())
+	return f.Name(), nil
+}
+
+// Discard closes the download and removes all its files
+func (d *RangedDownload) Discard() {
+	d.Release()
+	os.Remove(d.journalPath())
+	os.Remove(d.path)
+}
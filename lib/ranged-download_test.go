@@ -0,0 +1,284 @@
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// fakeObject serves the ranged GETs of a single object
+type fakeObject struct {
+	mutex   sync.Mutex
+	content []byte
+	etag    string
+	// the ranges, as "start-end", that fail and the ones requested
+	failing   map[string]bool
+	requested []string
+	// status and code of the error of every range, if denied is not zero
+	denied int
+	code   string
+}
+
+func (o *fakeObject) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPut {
+		// status files
+		w.Header().Set("ETag", `"status"`)
+		return
+	}
+	var start, end int
+	if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end); err != nil {
+		// like the sidecar of the checksum
+		s3Error(w, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	rng := fmt.Sprintf("%d-%d", start, end)
+	o.requested = append(o.requested, rng)
+	if r.Header.Get("If-Match") != o.etag {
+		s3Error(w, http.StatusPreconditionFailed, "PreconditionFailed")
+		return
+	}
+	if o.denied != 0 {
+		s3Error(w, o.denied, o.code)
+		return
+	}
+	if o.failing[rng] {
+		s3Error(w, http.StatusInternalServerError, "InternalError")
+		return
+	}
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(o.content)))
+	w.WriteHeader(http.StatusPartialContent)
+	w.Write(o.content[start : end+1])
+}
+
+func (o *fakeObject) reset(failing ...string) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.failing = map[string]bool{}
+	for _, rng := range failing {
+		o.failing[rng] = true
+	}
+	o.requested = nil
+	o.denied = 0
+}
+
+func newRangedTest(t *testing.T) (s3obj S3Object, object *fakeObject, cleanup func()) {
+	spool, err := ioutil.TempDir("", "portals-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	object = &fakeObject{content: []byte("0123456789"), etag: "etag"}
+	sess, stop := fakeS3(t, object.ServeHTTP)
+	delay := partRetryDelay
+	partRetryDelay = 0
+
+	s3obj = S3Object{
+		bucket:       "data",
+		statusBucket: "status",
+		key:          "object.tar",
+		session:      sess,
+		etag:         "etag",
+		size:         int64(len(object.content)),
+		config: &BucketConfiguration{
+			SpoolDir:             spool,
+			DownloadPartSize:     4,
+			DownloadConcurrency:  2,
+			SkipETagVerification: true,
+		},
+	}
+	return s3obj, object, func() {
+		partRetryDelay = delay
+		stop()
+		os.RemoveAll(spool)
+	}
+}
+
+func TestPartRange(t *testing.T) {
+	d := &RangedDownload{header: partialHeader{Size: 10, PartSize: 4}}
+	if d.parts() != 3 {
+		t.Errorf("expected 3 parts, got %d", d.parts())
+	}
+	expected := [][2]int64{{0, 3}, {4, 7}, {8, 9}}
+	for part, rng := range expected {
+		start, end := d.partRange(int64(part))
+		if start != rng[0] || end != rng[1] {
+			t.Errorf("part %d: expected %v, got %d-%d", part, rng, start, end)
+		}
+	}
+	d.completed = map[int64]bool{2: true}
+	if d.Remaining() != 8 {
+		t.Errorf("expected 8 bytes remaining, got %d", d.Remaining())
+	}
+}
+
+func TestOffsetWriter(t *testing.T) {
+	f, err := ioutil.TempFile("", "offset")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	f.Truncate(8)
+	w := &offsetWriter{f, 4}
+	w.Write([]byte("ab"))
+	w.Write([]byte("cd"))
+	content, _ := ioutil.ReadFile(f.Name())
+	if !bytes.Equal(content, []byte("\x00\x00\x00\x00abcd")) {
+		t.Errorf("unexpected content %q", content)
+	}
+}
+
+func TestRangedDownloadResume(t *testing.T) {
+	s3obj, object, cleanup := newRangedTest(t)
+	defer cleanup()
+
+	// the middle part fails, the others are kept
+	object.reset("4-7")
+	d, err := OpenRangedDownload(s3obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Download(); err == nil {
+		t.Fatalf("expected the download to fail")
+	}
+	d.Release()
+
+	object.reset()
+	d, err = OpenRangedDownload(s3obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Remaining() != 4 {
+		t.Errorf("expected only the failed part to be missing, %d bytes remaining", d.Remaining())
+	}
+	if err := d.Download(); err != nil {
+		t.Fatal(err)
+	}
+	if len(object.requested) != 1 || object.requested[0] != "4-7" {
+		t.Errorf("expected only the failed part to be downloaded, got %v", object.requested)
+	}
+	path, err := d.Complete()
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ := ioutil.ReadFile(path)
+	if !bytes.Equal(content, object.content) {
+		t.Errorf("wrong content %q", content)
+	}
+	files, _ := ioutil.ReadDir(s3obj.config.SpoolDir)
+	if len(files) != 1 || filepath.Join(s3obj.config.SpoolDir, files[0].Name()) != path {
+		t.Errorf("only the downloaded file should be left in the spool, got %d files", len(files))
+	}
+}
+
+func TestRangedDownloadOtherVersion(t *testing.T) {
+	s3obj, object, cleanup := newRangedTest(t)
+	defer cleanup()
+
+	object.reset("4-7")
+	d, err := OpenRangedDownload(s3obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenRangedDownload(s3obj); err == nil {
+		t.Errorf("the same object cannot be downloaded twice at the same time")
+	}
+	d.Download()
+	d.Release()
+
+	// a new version of the object does not reuse the parts of the old one
+	s3obj.size = 12
+	d, err = OpenRangedDownload(s3obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Discard()
+	if d.Remaining() != 12 {
+		t.Errorf("expected the whole object to be downloaded, %d bytes remaining", d.Remaining())
+	}
+}
+
+func TestDownloadFailure(t *testing.T) {
+	s3obj, object, cleanup := newRangedTest(t)
+	defer cleanup()
+
+	// a part failing at every attempt keeps the other parts for the next
+	// listing, it is not a FAILURE
+	object.reset("8-9")
+	result := s3obj.downloadToFile()
+	if _, ok := result.(ErrorInDownloadingFile); !ok {
+		t.Fatalf("expected the download to be tried again, got %T", result)
+	}
+	attempts := 0
+	for _, rng := range object.requested {
+		if rng == "8-9" {
+			attempts++
+		}
+	}
+	if attempts != partAttempts {
+		t.Errorf("expected %d attempts on the failing part, got %d", partAttempts, attempts)
+	}
+	files, _ := ioutil.ReadDir(s3obj.config.SpoolDir)
+	if len(files) != 2 {
+		t.Errorf("expected the partial download and its journal in the spool, got %d files", len(files))
+	}
+
+	object.reset()
+	result = s3obj.downloadToFile()
+	downloaded, ok := result.(S3DownloadedFile)
+	if !ok {
+		t.Fatalf("expected the object downloaded, got %T", result)
+	}
+	defer os.Remove(downloaded.tempPath)
+	if len(object.requested) != 1 || object.requested[0] != "8-9" {
+		t.Errorf("expected only the failed part to be downloaded, got %v", object.requested)
+	}
+	content, _ := ioutil.ReadFile(downloaded.tempPath)
+	if !bytes.Equal(content, object.content) {
+		t.Errorf("wrong content %q", content)
+	}
+}
+
+func TestDownloadPermanentFailure(t *testing.T) {
+	tests := []struct {
+		status int
+		code   string
+	}{
+		{http.StatusForbidden, "AccessDenied"},
+		{http.StatusNotFound, "NoSuchKey"},
+	}
+	for _, test := range tests {
+		s3obj, object, cleanup := newRangedTest(t)
+		object.reset()
+		object.denied = test.status
+		object.code = test.code
+
+		result := s3obj.downloadToFile()
+		failure, ok := result.(ErrorWithStatus)
+		if !ok {
+			t.Errorf("%s: expected the FAILURE of the object, got %T", test.code, result)
+			cleanup()
+			continue
+		}
+		requested := map[string]bool{}
+		for _, rng := range object.requested {
+			if requested[rng] {
+				t.Errorf("%s: the part %s is tried again", test.code, rng)
+			}
+			requested[rng] = true
+		}
+		files, _ := ioutil.ReadDir(s3obj.config.SpoolDir)
+		if len(files) != 0 {
+			t.Errorf("%s: the partial download is left in the spool: %d files", test.code, len(files))
+		}
+		failure.Cleanup()
+		cleanup()
+	}
+}
@@ -0,0 +1,77 @@
+package lib
+
+import (
+	"fmt"
+
+	"github.com/cvmfs/portals/log"
+)
+
+/*
+The configuration holds the keys of the buckets, it must never be printed as
+is: Config and BucketConfiguration print themselves with the secrets masked,
+whatever the verb used with fmt.
+*/
+
+// types without methods, so that fmt prints their fields instead of calling
+// String and GoString again
+type plainConfig Config
+type plainBucketConfiguration BucketConfiguration
+
+// maskAccessKey keeps only the first characters of the access key, enough to
+// tell which key is used
+func maskAccessKey(key string) string {
+	if len(key) <= 4 {
+		return redactSecret(key)
+	}
+	return key[:4] + "..."
+}
+
+func redactSecret(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return log.Redacted
+}
+
+// Redacted returns a copy of the configuration without secrets
+func (bc BucketConfiguration) Redacted() BucketConfiguration {
+	bc.AccessKey = maskAccessKey(bc.AccessKey)
+	bc.SecretKey = redactSecret(bc.SecretKey)
+	return bc
+}
+
+func (bc BucketConfiguration) String() string {
+	return fmt.Sprintf("%+v", plainBucketConfiguration(bc.Redacted()))
+}
+
+func (bc BucketConfiguration) GoString() string {
+	return fmt.Sprintf("%#v", plainBucketConfiguration(bc.Redacted()))
+}
+
+// Redacted returns a copy of the configuration without secrets
+func (config Config) Redacted() Config {
+	credentials := make([]BucketConfiguration, len(config.Credentials))
+	for i, bc := range config.Credentials {
+		credentials[i] = bc.Redacted()
+	}
+	config.Credentials = credentials
+	config.Webhook.Token = redactSecret(config.Webhook.Token)
+	return config
+}
+
+func (config Config) String() string {
+	return fmt.Sprintf("%+v", plainConfig(config.Redacted()))
+}
+
+func (config Config) GoString() string {
+	return fmt.Sprintf("%#v", plainConfig(config.Redacted()))
+}
+
+// RegisterSecrets keeps the secrets of the configuration out of the logs, the
+// commands call it once the configuration is parsed
+func (config Config) RegisterSecrets() {
+	log.RegisterSecret(config.Webhook.Token)
+	for _, bc := range config.Credentials {
+		log.RegisterSecret(bc.SecretKey)
+	}
+}
@@ -0,0 +1,181 @@
+package lib
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cvmfs/portals/cvmfs"
+	"github.com/cvmfs/portals/log"
+)
+
+// RollbackPlan describes what happens to the repository when we revert an
+// ingestion made by the portal
+type RollbackPlan struct {
+	CVMFSRepo string
+
+	// The ingestion we want to revert
+	Target StatusReport
+
+	// The tag the repository will be rolled back to, it is the one just
+	// before the tag of the target
+	RollbackTo cvmfs.Tag
+
+	// All the tags removed by the rollback, sorted by revision, the tag of
+	// the target included
+	RemovedTags []cvmfs.Tag
+
+	// The ingestions of the portal undone by the rollback, sorted by
+	// revision, the target included
+	Undone []StatusReport
+}
+
+// ListIngestions reads all the SUCCESS status files in the status bucket
+func ListIngestions(status S3Bucket) ([]StatusReport, error) {
+	objects, err := status.ListAllObjects("")
+	if err != nil {
+		return nil, err
+	}
+	reports := []StatusReport{}
+	for _, object := range objects {
+		if !strings.HasSuffix(*object.Key, ".SUCCESS") {
+			continue
+		}
+		content, err := status.GetObjectContent(*object.Key)
+		if err != nil {
+			return nil, err
+		}
+		report, err := ParseStatusReport(content)
+		if err != nil || report.Tag == "" {
+			// status files written before the ingestions were tagged
+			l := log.Decorate(map[string]string{"file": *object.Key})
+			l(log.LogE(err)).Warning("Skipping SUCCESS status without a tag")
+			continue
+		}
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
+
+// PlanRollback finds the ingestion of the key and computes what rolling it
+// back implies, if hash is empty the most recent ingestion of the key is
+// used
+func PlanRollback(couple S3BucketCouple, CVMFSRepo, key, hash string) (plan RollbackPlan, err error) {
+	ingestions, err := ListIngestions(couple.Status)
+	if err != nil {
+		err = fmt.Errorf("Error in listing the ingestions in the status bucket: %s", err)
+		return
+	}
+	tags, err := cvmfs.ListTags(CVMFSRepo)
+	if err != nil {
+		err = fmt.Errorf("Error in listing the tags of the repository: %s", err)
+		return
+	}
+	return planRollback(ingestions, tags, CVMFSRepo, key, hash)
+}
+
+// planRollback computes the plan from the ingestions in the status bucket and
+// the tags of the repository
+func planRollback(ingestions []StatusReport, tags []cvmfs.Tag, CVMFSRepo, key, hash string) (plan RollbackPlan, err error) {
+	plan.CVMFSRepo = CVMFSRepo
+
+	sort.Slice(tags, func(i, j int) bool { return tags[i].Revision < tags[j].Revision })
+	tagsByName := make(map[string]cvmfs.Tag)
+	for _, tag := range tags {
+		tagsByName[tag.Name] = tag
+	}
+
+	// the revision in the status report is missing when the tag could not
+	// be read after the ingestion, the one of the tag is always right
+	found := false
+	for _, ingestion := range ingestions {
+		if ingestion.Key != key || (hash != "" && ingestion.Hash != hash) {
+			continue
+		}
+		tag, ok := tagsByName[ingestion.Tag]
+		if !ok {
+			l := log.Decorate(map[string]string{"key": ingestion.Key, "hash": ingestion.Hash, "tag": ingestion.Tag})
+			l(log.Log()).Info("Skipping the ingestion, its tag is not in the repository anymore, it was already rolled back")
+			continue
+		}
+		if !found || tag.Revision > tagsByName[plan.Target.Tag].Revision {
+			plan.Target = ingestion
+			found = true
+		}
+	}
+	if !found {
+		err = fmt.Errorf("No ingestion of the key %s still present in the repository %s", key, CVMFSRepo)
+		return
+	}
+
+	target := tagsByName[plan.Target.Tag]
+	foundPrevious := false
+	for _, tag := range tags {
+		if isAutomaticTag(tag) {
+			continue
+		}
+		if tag.Revision < target.Revision {
+			plan.RollbackTo = tag
+			foundPrevious = true
+		} else {
+			plan.RemovedTags = append(plan.RemovedTags, tag)
+		}
+	}
+	if !foundPrevious {
+		err = fmt.Errorf("No tag before %s, impossible to rollback", target.Name)
+		return
+	}
+
+	for _, tag := range plan.RemovedTags {
+		for _, ingestion := range ingestions {
+			if ingestion.Tag == tag.Name {
+				plan.Undone = append(plan.Undone, ingestion)
+			}
+		}
+	}
+	return
+}
+
+// trunk and trunk-previous are maintained by CVMFS itself
+func isAutomaticTag(tag cvmfs.Tag) bool {
+	return tag.Name == "trunk" || tag.Name == "trunk-previous"
+}
+
+func (plan RollbackPlan) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Repository:  %s\n", plan.CVMFSRepo)
+	fmt.Fprintf(&b, "Ingestion:   %s (%s) tag %s revision %d\n",
+		plan.Target.Key, plan.Target.Hash, plan.Target.Tag, plan.Target.Revision)
+	fmt.Fprintf(&b, "Rollback to: tag %s revision %d\n",
+		plan.RollbackTo.Name, plan.RollbackTo.Revision)
+	fmt.Fprintf(&b, "Tags removed:\n")
+	for _, tag := range plan.RemovedTags {
+		fmt.Fprintf(&b, "  %s revision %d\n", tag.Name, tag.Revision)
+	}
+	fmt.Fprintf(&b, "Ingestions undone:\n")
+	for _, ingestion := range plan.Undone {
+		fmt.Fprintf(&b, "  %s (%s) revision %d\n", ingestion.Key, ingestion.Hash, ingestion.Revision)
+	}
+	return b.String()
+}
+
+// Execute rolls back the repository and writes a ROLLEDBACK status for each
+// ingestion undone
+func (plan RollbackPlan) Execute(couple S3BucketCouple) error {
+	err := cvmfs.Rollback(plan.CVMFSRepo, plan.RollbackTo.Name)
+	if err != nil {
+		return err
+	}
+
+	for _, ingestion := range plan.Undone {
+		report := ingestion
+		report.Status = "ROLLEDBACK"
+		report.Timestamp = time.Now().Format(time.RFC3339)
+		err := UploadStatusReport(&couple.Status.Session, couple.Status.BucketName, report)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
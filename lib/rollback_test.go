@@ -0,0 +1,124 @@
+package lib
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/cvmfs/portals/cvmfs"
+)
+
+func TestPlanRollback(t *testing.T) {
+	tags := []cvmfs.Tag{
+		{Name: "portal-c", Revision: 5},
+		{Name: "trunk", Revision: 5},
+		{Name: "portal-a", Revision: 2},
+		{Name: "trunk-previous", Revision: 4},
+		{Name: "portal-b", Revision: 4},
+		{Name: "initial", Revision: 1},
+	}
+	ingestions := []StatusReport{
+		{Key: "a.tar", Hash: "h1", Tag: "portal-a", Revision: 2},
+		{Key: "b.tar", Hash: "h2", Tag: "portal-b", Revision: 4},
+		{Key: "a.tar", Hash: "h3", Tag: "portal-c", Revision: 5},
+		// already rolled back, its tag is not in the repository anymore
+		{Key: "b.tar", Hash: "h0", Tag: "portal-gone", Revision: 3},
+	}
+
+	tests := []struct {
+		key, hash  string
+		target     string
+		rollbackTo string
+		removed    []string
+		undone     []string
+		fails      bool
+	}{
+		{key: "a.tar", target: "portal-c", rollbackTo: "portal-b",
+			removed: []string{"portal-c"}, undone: []string{"h3"}},
+		{key: "a.tar", hash: "h1", target: "portal-a", rollbackTo: "initial",
+			removed: []string{"portal-a", "portal-b", "portal-c"}, undone: []string{"h1", "h2", "h3"}},
+		{key: "b.tar", target: "portal-b", rollbackTo: "portal-a",
+			removed: []string{"portal-b", "portal-c"}, undone: []string{"h2", "h3"}},
+		{key: "b.tar", hash: "h0", fails: true},
+		{key: "missing.tar", fails: true},
+	}
+	for _, test := range tests {
+		plan, err := planRollback(ingestions, append([]cvmfs.Tag{}, tags...), "repo.example.org", test.key, test.hash)
+		if test.fails {
+			if err == nil {
+				t.Errorf("Rollback of %s %s did not fail", test.key, test.hash)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Rollback of %s %s failed: %s", test.key, test.hash, err)
+			continue
+		}
+		removed := []string{}
+		for _, tag := range plan.RemovedTags {
+			removed = append(removed, tag.Name)
+		}
+		undone := []string{}
+		for _, ingestion := range plan.Undone {
+			undone = append(undone, ingestion.Hash)
+		}
+		if plan.Target.Tag != test.target || plan.RollbackTo.Name != test.rollbackTo ||
+			!reflect.DeepEqual(removed, test.removed) || !reflect.DeepEqual(undone, test.undone) {
+			t.Errorf("Rollback of %s %s: target %s, to %s, removed %v, undone %v; expected %s, %s, %v, %v",
+				test.key, test.hash, plan.Target.Tag, plan.RollbackTo.Name, removed, undone,
+				test.target, test.rollbackTo, test.removed, test.undone)
+		}
+	}
+}
+
+func TestRollbackTargetByTagRevision(t *testing.T) {
+	tags := []cvmfs.Tag{
+		{Name: "initial", Revision: 1},
+		{Name: "portal-a", Revision: 2},
+		{Name: "portal-b", Revision: 3},
+	}
+	ingestions := []StatusReport{
+		// the tag of the newer ingestion could not be read, its status
+		// report has no revision
+		{Key: "a.tar", Hash: "h2", Tag: "portal-b"},
+		{Key: "a.tar", Hash: "h1", Tag: "portal-a", Revision: 2},
+	}
+	plan, err := planRollback(ingestions, tags, "repo.example.org", "a.tar", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.Target.Hash != "h2" || plan.RollbackTo.Name != "portal-a" {
+		t.Errorf("expected to roll back h2 to portal-a, got %s to %s", plan.Target.Hash, plan.RollbackTo.Name)
+	}
+}
+
+func TestRollbackWithoutPreviousTag(t *testing.T) {
+	tags := []cvmfs.Tag{{Name: "trunk", Revision: 2}, {Name: "portal-a", Revision: 2}}
+	ingestions := []StatusReport{{Key: "a.tar", Hash: "h1", Tag: "portal-a", Revision: 2}}
+	if _, err := planRollback(ingestions, tags, "repo.example.org", "a.tar", ""); err == nil {
+		t.Errorf("Rollback of the first ingestion did not fail")
+	}
+}
+
+func TestParseStatusReport(t *testing.T) {
+	tests := []struct {
+		content  string
+		expected StatusReport
+		fails    bool
+	}{
+		{content: `{"status":"SUCCESS","key":"a.tar","hash":"h1","tag":"portal-a","revision":3,"root-hash":"abc"}`,
+			expected: StatusReport{Status: "SUCCESS", Key: "a.tar", Hash: "h1", Tag: "portal-a", Revision: 3, RootHash: "abc"}},
+		{content: `2019-01-01 10:00:00`, fails: true},
+	}
+	for _, test := range tests {
+		report, err := ParseStatusReport([]byte(test.content))
+		if test.fails {
+			if err == nil {
+				t.Errorf("ParseStatusReport(%q) did not fail", test.content)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(report, test.expected) {
+			t.Errorf("ParseStatusReport(%q) = %+v, %v, expected %+v", test.content, report, err, test.expected)
+		}
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"fmt"
 	"io/ioutil"
-	"os"
 	"time"
 
 	"github.com/cvmfs/portals/log"
@@ -46,13 +45,7 @@ type S3Bucket struct {
 	Session    session.Session
 }
 
-func NewS3Bucket(bucketName, region, hostURL, accessKey, secretKey string) (bucket S3Bucket, err error) {
-	S3CredentialsProvide, err := NewS3CredentialProvider(accessKey, secretKey)
-	if err != nil {
-		err = fmt.Errorf("Error in generating the CredentialProvider: %s", err)
-		return
-	}
-	credentials := credentials.NewCredentials(S3CredentialsProvide)
+func NewS3Bucket(bucketName, region, hostURL string, credentials *credentials.Credentials) (bucket S3Bucket, err error) {
 	sess, err := session.NewSession(
 		aws.NewConfig().
 			WithCredentials(credentials).
@@ -72,31 +65,74 @@ func (b S3Bucket) ListObject() (*s3.ListObjectsOutput, error) {
 	return sess.ListObjects(&s3.ListObjectsInput{Bucket: &b.BucketName})
 }
 
-func (b S3Bucket) SpoolAllObject(input *s3.ListObjectsV2Input, output chan<- s3.Object) {
+// ListAllObjects returns all the objects in the bucket whose key starts with
+// prefix, following the pagination
+func (b S3Bucket) ListAllObjects(prefix string) ([]s3.Object, error) {
+	client := s3.New(&b.Session)
+	objects := []s3.Object{}
+	err := client.ListObjectsV2Pages(
+		&s3.ListObjectsV2Input{Bucket: &b.BucketName, Prefix: &prefix, FetchOwner: aws.Bool(true)},
+		func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+			for _, object := range page.Contents {
+				objects = append(objects, *object)
+			}
+			return true
+		})
+	return objects, err
+}
+
+// GetObjectContent downloads the whole object in memory, it is meant for the
+// small files of the status bucket
+func (b S3Bucket) GetObjectContent(key string) ([]byte, error) {
+	client := s3.New(&b.Session)
+	output, err := client.GetObject(&s3.GetObjectInput{
+		Bucket: &b.BucketName,
+		Key:    &key,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer output.Body.Close()
+	return ioutil.ReadAll(output.Body)
+}
+
+// SpoolAllObject sends all the objects of the listing into output and closes
+// it, the returned channel receives the result of the listing once output is
+// closed: nil, or the error that interrupted the listing
+func (b S3Bucket) SpoolAllObject(input *s3.ListObjectsV2Input, output chan<- s3.Object) <-chan error {
 	client := s3.New(&b.Session)
+	result := make(chan error, 1)
 
 	if input == nil {
-		input = &s3.ListObjectsV2Input{Bucket: &b.BucketName}
+		input = &s3.ListObjectsV2Input{
+			Bucket:     &b.BucketName,
+			FetchOwner: aws.Bool(true),
+		}
 	} else {
 		if input.Bucket == nil {
 			input.Bucket = &b.BucketName
 		}
 	}
 
-	fmt.Println(input)
 	go func() {
-		client.ListObjectsV2Pages(input,
+		err := client.ListObjectsV2Pages(input,
 			func(page *s3.ListObjectsV2Output, lastPage bool) bool {
 				for _, object := range page.Contents {
 					log.Log().Trace("Got object")
 					output <- *object
 				}
-				return lastPage
+				// keep going until the last page
+				return true
 			},
 		)
 		log.Log().Trace("Closing spool channel")
 		close(output)
+		if err != nil {
+			err = fmt.Errorf("Error in listing the bucket %s: %s", b.BucketName, err)
+		}
+		result <- err
 	}()
+	return result
 }
 
 type S3BucketCouple struct {
@@ -107,15 +143,18 @@ type S3BucketCouple struct {
 func NewS3BucketCouple(bc BucketConfiguration) (couple S3BucketCouple, err error) {
 	region := bc.Region
 	hostURL := bc.HostURL
-	accessKey := bc.AccessKey
-	secretKey := bc.SecretKey
-	data, err := NewS3Bucket(bc.Bucket, region, hostURL, accessKey, secretKey)
+	credentials, err := NewCredentials(bc)
+	if err != nil {
+		err = fmt.Errorf("Error in generating the credentials: %s", err)
+		return
+	}
+	data, err := NewS3Bucket(bc.Bucket, region, hostURL, credentials)
 	if err != nil {
 		err = fmt.Errorf("Error in generating the structure for the data bucket: %s | %s",
 			bc.Bucket, err)
 		return
 	}
-	status, err := NewS3Bucket(bc.StatusBucket, region, hostURL, accessKey, secretKey)
+	status, err := NewS3Bucket(bc.StatusBucket, region, hostURL, credentials)
 	if err != nil {
 		err = fmt.Errorf("Error in generating the structure for the status bucket: %s | %s",
 			bc.StatusBucket, err)
@@ -126,7 +165,9 @@ func NewS3BucketCouple(bc BucketConfiguration) (couple S3BucketCouple, err error
 	return
 }
 
-func UploadPingToStatusBucket(s3c S3BucketCouple) {
+// UploadPingToStatusBucket keeps uploading the PING object, with the current
+// timestamp and, if health is not nil, the health of the listings
+func UploadPingToStatusBucket(s3c S3BucketCouple, health func() ListingHealth) {
 	status := s3c.Status
 	uploader := s3manager.NewUploader(&status.Session)
 	l := log.Decorate(map[string]string{
@@ -140,6 +181,10 @@ func UploadPingToStatusBucket(s3c S3BucketCouple) {
 
 			body := bytes.NewBuffer(make([]byte, 0))
 			body.WriteString(timestamp)
+			if health != nil {
+				body.WriteString("\n")
+				body.WriteString(health().String())
+			}
 
 			_, err := uploader.Upload(&s3manager.UploadInput{
 				Bucket:      aws.String(status.BucketName),
@@ -161,59 +206,3 @@ func UploadPingToStatusBucket(s3c S3BucketCouple) {
 		time.Sleep(30 * time.Second)
 	}
 }
-
-type S3File struct {
-	downloader             *s3manager.Downloader
-	remotePath             *s3.GetObjectInput
-	tempPath               string
-	err                    error
-	downloadedWithoutError bool
-}
-
-func NewS3File(downloader *s3manager.Downloader, remotePath *s3.GetObjectInput) S3File {
-	return S3File{
-		downloader: downloader,
-		remotePath: remotePath,
-		tempPath:   "",
-		err:        nil,
-		downloadedWithoutError: false,
-	}
-}
-
-func (s3f S3File) Download() {
-	f, err := ioutil.TempFile("", "portal")
-	if err != nil {
-		s3f.err = err
-		return
-	}
-	_, err = s3f.downloader.Download(f, s3f.remotePath)
-	if err != nil {
-		s3f.err = err
-		return
-	}
-	s3f.downloadedWithoutError = true
-	return
-}
-
-func (s3f S3File) Error() error {
-	return s3f.err
-}
-
-func (s3f S3File) TemporaryLocation() string {
-	if s3f.downloadedWithoutError {
-		return s3f.tempPath
-	}
-	if s3f.downloadedWithoutError == false && s3f.Error() == nil {
-		s3f.Download()
-		return s3f.TemporaryLocation()
-	}
-	return ""
-}
-
-func (s3f S3File) Clean() error {
-	if s3f.downloadedWithoutError == false {
-		return nil
-	}
-	err := os.Remove(s3f.tempPath)
-	return err
-}
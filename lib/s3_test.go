@@ -0,0 +1,148 @@
+package lib
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// fakeListing serves the ListObjectsV2 of a bucket, pageSize objects per page
+type fakeListing struct {
+	mutex    sync.Mutex
+	objects  map[string]time.Time
+	pageSize int
+	// requests served, with their start-after
+	requests []string
+}
+
+func newFakeListing(pageSize int, keys ...string) *fakeListing {
+	l := &fakeListing{objects: map[string]time.Time{}, pageSize: pageSize}
+	for _, key := range keys {
+		l.put(key)
+	}
+	return l
+}
+
+// put creates or modifies the object
+func (l *fakeListing) put(key string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.objects[key] = time.Now().Add(time.Duration(len(l.objects)) * time.Second)
+}
+
+// putAt creates or modifies the object, as modified at the time provided
+func (l *fakeListing) putAt(key string, modified time.Time) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.objects[key] = modified
+}
+
+func (l *fakeListing) remove(key string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	delete(l.objects, key)
+}
+
+func (l *fakeListing) served() []string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return append([]string{}, l.requests...)
+}
+
+func (l *fakeListing) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("list-type") != "2" {
+		s3Error(w, http.StatusBadRequest, "UnexpectedRequest")
+		return
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	after := query.Get("start-after")
+	l.requests = append(l.requests, after)
+	if token := query.Get("continuation-token"); token != "" {
+		after = token
+	}
+	keys := []string{}
+	for key := range l.objects {
+		if key > after && strings.HasPrefix(key, query.Get("prefix")) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	truncated := len(keys) > l.pageSize
+	if truncated {
+		keys = keys[:l.pageSize]
+	}
+	body := "<ListBucketResult><Name>bucket</Name><KeyCount>" + strconv.Itoa(len(keys)) + "</KeyCount>"
+	body += fmt.Sprintf("<IsTruncated>%t</IsTruncated>", truncated)
+	if truncated {
+		body += "<NextContinuationToken>" + keys[len(keys)-1] + "</NextContinuationToken>"
+	}
+	for _, key := range keys {
+		body += "<Contents><Key>" + key + "</Key><ETag>&quot;etag&quot;</ETag><Size>10</Size>" +
+			"<LastModified>" + l.objects[key].UTC().Format(time.RFC3339) + "</LastModified></Contents>"
+	}
+	body += "</ListBucketResult>"
+	w.Write([]byte(body))
+}
+
+func TestSpoolAllObjectPages(t *testing.T) {
+	keys := []string{"a.tar", "b.tar", "c.tar", "d.tar", "e.tar"}
+	for _, pageSize := range []int{1, 2, 5, 10} {
+		listing := newFakeListing(pageSize, keys...)
+		sess, stop := fakeS3(t, listing.ServeHTTP)
+		bucket := S3Bucket{BucketName: "bucket", Session: *sess}
+
+		output := make(chan s3.Object)
+		result := bucket.SpoolAllObject(nil, output)
+		listed := []string{}
+		for object := range output {
+			listed = append(listed, *object.Key)
+		}
+		err := <-result
+		stop()
+		if err != nil {
+			t.Errorf("page size %d: unexpected error %s", pageSize, err)
+			continue
+		}
+		if strings.Join(listed, " ") != "a.tar b.tar c.tar d.tar e.tar" {
+			t.Errorf("page size %d: wrong listing %v", pageSize, listed)
+		}
+	}
+}
+
+func TestSpoolAllObjectError(t *testing.T) {
+	listing := newFakeListing(2, "a.tar", "b.tar", "c.tar")
+	sess, stop := fakeS3(t, func(w http.ResponseWriter, r *http.Request) {
+		// the second page is refused
+		if r.URL.Query().Get("continuation-token") != "" {
+			s3Error(w, http.StatusForbidden, "AccessDenied")
+			return
+		}
+		listing.ServeHTTP(w, r)
+	})
+	defer stop()
+	bucket := S3Bucket{BucketName: "bucket", Session: *sess}
+
+	output := make(chan s3.Object, 10)
+	err := <-bucket.SpoolAllObject(nil, output)
+	listed := []string{}
+	for object := range output {
+		listed = append(listed, *object.Key)
+	}
+	if err == nil || !strings.Contains(err.Error(), "AccessDenied") {
+		t.Errorf("expected the error of the second page, got %v", err)
+	}
+	if strings.Join(listed, " ") != "a.tar b.tar" {
+		t.Errorf("expected the objects of the first page, got %v", listed)
+	}
+}
@@ -0,0 +1,235 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/openpgp"
+)
+
+// SignaturePolicy configures the verification of the detached signature
+// <key>.sig that must accompany every object.
+//
+// The verification is enabled as soon as a key is configured, both OpenPGP
+// signatures, checked against the keyring file, and minisign signatures,
+// checked against the public keys, are accepted.
+type SignaturePolicy struct {
+	// path of the OpenPGP keyring, either armored or binary
+	OpenPGPKeyring string `toml:"openpgp-keyring"`
+	// minisign public keys, as the base64 line of the minisign.pub file
+	MinisignKeys []string `toml:"minisign-keys"`
+
+	keyring      openpgp.EntityList
+	minisignKeys map[string]ed25519.PublicKey
+}
+
+func (policy SignaturePolicy) Enabled() bool {
+	return policy.OpenPGPKeyring != "" || len(policy.MinisignKeys) > 0
+}
+
+// Validate loads all the keys of the policy
+func (policy *SignaturePolicy) Validate() error {
+	if policy.OpenPGPKeyring != "" {
+		keyring, err := readOpenPGPKeyring(policy.OpenPGPKeyring)
+		if err != nil {
+			return fmt.Errorf("Error in reading the keyring %s: %s", policy.OpenPGPKeyring, err)
+		}
+		policy.keyring = keyring
+	}
+	policy.minisignKeys = make(map[string]ed25519.PublicKey)
+	for _, encoded := range policy.MinisignKeys {
+		keyID, key, err := parseMinisignPublicKey(encoded)
+		if err != nil {
+			return fmt.Errorf("Error in the minisign key %s: %s", encoded, err)
+		}
+		policy.minisignKeys[keyID] = key
+	}
+	return nil
+}
+
+func readOpenPGPKeyring(path string) (openpgp.EntityList, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Contains(content, []byte("-----BEGIN PGP")) {
+		return openpgp.ReadArmoredKeyRing(bytes.NewReader(content))
+	}
+	return openpgp.ReadKeyRing(bytes.NewReader(content))
+}
+
+// minisign public keys are: "Ed" || key id (8 bytes) || ed25519 key
+func parseMinisignPublicKey(encoded string) (keyID string, key ed25519.PublicKey, err error) {
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return
+	}
+	if len(decoded) != 2+8+ed25519.PublicKeySize || string(decoded[:2]) != "Ed" {
+		err = fmt.Errorf("Not a minisign ed25519 public key")
+		return
+	}
+	keyID = fmt.Sprintf("%X", decoded[2:10])
+	key = ed25519.PublicKey(decoded[10:])
+	return
+}
+
+// SignatureError is returned when the signature is missing or invalid
+type SignatureError struct {
+	Signature string
+	Reason    string
+}
+
+func (e SignatureError) Error() string {
+	return fmt.Sprintf("Signature verification failed with %s: %s", e.Signature, e.Reason)
+}
+
+func (e SignatureError) Details() map[string]string {
+	return map[string]string{
+		"signature":        e.Signature,
+		"signature-reason": e.Reason,
+	}
+}
+
+// VerifySignature checks the downloaded file against the signature object
+// <key>.sig, it returns the identity of the signer
+func (s3obj S3Object) VerifySignature(path string) (string, error) {
+	signature, err := s3obj.FetchSignature()
+	if err != nil {
+		return "", err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	return s3obj.VerifySignatureOf(f, signature)
+}
+
+// FetchSignature downloads the signature object <key>.sig
+func (s3obj S3Object) FetchSignature() ([]byte, error) {
+	sigKey := s3obj.key + ".sig"
+
+	object, err := s3.New(s3obj.session).GetObject(&s3.GetObjectInput{
+		Bucket: &s3obj.bucket,
+		Key:    &sigKey,
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+			return nil, SignatureError{Signature: sigKey, Reason: "signature missing"}
+		}
+		return nil, fmt.Errorf("Error in downloading the signature %s: %s", sigKey, err)
+	}
+	defer object.Body.Close()
+	signature, err := ioutil.ReadAll(object.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Error in downloading the signature %s: %s", sigKey, err)
+	}
+	return signature, nil
+}
+
+// VerifySignatureOf checks the content read from signed against the
+// signature, it returns the identity of the signer
+func (s3obj S3Object) VerifySignatureOf(signed io.Reader, signature []byte) (signer string, err error) {
+	policy := s3obj.config.Signature
+	if bytes.HasPrefix(signature, []byte("untrusted comment:")) {
+		signer, err = verifyMinisign(policy.minisignKeys, signed, signature)
+	} else {
+		signer, err = verifyOpenPGP(policy.keyring, signed, signature)
+	}
+	if err != nil {
+		return "", SignatureError{Signature: s3obj.key + ".sig", Reason: err.Error()}
+	}
+	return signer, nil
+}
+
+func verifyOpenPGP(keyring openpgp.EntityList, signed io.Reader, signature []byte) (string, error) {
+	if len(keyring) == 0 {
+		return "", fmt.Errorf("OpenPGP signature but no OpenPGP keyring configured")
+	}
+	var entity *openpgp.Entity
+	var err error
+	if bytes.Contains(signature, []byte("-----BEGIN PGP SIGNATURE-----")) {
+		entity, err = openpgp.CheckArmoredDetachedSignature(keyring, signed, bytes.NewReader(signature))
+	} else {
+		entity, err = openpgp.CheckDetachedSignature(keyring, signed, bytes.NewReader(signature))
+	}
+	if err != nil {
+		return "", err
+	}
+	for name := range entity.Identities {
+		return name, nil
+	}
+	return fmt.Sprintf("%X", entity.PrimaryKey.Fingerprint), nil
+}
+
+// the legacy minisign signatures sign the whole file, that must be kept in
+// memory to be verified, they are accepted only for files up to this size,
+// the larger files must be signed with `minisign -H`
+const legacyMinisignMaxSize = 64 * 1024 * 1024
+
+// The minisign signature file is composed of four lines:
+// untrusted comment: <text>
+// base64("Ed" or "ED" || key id (8 bytes) || ed25519 signature)
+// trusted comment: <text>
+// base64(ed25519 signature of the signature || trusted comment text)
+// with "ED" the signed message is the blake2b-512 of the file
+func verifyMinisign(keys map[string]ed25519.PublicKey, signed io.Reader, signature []byte) (string, error) {
+	lines := strings.Split(strings.Replace(string(signature), "\r\n", "\n", -1), "\n")
+	if len(lines) < 4 || !strings.HasPrefix(lines[2], "trusted comment: ") {
+		return "", fmt.Errorf("Malformed minisign signature")
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[1]))
+	if err != nil || len(sig) != 2+8+ed25519.SignatureSize {
+		return "", fmt.Errorf("Malformed minisign signature")
+	}
+	globalSig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[3]))
+	if err != nil || len(globalSig) != ed25519.SignatureSize {
+		return "", fmt.Errorf("Malformed minisign global signature")
+	}
+
+	keyID := fmt.Sprintf("%X", sig[2:10])
+	key, ok := keys[keyID]
+	if !ok {
+		return "", fmt.Errorf("Minisign signature from the unknown key %s", keyID)
+	}
+
+	var message []byte
+	switch string(sig[:2]) {
+	case "Ed":
+		message, err = ioutil.ReadAll(io.LimitReader(signed, legacyMinisignMaxSize+1))
+		if err == nil && len(message) > legacyMinisignMaxSize {
+			return "", fmt.Errorf("Legacy minisign signature on a file larger than %d bytes, "+
+				"the file must be signed with minisign -H", legacyMinisignMaxSize)
+		}
+	case "ED":
+		h, _ := blake2b.New512(nil)
+		_, err = io.Copy(h, signed)
+		message = h.Sum(nil)
+	default:
+		return "", fmt.Errorf("Unknown minisign signature algorithm %q", sig[:2])
+	}
+	if err != nil {
+		return "", err
+	}
+	if !ed25519.Verify(key, message, sig[10:]) {
+		return "", fmt.Errorf("Invalid minisign signature from the key %s", keyID)
+	}
+
+	trustedComment := strings.TrimPrefix(lines[2], "trusted comment: ")
+	if !ed25519.Verify(key, append(sig[10:], []byte(trustedComment)...), globalSig) {
+		return "", fmt.Errorf("Invalid minisign trusted comment from the key %s", keyID)
+	}
+	return "minisign key " + keyID, nil
+}
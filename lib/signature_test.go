@@ -0,0 +1,184 @@
+package lib
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/openpgp"
+)
+
+type minisignKey struct {
+	id      []byte
+	public  ed25519.PublicKey
+	private ed25519.PrivateKey
+}
+
+func newMinisignKey(t *testing.T, id string) minisignKey {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return minisignKey{id: []byte(id), public: public, private: private}
+}
+
+func (k minisignKey) encoded() string {
+	return base64.StdEncoding.EncodeToString(append(append([]byte("Ed"), k.id...), k.public...))
+}
+
+// sign returns the minisign signature file of content, with algorithm "Ed"
+// the whole content is signed, with "ED" its blake2b-512
+func (k minisignKey) sign(algorithm string, content []byte, trustedComment string) []byte {
+	message := content
+	if algorithm == "ED" {
+		sum := blake2b.Sum512(content)
+		message = sum[:]
+	}
+	sig := ed25519.Sign(k.private, message)
+	globalSig := ed25519.Sign(k.private, append(append([]byte{}, sig...), []byte(trustedComment)...))
+	return []byte("untrusted comment: signature from minisign secret key\n" +
+		base64.StdEncoding.EncodeToString(append(append([]byte(algorithm), k.id...), sig...)) + "\n" +
+		"trusted comment: " + trustedComment + "\n" +
+		base64.StdEncoding.EncodeToString(globalSig) + "\n")
+}
+
+func TestParseMinisignPublicKey(t *testing.T) {
+	key := newMinisignKey(t, "12345678")
+	keyID, public, err := parseMinisignPublicKey(key.encoded() + "\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keyID != "3132333435363738" || !bytes.Equal(public, key.public) {
+		t.Errorf("wrong key %s %x", keyID, public)
+	}
+
+	for _, encoded := range []string{
+		"not base64!",
+		base64.StdEncoding.EncodeToString([]byte("Ed12345678short")),
+		base64.StdEncoding.EncodeToString(append([]byte("XX12345678"), key.public...)),
+	} {
+		if _, _, err := parseMinisignPublicKey(encoded); err == nil {
+			t.Errorf("%s: expected an error", encoded)
+		}
+	}
+}
+
+func TestVerifyMinisign(t *testing.T) {
+	key := newMinisignKey(t, "12345678")
+	other := newMinisignKey(t, "87654321")
+	keys := map[string]ed25519.PublicKey{"3132333435363738": key.public}
+	content := []byte("content of the tarball")
+
+	tampered := key.sign("ED", content, "timestamp:1")
+	tampered = bytes.Replace(tampered, []byte("timestamp:1"), []byte("timestamp:2"), 1)
+
+	tests := []struct {
+		name      string
+		signature []byte
+		signed    []byte
+		err       string
+	}{
+		{"prehashed", key.sign("ED", content, "c"), content, ""},
+		{"legacy", key.sign("Ed", content, "c"), content, ""},
+		{"other content", key.sign("ED", content, "c"), []byte("other"), "Invalid minisign signature"},
+		{"unknown key", other.sign("ED", content, "c"), content, "unknown key"},
+		{"trusted comment changed", tampered, content, "trusted comment"},
+		{"unknown algorithm", key.sign("XX", content, "c"), content, "Unknown minisign signature algorithm"},
+		{"truncated", []byte("untrusted comment: x\n"), content, "Malformed"},
+		{"not base64", []byte("untrusted comment: x\n!!\ntrusted comment: c\n!!\n"), content, "Malformed"},
+	}
+	for _, test := range tests {
+		signer, err := verifyMinisign(keys, bytes.NewReader(test.signed), test.signature)
+		if test.err == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error %s", test.name, err)
+			} else if signer != "minisign key 3132333435363738" {
+				t.Errorf("%s: wrong signer %s", test.name, signer)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: expected an error containing %q, got %v", test.name, test.err, err)
+		}
+	}
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+func TestLegacyMinisignSizeLimit(t *testing.T) {
+	key := newMinisignKey(t, "12345678")
+	keys := map[string]ed25519.PublicKey{"3132333435363738": key.public}
+	// the signature does not matter, the size is checked first
+	signature := key.sign("Ed", []byte("small"), "c")
+	signed := io.LimitReader(zeroReader{}, legacyMinisignMaxSize+1)
+
+	_, err := verifyMinisign(keys, signed, signature)
+	if err == nil || !strings.Contains(err.Error(), "minisign -H") {
+		t.Errorf("expected the legacy signature to be refused, got %v", err)
+	}
+}
+
+func TestVerifySignatureOf(t *testing.T) {
+	entity, err := openpgp.NewEntity("Portal Test", "", "portal@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	minisign := newMinisignKey(t, "12345678")
+	content := []byte("content of the tarball")
+
+	var armored, binary bytes.Buffer
+	if err := openpgp.ArmoredDetachSign(&armored, entity, bytes.NewReader(content), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := openpgp.DetachSign(&binary, entity, bytes.NewReader(content), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	policy := SignaturePolicy{
+		keyring:      openpgp.EntityList{entity},
+		minisignKeys: map[string]ed25519.PublicKey{"3132333435363738": minisign.public},
+	}
+	tests := []struct {
+		name      string
+		policy    SignaturePolicy
+		signature []byte
+		signer    string
+	}{
+		{"armored openpgp", policy, armored.Bytes(), "Portal Test <portal@example.com>"},
+		{"binary openpgp", policy, binary.Bytes(), "Portal Test <portal@example.com>"},
+		{"minisign", policy, minisign.sign("ED", content, "c"), "minisign key 3132333435363738"},
+		{"no keyring", SignaturePolicy{}, armored.Bytes(), ""},
+		{"no minisign keys", SignaturePolicy{keyring: policy.keyring}, minisign.sign("ED", content, "c"), ""},
+		{"garbage", policy, []byte("garbage"), ""},
+	}
+	for _, test := range tests {
+		s3obj := S3Object{key: "object.tar", config: &BucketConfiguration{Signature: test.policy}}
+		signer, err := s3obj.VerifySignatureOf(bytes.NewReader(content), test.signature)
+		if test.signer != "" {
+			if err != nil || signer != test.signer {
+				t.Errorf("%s: expected the signer %s, got %s %v", test.name, test.signer, signer, err)
+			}
+			continue
+		}
+		sigErr, ok := err.(SignatureError)
+		if !ok {
+			t.Errorf("%s: expected a SignatureError, got %v", test.name, err)
+			continue
+		}
+		if sigErr.Details()["signature"] != "object.tar.sig" {
+			t.Errorf("%s: wrong details %v", test.name, sigErr.Details())
+		}
+	}
+}
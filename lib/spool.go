@@ -0,0 +1,178 @@
+package lib
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/cvmfs/portals/log"
+)
+
+/*
+The objects are downloaded into the spool directory before being ingested.
+
+A spool directory belongs to a single daemon: when the daemon starts, all the
+files it may have left there, after a crash, are removed, but the partial
+downloads that can still be resumed.
+*/
+
+// prefixes of the temporary files created in the spool directory
+var spoolPrefixes = []string{"s3temp", "portal"}
+
+// free space that we always leave in the spool directory, on top of the size
+// of the object
+const spoolReserve = 64 * 1024 * 1024
+
+// SpoolFullError is returned when the spool directory has not enough space
+// to download an object
+type SpoolFullError struct {
+	SpoolDir  string
+	Needed    uint64
+	Available uint64
+}
+
+func (e SpoolFullError) Error() string {
+	return fmt.Sprintf("Not enough space in the spool directory %s: %d bytes needed, %d available",
+		e.SpoolDir, e.Needed, e.Available)
+}
+
+// DefaultSpoolDir is dedicated to the daemon, the sweep removes what it finds
+// there
+const DefaultSpoolDir = "/var/spool/portals"
+
+func validateSpoolDir(dir string) error {
+	if !filepath.IsAbs(dir) {
+		return fmt.Errorf("The spool directory %s is not an absolute path", dir)
+	}
+	if filepath.Clean(dir) == filepath.Clean(os.TempDir()) {
+		return fmt.Errorf("The spool directory %s is shared with other processes, "+
+			"it must be dedicated to the daemon", dir)
+	}
+	return nil
+}
+
+// PrepareSpoolDir creates the spool directory, if it is missing
+func PrepareSpoolDir(dir string) error {
+	return os.MkdirAll(dir, 0700)
+}
+
+// FreeSpace returns the bytes available to unprivileged users in dir
+func FreeSpace(dir string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+	return stat.Bavail * uint64(stat.Bsize), nil
+}
+
+// space promised to the downloads in progress, by spool directory
+var spoolReservations = struct {
+	sync.Mutex
+	bytes map[string]uint64
+}{bytes: map[string]uint64{}}
+
+// CheckSpoolSpace makes sure that an object of size bytes fits in the spool
+// directory, next to the downloads in progress
+func CheckSpoolSpace(dir string, size int64) error {
+	spoolReservations.Lock()
+	defer spoolReservations.Unlock()
+	return checkSpoolSpace(dir, size)
+}
+
+func checkSpoolSpace(dir string, size int64) error {
+	available, err := FreeSpace(dir)
+	if err != nil {
+		return fmt.Errorf("Error in checking the space in the spool directory %s: %s", dir, err)
+	}
+	needed := uint64(size) + spoolReserve + spoolReservations.bytes[dir]
+	if available < needed {
+		return SpoolFullError{SpoolDir: dir, Needed: needed, Available: available}
+	}
+	return nil
+}
+
+// ReserveSpoolSpace is CheckSpoolSpace, but the space stays reserved for the
+// object until release is called, so that the downloads running at the same
+// time do not count on the same free space.
+// The bytes already downloaded are counted both as reserved and as used, the
+// reservation must be released as soon as the download is done
+func ReserveSpoolSpace(dir string, size int64) (release func(), err error) {
+	spoolReservations.Lock()
+	defer spoolReservations.Unlock()
+
+	if err = checkSpoolSpace(dir, size); err != nil {
+		return nil, err
+	}
+	spoolReservations.bytes[dir] += uint64(size)
+	var once sync.Once
+	release = func() {
+		once.Do(func() {
+			spoolReservations.Lock()
+			defer spoolReservations.Unlock()
+			spoolReservations.bytes[dir] -= uint64(size)
+		})
+	}
+	return release, nil
+}
+
+// CreateSpoolFile creates a new temporary file in the spool directory
+func CreateSpoolFile(dir, prefix string) (*os.File, error) {
+	return ioutil.TempFile(dir, prefix)
+}
+
+func isSpoolFile(name string) bool {
+	for _, prefix := range spoolPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// isResumable is true for the partial downloads, and their journals, that
+// can be resumed
+func isResumable(dir string, file os.FileInfo) bool {
+	if !strings.HasPrefix(file.Name(), partialPrefix) {
+		return false
+	}
+	journal := strings.TrimSuffix(file.Name(), ".parts") + ".parts"
+	info, err := os.Stat(filepath.Join(dir, journal))
+	if err != nil {
+		return false
+	}
+	return time.Since(info.ModTime()) < partialRetention
+}
+
+// SweepSpool removes the temporary files left in the spool directory by a
+// previous run of the daemon, it must be called before starting any download
+func SweepSpool(dir string) {
+	l := log.Decorate(map[string]string{
+		"Action":    "sweep spool",
+		"Spool dir": dir,
+	})
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		l(log.LogE(err)).Error("Error in reading the spool directory")
+		return
+	}
+	for _, file := range files {
+		if !file.Mode().IsRegular() || !isSpoolFile(file.Name()) {
+			continue
+		}
+		path := filepath.Join(dir, file.Name())
+		if isResumable(dir, file) {
+			l(log.Log()).WithField("file", path).Info("Keeping partial download")
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			l(log.LogE(err)).WithField("file", path).Error("Error in removing an orphaned spool file")
+			continue
+		}
+		l(log.Log()).WithField("file", path).Info("Removed orphaned spool file")
+	}
+}
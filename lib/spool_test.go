@@ -0,0 +1,118 @@
+package lib
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateSpoolDir(t *testing.T) {
+	tests := []struct {
+		dir string
+		ok  bool
+	}{
+		{"/var/spool/portals", true},
+		{"/data/spool/", true},
+		{"spool", false},
+		{"./spool", false},
+		{os.TempDir(), false},
+		{os.TempDir() + "/", false},
+	}
+	for _, test := range tests {
+		if err := validateSpoolDir(test.dir); (err == nil) != test.ok {
+			t.Errorf("%s: expected valid %t, got %v", test.dir, test.ok, err)
+		}
+	}
+}
+
+func TestReserveSpoolSpace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "portals-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	free, err := FreeSpace(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const margin = 256 * 1024 * 1024
+	if free < 4*margin {
+		t.Skip("not enough free space for the test")
+	}
+	// most of the free space, leaving less than margin
+	large := int64(free - spoolReserve - margin/2)
+
+	release, err := ReserveSpoolSpace(dir, large)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if _, err := ReserveSpoolSpace(dir, margin); err == nil {
+		t.Errorf("the second reservation should not fit")
+	} else if _, ok := err.(SpoolFullError); !ok {
+		t.Errorf("expected a SpoolFullError, got %s", err)
+	}
+	if err := CheckSpoolSpace(dir, margin); err == nil {
+		t.Errorf("the check should count the reservations")
+	}
+
+	release()
+	release()
+	again, err := ReserveSpoolSpace(dir, margin)
+	if err != nil {
+		t.Fatalf("the space should be available after the release: %s", err)
+	}
+	again()
+	if reserved := spoolReservations.bytes[dir]; reserved != 0 {
+		t.Errorf("%d bytes still reserved", reserved)
+	}
+}
+
+func TestSweepSpool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "portals-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	old := time.Now().Add(-partialRetention - time.Hour)
+	files := []struct {
+		name     string
+		modified time.Time
+	}{
+		{"s3temp123", time.Now()},
+		{"portal-upload", time.Now()},
+		{"other-process.txt", time.Now()},
+		{partialPrefix + "fresh", time.Now()},
+		{partialPrefix + "fresh.parts", time.Now()},
+		{partialPrefix + "stale", time.Now()},
+		{partialPrefix + "stale.parts", old},
+		{partialPrefix + "without-journal", time.Now()},
+	}
+	for _, file := range files {
+		path := filepath.Join(dir, file.name)
+		if err := ioutil.WriteFile(path, []byte("x"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(path, file.modified, file.modified)
+	}
+	os.Mkdir(filepath.Join(dir, "s3temp-directory"), 0700)
+
+	SweepSpool(dir)
+
+	infos, _ := ioutil.ReadDir(dir)
+	left := []string{}
+	for _, info := range infos {
+		left = append(left, info.Name())
+	}
+	sort.Strings(left)
+	expected := []string{"other-process.txt", partialPrefix + "fresh", partialPrefix + "fresh.parts", "s3temp-directory"}
+	sort.Strings(expected)
+	if strings.Join(left, " ") != strings.Join(expected, " ") {
+		t.Errorf("expected %v left in the spool, got %v", expected, left)
+	}
+}
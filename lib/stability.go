@@ -0,0 +1,147 @@
+package lib
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/cvmfs/portals/log"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+/*
+A client may be overwriting an object while we list it, to avoid ingesting an
+intermediate version:
+1. The objects modified less than the quiet period ago are not considered
+2. The download asks for the ETag we listed, if the object changed meanwhile
+   the download fails and we restart
+3. Right before the ingestion we check that the object in the bucket is still
+   the one we downloaded, if it is not we restart
+
+A restart does not happen inside the stage that noticed the change, the new
+version of the object goes back into the input of the pipeline.
+*/
+
+// maximum number of times an object is downloaded again because it changed
+const maxRestarts = 3
+
+// errObjectChanged is returned when the object in the bucket is not anymore
+// the one we downloaded
+var errObjectChanged = fmt.Errorf("The object changed while it was processed")
+
+// IsStable is true if the object was not modified during the quiet period
+func (bc BucketConfiguration) IsStable(object s3.Object, now time.Time) bool {
+	if object.LastModified == nil {
+		return true
+	}
+	return now.Sub(*object.LastModified) >= bc.QuietPeriod.Duration
+}
+
+// IsGroupStable is true if neither the marker nor any object of the group
+// were modified during the quiet period
+func (bc BucketConfiguration) IsGroupStable(group ObjectGroup, now time.Time) bool {
+	if !bc.IsStable(group.Marker, now) {
+		return false
+	}
+	for _, object := range group.Objects {
+		if !bc.IsStable(object, now) {
+			return false
+		}
+	}
+	return true
+}
+
+// headObject asks the bucket for the ETag and LastModified of the object, as
+// a listing would report them
+func headObject(session *session.Session, bucket, key string) (s3.Object, error) {
+	head, err := s3.New(session).HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return s3.Object{}, fmt.Errorf("Error in reading the metadata of the object: %s", err)
+	}
+	return s3.Object{
+		Key:          aws.String(key),
+		ETag:         head.ETag,
+		LastModified: head.LastModified,
+		Size:         head.ContentLength,
+	}, nil
+}
+
+// currentVersion asks the bucket for the ETag and LastModified of the object
+func (s3obj S3Object) currentVersion() (s3.Object, error) {
+	return headObject(s3obj.session, s3obj.bucket, s3obj.key)
+}
+
+// isUnchanged compares the object we are working on with the one in the
+// bucket
+func (s3obj S3Object) isUnchanged() (bool, error) {
+	current, err := s3obj.currentVersion()
+	if err != nil {
+		return false, err
+	}
+	etag := strings.Trim(aws.StringValue(current.ETag), "\"")
+	// HEAD reports the time with the precision of the second, the listing
+	// may be more precise
+	sameTime := current.LastModified != nil &&
+		current.LastModified.Unix() == s3obj.lastModified.Unix()
+	return etag == s3obj.etag && sameTime, nil
+}
+
+// refreshed is the same object in its new version, the hash changes and so
+// it gets new status files
+func (s3obj S3Object) refreshed(current s3.Object) S3Object {
+	refreshed := NewS3Object(s3obj.bucket, s3obj.statusBucket, current,
+		s3obj.session, s3obj.cvmfsRepo, s3obj.config, s3obj.journal)
+	refreshed.owner = s3obj.owner
+	refreshed.restarts = s3obj.restarts + 1
+	return refreshed
+}
+
+// ErrorObjectChanged skips all the stages of an object that changed while it
+// was processed, at the cleanup its new version is sent back into the
+// pipeline
+type ErrorObjectChanged struct {
+	S3Object
+	tempPath string
+}
+
+func (e ErrorObjectChanged) DownloadFile() IS3DownloadedFile {
+	return e
+}
+
+func (e ErrorObjectChanged) Validate() IS3LocalFile {
+	return e
+}
+
+func (e ErrorObjectChanged) Ingest() IS3IngestedFile {
+	return e
+}
+
+func (e ErrorObjectChanged) Cleanup() PipelineOutput {
+	if e.tempPath != "" {
+		os.Remove(e.tempPath)
+	}
+
+	report := NewStatusReport(e.S3Object, "RESTARTED")
+	report.Error = errObjectChanged.Error()
+	e.UploadStatusReport(report)
+
+	if e.restarts >= maxRestarts {
+		return NewErrorWithStatus(e.S3Object,
+			fmt.Errorf("The object changed %d times while it was processed", e.restarts+1)).Cleanup()
+	}
+	current, err := e.currentVersion()
+	if err != nil {
+		// the next listing tries again
+		l := log.Decorate(map[string]string{"file": e.key})
+		l(log.LogE(err)).Error("Error in reading the new version of the object")
+		return PipelineOutput{}
+	}
+	return PipelineOutput{Restart: e.refreshed(current)}
+}
@@ -0,0 +1,241 @@
+package lib
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// statusRecorder is a fake bucket that records the status files uploaded
+// into the status bucket and serves the object of the data bucket
+type statusRecorder struct {
+	mutex    sync.Mutex
+	statuses []string
+
+	// served for the GET of the object, zero for a 412
+	body []byte
+	// served for the HEAD of the object
+	etag         string
+	lastModified time.Time
+}
+
+func (r *statusRecorder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch {
+	case req.Method == http.MethodPut && len(req.URL.Path) > len("/status/"):
+		r.mutex.Lock()
+		r.statuses = append(r.statuses, req.URL.Path[len("/status/"):])
+		r.mutex.Unlock()
+		w.Header().Set("ETag", `"status"`)
+	case req.Method == http.MethodHead:
+		w.Header().Set("ETag", `"`+r.etag+`"`)
+		w.Header().Set("Last-Modified", r.lastModified.UTC().Format(http.TimeFormat))
+		w.Header().Set("Content-Length", "0")
+	case req.Method == http.MethodGet && r.body == nil:
+		s3Error(w, http.StatusPreconditionFailed, "PreconditionFailed")
+	case req.Method == http.MethodGet:
+		w.Write(r.body)
+	default:
+		s3Error(w, http.StatusBadRequest, "UnexpectedRequest")
+	}
+}
+
+func (r *statusRecorder) recorded() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]string{}, r.statuses...)
+}
+
+func TestDownloadOfChangedObject(t *testing.T) {
+	spool, err := ioutil.TempDir("", "portals-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(spool)
+
+	recorder := &statusRecorder{}
+	sess, stop := fakeS3(t, recorder.ServeHTTP)
+	defer stop()
+
+	s3obj := S3Object{
+		bucket:       "data",
+		statusBucket: "status",
+		key:          "object.tar",
+		hash:         "0123456789",
+		session:      sess,
+		config:       &BucketConfiguration{SpoolDir: spool},
+		etag:         "old",
+		size:         10,
+	}
+	result := s3obj.downloadToFile()
+	changed, ok := result.(ErrorObjectChanged)
+	if !ok {
+		t.Fatalf("expected ErrorObjectChanged, got %T", result)
+	}
+	files, _ := ioutil.ReadDir(spool)
+	if len(files) != 0 {
+		t.Errorf("the partial download is left in the spool: %d files", len(files))
+	}
+	if _, ok := changed.DownloadFile().Validate().Ingest().(ErrorObjectChanged); !ok {
+		t.Errorf("the stages after the download are not skipped")
+	}
+}
+
+func TestRestartOfChangedObject(t *testing.T) {
+	recorder := &statusRecorder{etag: "new", lastModified: time.Now().Add(-time.Hour)}
+	sess, stop := fakeS3(t, recorder.ServeHTTP)
+	defer stop()
+
+	for _, restarts := range []int{0, maxRestarts - 1, maxRestarts} {
+		s3obj := S3Object{
+			bucket:       "data",
+			statusBucket: "status",
+			key:          "object.tar",
+			hash:         "0123456789",
+			session:      sess,
+			config:       &BucketConfiguration{},
+			etag:         "old",
+			restarts:     restarts,
+		}
+		out := ErrorObjectChanged{S3Object: s3obj}.Cleanup()
+
+		if restarts >= maxRestarts {
+			if out.Restart != nil {
+				t.Errorf("restarts %d: restarted after the maximum", restarts)
+			}
+			continue
+		}
+		refreshed, ok := out.Restart.(S3Object)
+		if !ok {
+			t.Fatalf("restarts %d: expected the object to restart, got %v", restarts, out.Restart)
+		}
+		if refreshed.etag != "new" || refreshed.hash == s3obj.hash || refreshed.restarts != restarts+1 {
+			t.Errorf("restarts %d: the restart is not the new version: etag %s, hash %s, restarts %d",
+				restarts, refreshed.etag, refreshed.hash, refreshed.restarts)
+		}
+	}
+
+	statuses := map[string]int{}
+	for _, key := range recorder.recorded() {
+		statuses[key]++
+	}
+	if statuses["object.tar.0123456789.RESTARTED"] != 3 || statuses["object.tar.0123456789.FAILURE"] != 1 {
+		t.Errorf("unexpected status files %v", statuses)
+	}
+}
+
+func TestIsStable(t *testing.T) {
+	now := time.Now()
+	config := BucketConfiguration{QuietPeriod: Duration{time.Minute}}
+	old := s3.Object{Key: aws.String("old.tar"), LastModified: aws.Time(now.Add(-time.Hour))}
+	recent := s3.Object{Key: aws.String("recent.tar"), LastModified: aws.Time(now.Add(-time.Second))}
+
+	tests := []struct {
+		name   string
+		object s3.Object
+		stable bool
+	}{
+		{"no time", s3.Object{Key: aws.String("a.tar")}, true},
+		{"old", old, true},
+		{"exactly the quiet period", s3.Object{LastModified: aws.Time(now.Add(-time.Minute))}, true},
+		{"recent", recent, false},
+	}
+	for _, test := range tests {
+		if stable := config.IsStable(test.object, now); stable != test.stable {
+			t.Errorf("%s: expected stable %t, got %t", test.name, test.stable, stable)
+		}
+	}
+
+	groups := []struct {
+		name   string
+		group  ObjectGroup
+		stable bool
+	}{
+		{"all old", ObjectGroup{Marker: old, Objects: []s3.Object{old, old}}, true},
+		{"recent marker", ObjectGroup{Marker: recent, Objects: []s3.Object{old}}, false},
+		{"recent object", ObjectGroup{Marker: old, Objects: []s3.Object{old, recent}}, false},
+	}
+	for _, test := range groups {
+		if stable := config.IsGroupStable(test.group, now); stable != test.stable {
+			t.Errorf("%s: expected stable %t, got %t", test.name, test.stable, stable)
+		}
+	}
+}
+
+func TestIsUnchanged(t *testing.T) {
+	lastModified := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		name         string
+		etag         string
+		lastModified time.Time
+		unchanged    bool
+	}{
+		{"same", "etag", lastModified, true},
+		{"more precise listing", "etag", lastModified.Add(300 * time.Millisecond), true},
+		{"other etag", "other", lastModified, false},
+		{"other time", "etag", lastModified.Add(time.Second), false},
+	}
+	for _, test := range tests {
+		recorder := &statusRecorder{etag: "etag", lastModified: lastModified}
+		sess, stop := fakeS3(t, recorder.ServeHTTP)
+		s3obj := S3Object{bucket: "data", key: "object.tar", session: sess,
+			etag: test.etag, lastModified: test.lastModified}
+		unchanged, err := s3obj.isUnchanged()
+		stop()
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", test.name, err)
+			continue
+		}
+		if unchanged != test.unchanged {
+			t.Errorf("%s: expected unchanged %t, got %t", test.name, test.unchanged, unchanged)
+		}
+	}
+}
+
+func TestRestartOfChangedSet(t *testing.T) {
+	recorder := &statusRecorder{etag: "new", lastModified: time.Now().Add(-time.Hour)}
+	sess, stop := fakeS3(t, recorder.ServeHTTP)
+	defer stop()
+
+	object := func(key, hash string) S3Object {
+		return S3Object{bucket: "data", statusBucket: "status", key: key, hash: hash,
+			session: sess, config: &BucketConfiguration{}, etag: "old"}
+	}
+	set := NewS3ObjectSet(object(".ready", "m"), []S3Object{object("1.tar", "1"), object("2.tar", "2")})
+
+	out := ErrorObjectSetChanged{S3ObjectSet: set, changed: map[string]bool{"2.tar": true}}.Cleanup()
+	restarted, ok := out.Restart.(S3ObjectSet)
+	if !ok {
+		t.Fatalf("expected the set to restart, got %v", out.Restart)
+	}
+	if restarted.objects[0].hash != "1" || restarted.objects[1].etag != "new" || restarted.objects[1].hash == "2" {
+		t.Errorf("only the object changed must be refreshed: %+v", restarted.objects)
+	}
+	if restarted.marker.restarts != 1 || restarted.marker.hash != "m" {
+		t.Errorf("the marker must be the same, with one restart: %+v", restarted.marker)
+	}
+	if pipelineID(restarted) == pipelineID(set) {
+		t.Errorf("the restarted set has the same identifier of the old one")
+	}
+
+	set.marker.restarts = maxRestarts
+	out = ErrorObjectSetChanged{S3ObjectSet: set, changed: map[string]bool{"2.tar": true}}.Cleanup()
+	if out.Restart != nil {
+		t.Errorf("restarted after the maximum")
+	}
+	failures := 0
+	for _, key := range recorder.recorded() {
+		if strings.HasSuffix(key, ".FAILURE") {
+			failures++
+		}
+	}
+	if failures != 3 {
+		t.Errorf("expected the FAILURE of the marker and of the objects, got %v", recorder.recorded())
+	}
+}
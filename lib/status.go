@@ -0,0 +1,136 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"text/template"
+	"time"
+
+	"github.com/cvmfs/portals/cvmfs"
+	"github.com/cvmfs/portals/log"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// StatusReport is the content of the status files that the portal uploads
+// into the status bucket
+type StatusReport struct {
+	Status    string `json:"status"`
+	Timestamp string `json:"timestamp"`
+	Key       string `json:"key"`
+	Hash      string `json:"hash"`
+
+	// Filled only in the SUCCESS status, they are what is needed to map
+	// the revision of the repository back to the object, the Tag is also in
+	// the INGESTING status
+	Tag      string `json:"tag,omitempty"`
+	Revision int    `json:"revision,omitempty"`
+	RootHash string `json:"root-hash,omitempty"`
+
+	// Filled only in the FAILURE status
+	Error   string            `json:"error,omitempty"`
+	Details map[string]string `json:"details,omitempty"`
+}
+
+func NewStatusReport(s3o S3Object, status string) StatusReport {
+	return StatusReport{
+		Status:    status,
+		Timestamp: time.Now().Format(time.RFC3339),
+		Key:       s3o.key,
+		Hash:      s3o.hash,
+	}
+}
+
+// NewSuccessReport is the SUCCESS status of the ingestion published with tag
+func NewSuccessReport(s3o S3Object, tag cvmfs.Tag) StatusReport {
+	report := NewStatusReport(s3o, "SUCCESS")
+	report.Tag = tag.Name
+	report.Revision = tag.Revision
+	report.RootHash = tag.RootHash
+	return report
+}
+
+func (r StatusReport) Body() *bytes.Buffer {
+	body := bytes.NewBuffer(make([]byte, 0))
+	encoder := json.NewEncoder(body)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(r)
+	return body
+}
+
+// StatusKey is the key of the status file in the status bucket
+func (r StatusReport) StatusKey() string {
+	return fmt.Sprintf("%s.%s.%s", r.Key, r.Hash, r.Status)
+}
+
+// the FAILURE status files are tagged, so that the lifecycle rule of the
+// status bucket expires only them and never the RUN object or the other
+// statuses
+const (
+	statusTagKey    = "portal-status"
+	expiringStatus  = "FAILURE"
+	expiringTagging = statusTagKey + "=" + expiringStatus
+)
+
+func UploadStatusReport(session *session.Session, statusBucket string, report StatusReport) error {
+	key := report.StatusKey()
+
+	input := &s3manager.UploadInput{
+		Bucket: aws.String(statusBucket),
+		Key:    aws.String(key),
+		Body:   report.Body(),
+	}
+	if report.Status == expiringStatus {
+		input.Tagging = aws.String(expiringTagging)
+	}
+	uploader := s3manager.NewUploader(session)
+	_, err := uploader.Upload(input)
+	if err != nil {
+		l := log.Decorate(map[string]string{"file": key})
+		l(log.LogE(err)).Error("Error in uploading file")
+		return err
+	}
+	return nil
+}
+
+func ParseStatusReport(content []byte) (report StatusReport, err error) {
+	err = json.Unmarshal(content, &report)
+	return
+}
+
+type tagTemplateInput struct {
+	Key       string
+	Hash      string
+	Timestamp string
+	Bucket    string
+}
+
+// TagFor renders the name and the description of the tag to create when
+// ingesting the object
+func (s3o S3Object) TagFor(t time.Time) (name, description string, err error) {
+	input := tagTemplateInput{
+		Key:       s3o.key,
+		Hash:      s3o.hash,
+		Timestamp: t.UTC().Format("20060102T150405Z"),
+		Bucket:    s3o.bucket,
+	}
+	name, err = renderTemplate(s3o.config.TagTemplate, input)
+	if err != nil {
+		return
+	}
+	description, err = renderTemplate(s3o.config.TagDescription, input)
+	return cvmfs.SanitizeTagName(name), description, err
+}
+
+func renderTemplate(text string, input interface{}) (string, error) {
+	t, err := template.New("").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var rendered bytes.Buffer
+	err = t.Execute(&rendered, input)
+	return rendered.String(), err
+}
@@ -0,0 +1,57 @@
+package lib
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cvmfs/portals/cvmfs"
+)
+
+func TestTagFor(t *testing.T) {
+	at := time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		template    string
+		description string
+		name        string
+		described   string
+	}{
+		{DefaultTagTemplate, DefaultTagDescription,
+			"portal-dir_a.tar-0123456789-20190102T030405Z",
+			"Ingestion of dir/a.tar (0123456789) from the bucket data"},
+		{"{{.Bucket}}/{{.Key}}", "{{.Timestamp}}",
+			"data_dir_a.tar", "20190102T030405Z"},
+	}
+	for _, test := range tests {
+		config := &BucketConfiguration{TagTemplate: test.template, TagDescription: test.description}
+		s3obj := S3Object{bucket: "data", key: "dir/a.tar", hash: "0123456789", config: config}
+		name, description, err := s3obj.TagFor(at)
+		if err != nil {
+			t.Errorf("TagFor with %q failed: %s", test.template, err)
+			continue
+		}
+		if name != test.name || description != test.described {
+			t.Errorf("TagFor with %q = %q, %q, expected %q, %q",
+				test.template, name, description, test.name, test.described)
+		}
+	}
+}
+
+func TestNewSuccessReport(t *testing.T) {
+	s3obj := S3Object{key: "a.tar", hash: "0123456789"}
+	tests := []struct {
+		tag cvmfs.Tag
+	}{
+		{cvmfs.Tag{Name: "portal-a", Revision: 3, RootHash: "abc"}},
+		// the tag could not be read after the ingestion
+		{cvmfs.Tag{Name: "portal-a"}},
+	}
+	for _, test := range tests {
+		report := NewSuccessReport(s3obj, test.tag)
+		if report.Status != "SUCCESS" || report.Key != "a.tar" || report.Hash != "0123456789" {
+			t.Errorf("Wrong SUCCESS report %+v", report)
+		}
+		if report.Tag != test.tag.Name || report.Revision != test.tag.Revision || report.RootHash != test.tag.RootHash {
+			t.Errorf("SUCCESS report %+v does not match the tag %+v", report, test.tag)
+		}
+	}
+}
@@ -0,0 +1,418 @@
+package lib
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cvmfs/portals/cvmfs"
+	"github.com/cvmfs/portals/log"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+/*
+In streaming mode the object is not downloaded into a temporary file, the body
+of the GetObject is piped directly into `cvmfs_server ingest -t -`.
+
+All the checks that would run on the downloaded file, checksum, signature and
+tarball validation, run on the fly on the same stream.
+The ingestion cannot complete before it reads the end-of-archive marker of the
+tarball, so the marker, and everything after it, is held back until all the
+checks pass: if anything goes wrong the ingestion receives a truncated tarball
+and it is aborted without publishing anything. After the marker only the zeros
+of the padding may follow, any other data makes the object a FAILURE.
+*/
+
+const tarBlockSize = 512
+
+// largest pax header we read to know the size of the next entry
+const maxPaxHeaderSize = 1 << 20
+
+var errTarTrailingData = fmt.Errorf("Unexpected data after the end of the tarball")
+
+// tarEndWriter forwards the tarball up to its end-of-archive marker, the
+// headers are followed to know where the data of each entry ends, so that a
+// block of zeros inside a file is not taken for the marker
+type tarEndWriter struct {
+	w     io.Writer
+	block [tarBlockSize]byte
+	// bytes of the header block read so far
+	filled int
+	// bytes of data, padding included, before the next header
+	remaining int64
+	// the next block is an extension of an old GNU sparse header
+	sparseExtension bool
+	// content of the pax header being read, nil if the entry is not one,
+	// and its size without the padding
+	pax    []byte
+	paxLen int64
+	// size of the next entry set by a pax header, -1 if none
+	paxSize int64
+	ended   bool
+}
+
+func newTarEndWriter(w io.Writer) *tarEndWriter {
+	return &tarEndWriter{w: w, paxSize: -1}
+}
+
+func (t *tarEndWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		if t.ended {
+			for _, b := range p {
+				if b != 0 {
+					return 0, errTarTrailingData
+				}
+			}
+			return n, nil
+		}
+
+		if t.remaining > 0 {
+			chunk := int64(len(p))
+			if chunk > t.remaining {
+				chunk = t.remaining
+			}
+			if err := t.data(p[:chunk]); err != nil {
+				return 0, err
+			}
+			p = p[chunk:]
+			continue
+		}
+
+		copied := copy(t.block[t.filled:], p)
+		t.filled += copied
+		p = p[copied:]
+		if t.filled < tarBlockSize {
+			continue
+		}
+		t.filled = 0
+		if err := t.header(); err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
+
+// data forwards the data of an entry, the pax headers are kept to be parsed
+func (t *tarEndWriter) data(p []byte) error {
+	if _, err := t.w.Write(p); err != nil {
+		return err
+	}
+	t.remaining -= int64(len(p))
+	if t.pax == nil {
+		return nil
+	}
+	t.pax = append(t.pax, p...)
+	if t.remaining == 0 {
+		size, err := paxSize(t.pax[:t.paxLen])
+		if err != nil {
+			return err
+		}
+		t.paxSize = size
+		t.pax = nil
+	}
+	return nil
+}
+
+// header handles a complete header block, the first block of zeros is the
+// end-of-archive marker
+func (t *tarEndWriter) header() error {
+	block := t.block[:]
+	if t.sparseExtension {
+		t.sparseExtension = block[504] != 0
+		_, err := t.w.Write(block)
+		return err
+	}
+	if t.block == [tarBlockSize]byte{} {
+		t.ended = true
+		return nil
+	}
+
+	size, err := tarHeaderSize(block[124:136])
+	if err != nil {
+		return err
+	}
+	typeflag := block[156]
+	switch typeflag {
+	case tar.TypeXHeader:
+		if size > maxPaxHeaderSize {
+			return fmt.Errorf("Pax header of the tarball larger than %d bytes", maxPaxHeaderSize)
+		}
+		t.pax, t.paxLen = make([]byte, 0, size), size
+	case tar.TypeXGlobalHeader, tar.TypeGNULongName, tar.TypeGNULongLink:
+	default:
+		if t.paxSize >= 0 {
+			size = t.paxSize
+			t.paxSize = -1
+		}
+	}
+	switch typeflag {
+	case tar.TypeLink, tar.TypeSymlink, tar.TypeChar, tar.TypeBlock, tar.TypeDir, tar.TypeFifo:
+		// whatever the size says, these entries have no data
+		size = 0
+	case tar.TypeGNUSparse:
+		t.sparseExtension = block[482] != 0
+	}
+	if size == 0 && t.pax != nil {
+		t.pax = nil
+	}
+	t.remaining = (size + tarBlockSize - 1) / tarBlockSize * tarBlockSize
+	_, err = t.w.Write(block)
+	return err
+}
+
+// Flush writes the end-of-archive marker held back
+func (t *tarEndWriter) Flush() error {
+	if t.filled > 0 {
+		if _, err := t.w.Write(t.block[:t.filled]); err != nil {
+			return err
+		}
+		t.filled = 0
+	}
+	if !t.ended {
+		return nil
+	}
+	_, err := t.w.Write(make([]byte, 2*tarBlockSize))
+	return err
+}
+
+// tarHeaderSize parses the size field of a header, in octal or, for the
+// large sizes, in base-256
+func tarHeaderSize(field []byte) (int64, error) {
+	if field[0]&0x80 != 0 {
+		if field[0]&0x40 != 0 || field[0]&0x3f != 0 {
+			return 0, fmt.Errorf("Size of the tarball entry out of range")
+		}
+		var size int64
+		for _, b := range field[1:] {
+			if size >= 1<<55 {
+				return 0, fmt.Errorf("Size of the tarball entry out of range")
+			}
+			size = size<<8 | int64(b)
+		}
+		return size, nil
+	}
+	octal := strings.Trim(string(field), " \x00")
+	if octal == "" {
+		return 0, nil
+	}
+	size, err := strconv.ParseInt(octal, 8, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("Malformed size %q in the tarball", octal)
+	}
+	return size, nil
+}
+
+// paxSize reads the size record of a pax header, -1 if there is none
+func paxSize(header []byte) (int64, error) {
+	size := int64(-1)
+	for len(header) > 0 {
+		space := bytes.IndexByte(header, ' ')
+		if space < 0 {
+			return 0, fmt.Errorf("Malformed pax header in the tarball")
+		}
+		length, err := strconv.Atoi(string(header[:space]))
+		if err != nil || length <= space+1 || length > len(header) || header[length-1] != '\n' {
+			return 0, fmt.Errorf("Malformed pax header in the tarball")
+		}
+		record := string(header[space+1 : length-1])
+		header = header[length:]
+		if !strings.HasPrefix(record, "size=") {
+			continue
+		}
+		size, err = strconv.ParseInt(strings.TrimPrefix(record, "size="), 10, 64)
+		if err != nil || size < 0 {
+			return 0, fmt.Errorf("Malformed size %q in the pax header of the tarball", record)
+		}
+	}
+	return size, nil
+}
+
+// streamCheck runs a check on the stream in its own goroutine
+type streamCheck struct {
+	pipe   *io.PipeWriter
+	result chan error
+}
+
+func startStreamCheck(check func(io.Reader) error) streamCheck {
+	r, w := io.Pipe()
+	c := streamCheck{pipe: w, result: make(chan error, 1)}
+	go func() {
+		err := check(r)
+		// whatever the check did not read, like the padding after the
+		// end of the tarball, must be consumed to not block the stream
+		io.Copy(ioutil.Discard, r)
+		c.result <- err
+	}()
+	return c
+}
+
+type S3StreamingFile struct {
+	S3Object
+}
+
+func (s3streaming S3StreamingFile) Validate() IS3LocalFile {
+	return s3streaming
+}
+
+func (s3streaming S3StreamingFile) Ingest() IS3IngestedFile {
+	cvmfsPath := ingestBaseDir(s3streaming.cvmfsPath)
+	repo := s3streaming.cvmfsRepo
+
+	tagName, tagDescription, err := s3streaming.TagFor(time.Now())
+	if err != nil {
+		return NewErrorWithStatus(s3streaming.S3Object, err)
+	}
+	expected, err := s3streaming.ExpectedChecksums()
+	if err != nil {
+		return NewErrorWithStatus(s3streaming.S3Object, err)
+	}
+	var signature []byte
+	if s3streaming.config.Signature.Enabled() {
+		signature, err = s3streaming.FetchSignature()
+		if err != nil {
+			return s3streaming.failure(err)
+		}
+	}
+
+	ingesting := NewStatusReport(s3streaming.S3Object, "INGESTING")
+	ingesting.Tag = tagName
+	s3streaming.ReportStatusReport(ingesting)
+
+	err = func() error {
+		repo.Lock.LockWithPriority(s3streaming.priority)
+		defer repo.Lock.Unlock()
+
+		unchanged, err := s3streaming.isUnchanged()
+		if err != nil {
+			return err
+		}
+		if !unchanged {
+			return errObjectChanged
+		}
+
+		return s3streaming.stream(expected, signature, cvmfsPath, tagName, tagDescription)
+	}()
+
+	if err == errObjectChanged {
+		// nothing on disk to remove
+		return ErrorObjectChanged{S3Object: s3streaming.S3Object}
+	}
+	if err != nil {
+		return s3streaming.failure(err)
+	}
+
+	s3streaming.UploadStatusReport(NewSuccessReport(s3streaming.S3Object, publishedTag(repo.Name, tagName)))
+
+	return S3IngestedFile{s3streaming.S3Object, ""}
+}
+
+func (s3streaming S3StreamingFile) failure(err error) ErrorWithStatus {
+	failure := NewErrorWithStatus(s3streaming.S3Object, err)
+	switch e := err.(type) {
+	case ChecksumMismatch:
+		failure.details = e.Details()
+	case SignatureError:
+		failure.details = e.Details()
+	case TarViolations:
+		failure.details = e.Details()
+	}
+	return failure
+}
+
+// stream pipes the object into the ingestion, running all the checks on the
+// way, the ingestion is completed only if all of them pass
+func (s3streaming S3StreamingFile) stream(expected []ExpectedChecksum, signature []byte,
+	cvmfsPath, tagName, tagDescription string) error {
+
+	object, err := s3.New(s3streaming.session).GetObject(&s3.GetObjectInput{
+		Bucket:  &s3streaming.bucket,
+		Key:     &s3streaming.key,
+		IfMatch: aws.String(s3streaming.etag),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "PreconditionFailed" {
+			return errObjectChanged
+		}
+		return fmt.Errorf("Error in reading the object from S3: %s", err)
+	}
+	defer object.Body.Close()
+
+	ingestion, err := cvmfs.StartStreamingIngest(s3streaming.cvmfsRepo.Name,
+		cvmfsPath, tagName, tagDescription)
+	if err != nil {
+		return fmt.Errorf("Error in starting the ingestion: %s", err)
+	}
+
+	tarCheck := startStreamCheck(func(r io.Reader) error {
+		violations, err := ValidateTar(s3streaming.config.TarPolicy, r)
+		if err == nil && !violations.Empty() {
+			err = violations
+		}
+		return err
+	})
+	checks := []streamCheck{tarCheck}
+	if signature != nil {
+		checks = append(checks, startStreamCheck(func(r io.Reader) error {
+			_, err := s3streaming.VerifySignatureOf(r, signature)
+			return err
+		}))
+	}
+
+	digests := NewDigests()
+	held := newTarEndWriter(ingestion)
+	writers := []io.Writer{digests, held}
+	for _, check := range checks {
+		writers = append(writers, check.pipe)
+	}
+
+	_, copyErr := io.Copy(io.MultiWriter(writers...), object.Body)
+	for _, check := range checks {
+		check.pipe.CloseWithError(copyErr)
+	}
+
+	failure := copyErr
+	if failure != nil {
+		failure = fmt.Errorf("Error in streaming the object into the ingestion: %s", copyErr)
+	}
+	for _, check := range checks {
+		if err := <-check.result; err != nil && failure == nil {
+			failure = err
+		}
+	}
+	if failure == nil {
+		failure = digests.Verify(expected)
+	}
+
+	if failure != nil {
+		return abortIngestion(ingestion, failure)
+	}
+
+	if err := held.Flush(); err != nil {
+		return abortIngestion(ingestion,
+			fmt.Errorf("Error in streaming the object into the ingestion: %s", err))
+	}
+	if err := ingestion.Finish(); err != nil {
+		return fmt.Errorf("Error in the ingestion: %s", err)
+	}
+	return nil
+}
+
+// abortIngestion aborts the ingestion because of failure, if the ingestion
+// could not be aborted the error says so
+func abortIngestion(ingestion *cvmfs.StreamingIngest, failure error) error {
+	err := ingestion.Abort()
+	if err == nil {
+		return failure
+	}
+	log.LogE(err).Error("Error in aborting the streaming ingestion")
+	return fmt.Errorf("%s, and the ingestion could not be aborted: %s", failure, err)
+}
@@ -0,0 +1,137 @@
+package lib
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestTarEndWriter(t *testing.T) {
+	tarball := makeTar(t,
+		tar.Header{Name: "dir", Typeflag: tar.TypeDir},
+		// a file of zeros is not the end of the tarball
+		file("dir/zeros", 3000),
+		tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "dir/zeros"},
+		// the long name needs a pax header
+		file(strings.Repeat("long/", 30)+"file", 10),
+		file("empty", 0),
+	).Bytes()
+	marker := len(tarball) - 2*tarBlockSize
+
+	tests := []struct {
+		name     string
+		trailing []byte
+		chunks   []int
+		err      bool
+	}{
+		{"whole", nil, []int{len(tarball)}, false},
+		{"byte by byte", nil, []int{1}, false},
+		{"odd chunks", nil, []int{7, 511, 1300}, false},
+		{"padding", make([]byte, 10*tarBlockSize), []int{4096}, false},
+		{"trailing data", append(make([]byte, 3*tarBlockSize), []byte("tarball")...), []int{100}, true},
+		{"trailing data far away", append(make([]byte, 4<<20), 1), []int{1 << 16}, true},
+	}
+	for _, test := range tests {
+		content := append(append([]byte{}, tarball...), test.trailing...)
+		var out bytes.Buffer
+		w := newTarEndWriter(&out)
+		var err error
+		for i, written := 0, 0; written < len(content) && err == nil; i++ {
+			size := test.chunks[i%len(test.chunks)]
+			if written+size > len(content) {
+				size = len(content) - written
+			}
+			_, err = w.Write(content[written : written+size])
+			written += size
+		}
+		if (err != nil) != test.err {
+			t.Errorf("%s: expected error %t, got %v", test.name, test.err, err)
+			continue
+		}
+		if !bytes.Equal(out.Bytes(), tarball[:marker]) {
+			t.Errorf("%s: expected the %d bytes before the end-of-archive marker forwarded, got %d",
+				test.name, marker, out.Len())
+		}
+		if test.err {
+			continue
+		}
+		if err := w.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out.Bytes(), tarball) {
+			t.Errorf("%s: expected the whole tarball after the flush, got %d bytes", test.name, out.Len())
+		}
+	}
+}
+
+func TestTarEndWriterPaxSize(t *testing.T) {
+	// a pax header overrides the size of the next entry, here 1024 bytes
+	// of zeros that would otherwise look like the end of the tarball
+	pax := "13 size=1024\n"
+	var content bytes.Buffer
+	header := func(typeflag byte, size int) {
+		block := make([]byte, tarBlockSize)
+		copy(block, "entry")
+		copy(block[124:], fmt.Sprintf("%011o", size))
+		block[156] = typeflag
+		content.Write(block)
+	}
+	header(tar.TypeXHeader, len(pax))
+	content.WriteString(pax)
+	content.Write(make([]byte, tarBlockSize-len(pax)))
+	header(tar.TypeReg, 0)
+	content.Write(make([]byte, 1024))
+	header(tar.TypeReg, 1)
+	content.Write(append([]byte{1}, make([]byte, tarBlockSize-1)...))
+	forwarded := content.Len()
+	content.Write(make([]byte, 2*tarBlockSize))
+
+	var out bytes.Buffer
+	w := newTarEndWriter(&out)
+	if _, err := w.Write(content.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if out.Len() != forwarded {
+		t.Errorf("expected %d bytes forwarded, got %d", forwarded, out.Len())
+	}
+}
+
+func TestTarHeaderSize(t *testing.T) {
+	tests := []struct {
+		field []byte
+		size  int64
+		err   bool
+	}{
+		{[]byte("00000001750\x00"), 1000, false},
+		{[]byte("     1750 \x00\x00"), 1000, false},
+		{make([]byte, 12), 0, false},
+		{append([]byte{0x80}, append(make([]byte, 7), 0, 0, 1, 0)...), 256, false},
+		{append([]byte{0xff}, make([]byte, 11)...), 0, true},
+		{[]byte("0000000175x\x00"), 0, true},
+	}
+	for _, test := range tests {
+		size, err := tarHeaderSize(test.field)
+		if (err != nil) != test.err || size != test.size {
+			t.Errorf("%q: expected %d error %t, got %d %v", test.field, test.size, test.err, size, err)
+		}
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("broken pipe")
+}
+
+func TestTarEndWriterError(t *testing.T) {
+	w := newTarEndWriter(failingWriter{})
+	if _, err := w.Write([]byte("abc")); err != nil {
+		t.Errorf("nothing should be forwarded yet, got %s", err)
+	}
+	if _, err := w.Write(makeTar(t, file("a", 1)).Bytes()); err == nil {
+		t.Errorf("expected the error of the writer")
+	}
+}
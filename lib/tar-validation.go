@@ -0,0 +1,187 @@
+package lib
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// TarPolicy describes what a tarball must respect to be ingested.
+//
+// Absolute paths, paths with .. segments and hardlinks pointing outside of
+// the tarball are always rejected, the limits set to zero are not enforced.
+type TarPolicy struct {
+	MaxFiles int64 `toml:"max-files"`
+	// maximum uncompressed size of the content, in bytes
+	MaxSize int64 `toml:"max-size"`
+	// one of: "symlink", "hardlink", "device", "fifo", "setuid", "setgid"
+	ForbiddenTypes []string `toml:"forbidden-types"`
+	// regexes matched against the paths of the entries
+	ForbiddenPaths []string `toml:"forbidden-paths"`
+
+	forbiddenPaths []*regexp.Regexp
+}
+
+var DefaultForbiddenTypes = []string{"device", "setuid", "setgid"}
+
+var knownEntryTypes = map[string]bool{
+	"symlink":  true,
+	"hardlink": true,
+	"device":   true,
+	"fifo":     true,
+	"setuid":   true,
+	"setgid":   true,
+}
+
+// maximum number of violations reported in the status file
+const maxReportedViolations = 50
+
+func (policy *TarPolicy) Validate() error {
+	if policy.ForbiddenTypes == nil {
+		policy.ForbiddenTypes = DefaultForbiddenTypes
+	}
+	for _, t := range policy.ForbiddenTypes {
+		if !knownEntryTypes[t] {
+			return fmt.Errorf("Unknown type of entry in forbidden-types: %s", t)
+		}
+	}
+	policy.forbiddenPaths = nil
+	for _, p := range policy.ForbiddenPaths {
+		regex, err := regexp.Compile(p)
+		if err != nil {
+			return fmt.Errorf("Invalid regex in forbidden-paths %s: %s", p, err)
+		}
+		policy.forbiddenPaths = append(policy.forbiddenPaths, regex)
+	}
+	return nil
+}
+
+func (policy TarPolicy) forbids(entryType string) bool {
+	for _, t := range policy.ForbiddenTypes {
+		if t == entryType {
+			return true
+		}
+	}
+	return false
+}
+
+// TarViolations collects what is wrong in a tarball
+type TarViolations struct {
+	violations []string
+	total      int
+}
+
+func (v *TarViolations) add(format string, args ...interface{}) {
+	v.total++
+	if len(v.violations) < maxReportedViolations {
+		v.violations = append(v.violations, fmt.Sprintf(format, args...))
+	}
+}
+
+func (v TarViolations) Empty() bool {
+	return v.total == 0
+}
+
+func (v TarViolations) Error() string {
+	return fmt.Sprintf("The tarball violates the policy %d times", v.total)
+}
+
+// Details are meant to be reported in the FAILURE status
+func (v TarViolations) Details() map[string]string {
+	details := make(map[string]string)
+	for i, violation := range v.violations {
+		details[fmt.Sprintf("violation-%03d", i+1)] = violation
+	}
+	if v.total > len(v.violations) {
+		details["truncated"] = fmt.Sprintf("%d more violations not reported",
+			v.total-len(v.violations))
+	}
+	return details
+}
+
+// ValidateTarFile opens the tarball at path and checks it against the policy
+func ValidateTarFile(policy TarPolicy, tarPath string) (TarViolations, error) {
+	f, err := os.Open(tarPath)
+	if err != nil {
+		return TarViolations{}, err
+	}
+	defer f.Close()
+	return ValidateTar(policy, f)
+}
+
+// ValidateTar reads the whole tarball and checks every entry against the
+// policy, the error is returned only if the tarball cannot be read
+func ValidateTar(policy TarPolicy, r io.Reader) (TarViolations, error) {
+	violations := TarViolations{}
+	tr := tar.NewReader(r)
+
+	seen := make(map[string]bool)
+	var files, size int64
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return violations, fmt.Errorf("Error in reading the tarball: %s", err)
+		}
+		name := header.Name
+		files++
+		size += header.Size
+
+		if strings.HasPrefix(name, "/") {
+			violations.add("%s: absolute path", name)
+		}
+		if hasDotDotSegment(name) {
+			violations.add("%s: path with .. segment", name)
+		}
+		for _, regex := range policy.forbiddenPaths {
+			if regex.MatchString(name) {
+				violations.add("%s: path matches the forbidden pattern %s", name, regex)
+			}
+		}
+
+		switch header.Typeflag {
+		case tar.TypeSymlink:
+			if policy.forbids("symlink") {
+				violations.add("%s: symlink not allowed", name)
+			}
+		case tar.TypeLink:
+			if policy.forbids("hardlink") {
+				violations.add("%s: hardlink not allowed", name)
+			}
+			target := header.Linkname
+			if strings.HasPrefix(target, "/") || hasDotDotSegment(target) ||
+				!seen[path.Clean(target)] {
+				violations.add("%s: hardlink to %s outside of the tarball", name, target)
+			}
+		case tar.TypeChar, tar.TypeBlock:
+			if policy.forbids("device") {
+				violations.add("%s: device node not allowed", name)
+			}
+		case tar.TypeFifo:
+			if policy.forbids("fifo") {
+				violations.add("%s: fifo not allowed", name)
+			}
+		}
+		if header.Mode&04000 != 0 && policy.forbids("setuid") {
+			violations.add("%s: setuid bit not allowed", name)
+		}
+		if header.Mode&02000 != 0 && policy.forbids("setgid") {
+			violations.add("%s: setgid bit not allowed", name)
+		}
+		seen[path.Clean(name)] = true
+	}
+
+	if policy.MaxFiles > 0 && files > policy.MaxFiles {
+		violations.add("%d entries, more than the maximum of %d", files, policy.MaxFiles)
+	}
+	if policy.MaxSize > 0 && size > policy.MaxSize {
+		violations.add("%d bytes uncompressed, more than the maximum of %d", size, policy.MaxSize)
+	}
+	return violations, nil
+}
@@ -0,0 +1,121 @@
+package lib
+
+import (
+	"archive/tar"
+	"bytes"
+	"testing"
+)
+
+// makeTar builds an in memory tarball with the headers provided, the regular
+// files get Size bytes of content
+func makeTar(t *testing.T, headers ...tar.Header) *bytes.Buffer {
+	var buffer bytes.Buffer
+	w := tar.NewWriter(&buffer)
+	for _, header := range headers {
+		header := header
+		if header.Mode == 0 {
+			header.Mode = 0644
+		}
+		if err := w.WriteHeader(&header); err != nil {
+			t.Fatalf("Error in writing the header of %s: %s", header.Name, err)
+		}
+		if header.Typeflag == tar.TypeReg && header.Size > 0 {
+			w.Write(make([]byte, header.Size))
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Error in closing the tarball: %s", err)
+	}
+	return &buffer
+}
+
+func file(name string, size int64) tar.Header {
+	return tar.Header{Name: name, Typeflag: tar.TypeReg, Size: size}
+}
+
+func TestValidateTar(t *testing.T) {
+	tests := []struct {
+		name       string
+		policy     TarPolicy
+		headers    []tar.Header
+		violations int
+	}{
+		{"clean", TarPolicy{}, []tar.Header{file("a/b", 10), file("a/c", 0)}, 0},
+		{"absolute path", TarPolicy{}, []tar.Header{file("/etc/passwd", 1)}, 1},
+		{"dot dot", TarPolicy{}, []tar.Header{file("a/../../b", 1)}, 1},
+		{"symlink allowed", TarPolicy{},
+			[]tar.Header{{Name: "l", Typeflag: tar.TypeSymlink, Linkname: "/etc"}}, 0},
+		{"symlink forbidden", TarPolicy{ForbiddenTypes: []string{"symlink"}},
+			[]tar.Header{{Name: "l", Typeflag: tar.TypeSymlink, Linkname: "a"}}, 1},
+		{"hardlink inside", TarPolicy{},
+			[]tar.Header{file("a", 1), {Name: "b", Typeflag: tar.TypeLink, Linkname: "a"}}, 0},
+		{"hardlink outside", TarPolicy{},
+			[]tar.Header{{Name: "b", Typeflag: tar.TypeLink, Linkname: "/etc/shadow"}}, 1},
+		{"hardlink before target", TarPolicy{},
+			[]tar.Header{{Name: "b", Typeflag: tar.TypeLink, Linkname: "a"}, file("a", 1)}, 1},
+		{"device", TarPolicy{},
+			[]tar.Header{{Name: "dev", Typeflag: tar.TypeChar, Devmajor: 1, Devminor: 3}}, 1},
+		{"fifo allowed by default", TarPolicy{},
+			[]tar.Header{{Name: "p", Typeflag: tar.TypeFifo}}, 0},
+		{"setuid", TarPolicy{},
+			[]tar.Header{{Name: "s", Typeflag: tar.TypeReg, Mode: 04755}}, 1},
+		{"too many files", TarPolicy{MaxFiles: 2},
+			[]tar.Header{file("a", 0), file("b", 0), file("c", 0)}, 1},
+		{"too large", TarPolicy{MaxSize: 10}, []tar.Header{file("a", 6), file("b", 6)}, 1},
+		{"forbidden path", TarPolicy{ForbiddenPaths: []string{`\.git/`}},
+			[]tar.Header{file("repo/.git/config", 1), file("repo/src", 1)}, 1},
+	}
+	for _, test := range tests {
+		policy := test.policy
+		if err := policy.Validate(); err != nil {
+			t.Fatalf("%s: invalid policy: %s", test.name, err)
+		}
+		violations, err := ValidateTar(policy, makeTar(t, test.headers...))
+		if err != nil {
+			t.Errorf("%s: ValidateTar failed: %s", test.name, err)
+			continue
+		}
+		if violations.total != test.violations {
+			t.Errorf("%s: %d violations %v, expected %d",
+				test.name, violations.total, violations.violations, test.violations)
+		}
+	}
+}
+
+func TestValidateTarNotATarball(t *testing.T) {
+	if _, err := ValidateTar(TarPolicy{}, bytes.NewBufferString("not a tarball at all")); err == nil {
+		t.Errorf("ValidateTar accepted garbage")
+	}
+}
+
+func TestTarViolationsDetails(t *testing.T) {
+	violations := TarViolations{}
+	for i := 0; i < maxReportedViolations+5; i++ {
+		violations.add("violation %d", i)
+	}
+	details := violations.Details()
+	if len(details) != maxReportedViolations+1 {
+		t.Errorf("%d details, expected %d", len(details), maxReportedViolations+1)
+	}
+	if details["truncated"] != "5 more violations not reported" {
+		t.Errorf("Wrong truncated detail: %q", details["truncated"])
+	}
+}
+
+func TestTarPolicyValidate(t *testing.T) {
+	tests := []struct {
+		policy TarPolicy
+		valid  bool
+	}{
+		{TarPolicy{}, true},
+		{TarPolicy{ForbiddenTypes: []string{"symlink", "fifo"}}, true},
+		{TarPolicy{ForbiddenTypes: []string{"socket"}}, false},
+		{TarPolicy{ForbiddenPaths: []string{"("}}, false},
+	}
+	for _, test := range tests {
+		err := test.policy.Validate()
+		if (err == nil) != test.valid {
+			t.Errorf("Validate(%+v) = %v, expected valid %v", test.policy, err, test.valid)
+		}
+	}
+}
@@ -0,0 +1,273 @@
+package lib
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cvmfs/portals/log"
+)
+
+/*
+The webhook receives the S3 event notifications of the buckets, so that new
+objects are ingested without waiting for the next full listing.
+
+It accepts the event format of AWS and minio, either posted directly or
+wrapped into an SNS notification, and it confirms the SNS subscriptions.
+Only the ObjectCreated events are considered.
+
+The notifications are handed to a fixed number of workers through a bounded
+queue, when the queue is full the webhook answers 503 and the sender retries
+later. The objects still in their quiet period are tried again a few times,
+then they are left to the next listing.
+*/
+
+// maximum size of a notification we accept
+const maxNotificationSize = 1 << 20
+
+const (
+	// notifications waiting for the workers, and objects waiting for their
+	// quiet period, at most
+	webhookQueueSize = 1024
+	webhookWorkers   = 4
+	// times an object in its quiet period is tried again
+	maxNotificationRetries = 3
+)
+
+var errWebhookBusy = fmt.Errorf("Too many notifications, try again later")
+
+type WebhookConfig struct {
+	// address where the webhook listens, like ":8080", the webhook is
+	// disabled if it is empty
+	Listen string `toml:"listen"`
+	// path of the webhook, by default /events
+	Path string `toml:"path"`
+	// the notifications must carry it in the Authorization header, either
+	// as is, with "Bearer ", or as the password of the basic authentication,
+	// it is required when the webhook is enabled
+	Token string `toml:"token"`
+}
+
+func (c WebhookConfig) Enabled() bool {
+	return c.Listen != ""
+}
+
+type s3Event struct {
+	Records []struct {
+		EventName string `json:"eventName"`
+		S3        struct {
+			Bucket struct {
+				Name string `json:"name"`
+			} `json:"bucket"`
+			Object struct {
+				Key string `json:"key"`
+			} `json:"object"`
+		} `json:"s3"`
+	} `json:"Records"`
+}
+
+type snsMessage struct {
+	Type         string `json:"Type"`
+	Message      string `json:"Message"`
+	SubscribeURL string `json:"SubscribeURL"`
+}
+
+// notification is an object created in the bucket of the portal
+type notification struct {
+	portal  *Portal
+	key     string
+	retries int
+}
+
+type WebhookReceiver struct {
+	config WebhookConfig
+	queue  chan notification
+
+	mutex   sync.RWMutex
+	portals map[string][]*Portal
+	// notifications waiting for the quiet period of their object
+	delayed int
+}
+
+func NewWebhookReceiver(config WebhookConfig) *WebhookReceiver {
+	return &WebhookReceiver{
+		config:  config,
+		queue:   make(chan notification, webhookQueueSize),
+		portals: make(map[string][]*Portal),
+	}
+}
+
+// Register routes the notifications of the bucket of the portal to it
+func (r *WebhookReceiver) Register(p *Portal) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.portals[p.Bucket()] = append(r.portals[p.Bucket()], p)
+}
+
+func (r *WebhookReceiver) ListenAndServe() error {
+	path := r.config.Path
+	if path == "" {
+		path = "/events"
+	}
+	for i := 0; i < webhookWorkers; i++ {
+		go r.work()
+	}
+	mux := http.NewServeMux()
+	mux.Handle(path, r)
+	log.Log().WithField("listen", r.config.Listen).WithField("path", path).Info("Webhook listening")
+	return http.ListenAndServe(r.config.Listen, mux)
+}
+
+// work hands the notifications to their portal
+func (r *WebhookReceiver) work() {
+	for n := range r.queue {
+		wait := n.portal.ObjectCreated(n.key)
+		if wait > 0 {
+			r.retry(n, wait)
+		}
+	}
+}
+
+// retry queues the notification again once the quiet period of its object is
+// over, at most maxNotificationRetries times and while there is room
+func (r *WebhookReceiver) retry(n notification, wait time.Duration) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if n.retries >= maxNotificationRetries || r.delayed >= webhookQueueSize {
+		n.portal.retryAtNextListing(n.key)
+		return
+	}
+	r.delayed++
+	n.retries++
+	time.AfterFunc(wait, func() {
+		r.mutex.Lock()
+		r.delayed--
+		r.mutex.Unlock()
+		if !r.push(n) {
+			n.portal.retryAtNextListing(n.key)
+		}
+	})
+}
+
+// push queues the notification, it is false if the queue is full
+func (r *WebhookReceiver) push(n notification) bool {
+	select {
+	case r.queue <- n:
+		return true
+	default:
+		return false
+	}
+}
+
+func (r *WebhookReceiver) authorized(req *http.Request) bool {
+	if r.config.Token == "" {
+		return false
+	}
+	header := req.Header.Get("Authorization")
+	candidates := []string{header, strings.TrimPrefix(header, "Bearer ")}
+	if _, password, ok := req.BasicAuth(); ok {
+		candidates = append(candidates, password)
+	}
+	for _, candidate := range candidates {
+		if subtle.ConstantTimeCompare([]byte(candidate), []byte(r.config.Token)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *WebhookReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "Only POST is accepted", http.StatusMethodNotAllowed)
+		return
+	}
+	if !r.authorized(req) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, maxNotificationSize))
+	if err != nil {
+		http.Error(w, "Error in reading the notification", http.StatusBadRequest)
+		return
+	}
+	if err = r.handle(body); err == errWebhookBusy {
+		log.LogE(err).Warning("Notification refused, the queue is full")
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		log.LogE(err).Error("Error in handling the notification")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (r *WebhookReceiver) handle(body []byte) error {
+	var sns snsMessage
+	if err := json.Unmarshal(body, &sns); err != nil {
+		return fmt.Errorf("The notification is not JSON: %s", err)
+	}
+	switch sns.Type {
+	case "SubscriptionConfirmation":
+		return confirmSubscription(sns.SubscribeURL)
+	case "Notification":
+		body = []byte(sns.Message)
+	}
+
+	var event s3Event
+	if err := json.Unmarshal(body, &event); err != nil {
+		return fmt.Errorf("The notification is not an S3 event: %s", err)
+	}
+	for _, record := range event.Records {
+		// "ObjectCreated:Put" from AWS, "s3:ObjectCreated:Put" from minio
+		if !strings.Contains(record.EventName, "ObjectCreated:") {
+			continue
+		}
+		// the keys are URL encoded in the events
+		key, err := url.QueryUnescape(record.S3.Object.Key)
+		if err != nil {
+			return fmt.Errorf("Malformed key %s: %s", record.S3.Object.Key, err)
+		}
+
+		r.mutex.RLock()
+		portals := r.portals[record.S3.Bucket.Name]
+		r.mutex.RUnlock()
+		if len(portals) == 0 {
+			log.Log().WithField("bucket", record.S3.Bucket.Name).Info("Notification for a bucket without portal")
+		}
+		for _, p := range portals {
+			if !r.push(notification{portal: p, key: key}) {
+				return errWebhookBusy
+			}
+		}
+	}
+	return nil
+}
+
+// confirmSubscription confirms the SNS subscription of the webhook, only
+// the URLs of AWS are followed
+func confirmSubscription(subscribeURL string) error {
+	u, err := url.Parse(subscribeURL)
+	if err != nil || u.Scheme != "https" || !strings.HasSuffix(u.Hostname(), ".amazonaws.com") {
+		return fmt.Errorf("Refusing to confirm the subscription at %s", subscribeURL)
+	}
+	resp, err := http.Get(subscribeURL)
+	if err != nil {
+		return fmt.Errorf("Error in confirming the subscription: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Error in confirming the subscription: %s", resp.Status)
+	}
+	log.Log().WithField("url", subscribeURL).Info("SNS subscription confirmed")
+	return nil
+}
@@ -0,0 +1,274 @@
+package lib
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testPortal(bucket string) *Portal {
+	return &Portal{
+		config:   &BucketConfiguration{},
+		couple:   S3BucketCouple{Data: S3Bucket{BucketName: bucket}},
+		lister:   NewIncrementalLister(S3Bucket{BucketName: bucket}, time.Hour),
+		inFlight: make(map[string]bool),
+	}
+}
+
+func TestWebhookAuthorized(t *testing.T) {
+	tests := []struct {
+		name       string
+		token      string
+		header     string
+		basic      []string
+		query      string
+		authorized bool
+	}{
+		{"bearer", "secret-token", "Bearer secret-token", nil, "", true},
+		{"as is", "secret-token", "secret-token", nil, "", true},
+		{"basic", "secret-token", "", []string{"sns", "secret-token"}, "", true},
+		{"wrong bearer", "secret-token", "Bearer other", nil, "", false},
+		{"wrong basic", "secret-token", "", []string{"secret-token", "other"}, "", false},
+		{"no header", "secret-token", "", nil, "", false},
+		{"query parameter", "secret-token", "", nil, "?token=secret-token", false},
+		{"no token configured", "", "", nil, "", false},
+		{"empty bearer without token configured", "", "Bearer ", nil, "", false},
+	}
+	for _, test := range tests {
+		r := NewWebhookReceiver(WebhookConfig{Listen: ":0", Token: test.token})
+		req := httptest.NewRequest(http.MethodPost, "/events"+test.query, nil)
+		if test.header != "" {
+			req.Header.Set("Authorization", test.header)
+		}
+		if test.basic != nil {
+			req.SetBasicAuth(test.basic[0], test.basic[1])
+		}
+		if authorized := r.authorized(req); authorized != test.authorized {
+			t.Errorf("%s: expected authorized %t, got %t", test.name, test.authorized, authorized)
+		}
+	}
+}
+
+func s3EventBody(bucket string, events ...string) string {
+	records := []map[string]interface{}{}
+	for i := 0; i < len(events); i += 2 {
+		records = append(records, map[string]interface{}{
+			"eventName": events[i],
+			"s3": map[string]interface{}{
+				"bucket": map[string]string{"name": bucket},
+				"object": map[string]string{"key": events[i+1]},
+			},
+		})
+	}
+	body, _ := json.Marshal(map[string]interface{}{"Records": records})
+	return string(body)
+}
+
+func TestWebhookHandle(t *testing.T) {
+	sns, _ := json.Marshal(map[string]string{
+		"Type":    "Notification",
+		"Message": s3EventBody("data", "ObjectCreated:Put", "sns.tar"),
+	})
+	tests := []struct {
+		name string
+		body string
+		// keys queued, in order
+		queued string
+		err    bool
+	}{
+		{"aws", s3EventBody("data", "ObjectCreated:Put", "a.tar"), "a.tar", false},
+		{"minio", s3EventBody("data", "s3:ObjectCreated:CompleteMultipartUpload", "b.tar"), "b.tar", false},
+		{"sns", string(sns), "sns.tar", false},
+		{"encoded key", s3EventBody("data", "ObjectCreated:Put", "dir/a+b%2Bc.tar"), "dir/a b+c.tar", false},
+		{"removed", s3EventBody("data", "ObjectRemoved:Delete", "a.tar"), "", false},
+		{"many records", s3EventBody("data", "ObjectCreated:Put", "a.tar", "ObjectRemoved:Delete", "b.tar",
+			"ObjectCreated:Copy", "c.tar"), "a.tar,c.tar", false},
+		{"bucket without portal", s3EventBody("other", "ObjectCreated:Put", "a.tar"), "", false},
+		{"malformed key", s3EventBody("data", "ObjectCreated:Put", "%zz.tar"), "", true},
+		{"not json", "<xml/>", "", true},
+		{"wrong records", `{"Records": 1}`, "", true},
+	}
+	for _, test := range tests {
+		r := NewWebhookReceiver(WebhookConfig{Listen: ":0", Token: "token"})
+		p := testPortal("data")
+		r.Register(p)
+
+		err := r.handle([]byte(test.body))
+		if (err != nil) != test.err {
+			t.Errorf("%s: expected error %t, got %v", test.name, test.err, err)
+		}
+		close(r.queue)
+		queued := []string{}
+		for n := range r.queue {
+			if n.portal != p {
+				t.Errorf("%s: notification for the wrong portal", test.name)
+			}
+			queued = append(queued, n.key)
+		}
+		if strings.Join(queued, ",") != test.queued {
+			t.Errorf("%s: expected %q to be queued, got %q", test.name, test.queued, queued)
+		}
+	}
+}
+
+func TestWebhookServeHTTP(t *testing.T) {
+	event := s3EventBody("data", "ObjectCreated:Put", "a.tar")
+	tests := []struct {
+		name   string
+		method string
+		auth   string
+		body   string
+		// notifications already in the queue
+		queued int
+		status int
+	}{
+		{"accepted", http.MethodPost, "Bearer token", event, 0, http.StatusOK},
+		{"get", http.MethodGet, "Bearer token", "", 0, http.StatusMethodNotAllowed},
+		{"unauthorized", http.MethodPost, "Bearer other", event, 0, http.StatusUnauthorized},
+		{"malformed", http.MethodPost, "Bearer token", "{", 0, http.StatusBadRequest},
+		{"queue full", http.MethodPost, "Bearer token", event, webhookQueueSize, http.StatusServiceUnavailable},
+	}
+	for _, test := range tests {
+		r := NewWebhookReceiver(WebhookConfig{Listen: ":0", Token: "token"})
+		p := testPortal("data")
+		r.Register(p)
+		for i := 0; i < test.queued; i++ {
+			r.queue <- notification{portal: p, key: "queued.tar"}
+		}
+
+		req := httptest.NewRequest(test.method, "/events", strings.NewReader(test.body))
+		req.Header.Set("Authorization", test.auth)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != test.status {
+			t.Errorf("%s: expected the status %d, got %d", test.name, test.status, w.Code)
+		}
+	}
+}
+
+func TestWebhookRetry(t *testing.T) {
+	tests := []struct {
+		name    string
+		retries int
+		delayed int
+		queued  bool
+	}{
+		{"first retry", 0, 0, true},
+		{"last retry", maxNotificationRetries - 1, 0, true},
+		{"too many retries", maxNotificationRetries, 0, false},
+		{"too many delayed", 0, webhookQueueSize, false},
+	}
+	for _, test := range tests {
+		r := NewWebhookReceiver(WebhookConfig{Listen: ":0", Token: "token"})
+		r.delayed = test.delayed
+		p := testPortal("data")
+		p.lister.seen["a.tar"] = "fingerprint"
+
+		r.retry(notification{portal: p, key: "a.tar", retries: test.retries}, time.Millisecond)
+		select {
+		case n := <-r.queue:
+			if !test.queued {
+				t.Errorf("%s: queued again", test.name)
+			} else if n.retries != test.retries+1 {
+				t.Errorf("%s: expected %d retries, got %d", test.name, test.retries+1, n.retries)
+			}
+		case <-time.After(100 * time.Millisecond):
+			if test.queued {
+				t.Errorf("%s: not queued again", test.name)
+			}
+		}
+		_, seen := p.lister.seen["a.tar"]
+		if seen == !test.queued {
+			t.Errorf("%s: expected the object to be left to the next listing %t", test.name, !test.queued)
+		}
+	}
+}
+
+func TestObjectCreated(t *testing.T) {
+	stable := map[string]string{
+		"ETag": `"etag"`, "Last-Modified": time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)}
+	const ownerACL = `<AccessControlPolicy><Owner><ID>uploader</ID></Owner></AccessControlPolicy>`
+	tests := []struct {
+		name string
+		key  string
+		// headers of the HEAD of the object, nil for a 404
+		headers map[string]string
+		// rules that depend on the owner, and the ACL of the object, empty
+		// for an error
+		ownerRules bool
+		acl        string
+		enqueued   bool
+		wait       bool
+		// the object is left to the next listing
+		forgotten bool
+	}{
+		{"stable", "a.tar", stable, false, "", true, false, false},
+		{"quiet period", "a.tar", map[string]string{
+			"ETag": `"etag"`, "Last-Modified": time.Now().UTC().Format(http.TimeFormat)}, false, "", false, true, false},
+		{"without Last-Modified", "a.tar", map[string]string{"ETag": `"etag"`}, false, "", true, false, false},
+		{"not a tarball", "a.txt", stable, false, "", false, false, false},
+		{"missing", "a.tar", nil, false, "", false, false, false},
+		{"owner from the ACL", "a.tar", stable, true, ownerACL, true, false, false},
+		{"ACL unreadable", "a.tar", stable, true, "", false, false, true},
+		{"ACL without owner", "a.tar", stable, true, `<AccessControlPolicy></AccessControlPolicy>`, false, false, true},
+	}
+	for _, test := range tests {
+		sess, stop := fakeS3(t, func(w http.ResponseWriter, r *http.Request) {
+			_, acl := r.URL.Query()["acl"]
+			switch {
+			case r.URL.Path != "/data/"+test.key:
+				s3Error(w, http.StatusBadRequest, "UnexpectedRequest")
+			case acl && r.Method == http.MethodGet && test.acl != "":
+				w.Write([]byte(test.acl))
+			case acl:
+				s3Error(w, http.StatusForbidden, "AccessDenied")
+			case r.Method != http.MethodHead:
+				s3Error(w, http.StatusBadRequest, "UnexpectedRequest")
+			case test.headers == nil:
+				w.WriteHeader(http.StatusNotFound)
+			default:
+				for key, value := range test.headers {
+					w.Header().Set(key, value)
+				}
+				w.Header().Set("Content-Length", "10")
+			}
+		})
+		input := make(chan PipelineInput, 1)
+		p := testPortal("data")
+		p.config.QuietPeriod = Duration{time.Minute}
+		if test.ownerRules {
+			p.config.ACL = []ACLRule{{Owner: "uploader", Paths: []string{"/"}}}
+		}
+		p.couple.Data.Session = *sess
+		p.couple.Status = S3Bucket{BucketName: "data.status", Session: *sess}
+		p.input = input
+		p.lister.seen[test.key] = "fingerprint"
+
+		wait := p.ObjectCreated(test.key)
+		stop()
+		if (wait > 0) != test.wait || wait > time.Minute {
+			t.Errorf("%s: wrong wait %s", test.name, wait)
+		}
+		select {
+		case in := <-input:
+			object, ok := in.(S3Object)
+			if !test.enqueued {
+				t.Errorf("%s: unexpected object in the pipeline", test.name)
+			} else if !ok || object.key != test.key || object.etag != "etag" || object.size != 10 {
+				t.Errorf("%s: wrong object in the pipeline %+v", test.name, in)
+			} else if test.ownerRules && object.owner.ID != "uploader" {
+				t.Errorf("%s: wrong owner %s", test.name, object.owner)
+			}
+		default:
+			if test.enqueued {
+				t.Errorf("%s: the object is not in the pipeline", test.name)
+			}
+		}
+		if _, seen := p.lister.seen[test.key]; seen == test.forgotten {
+			t.Errorf("%s: expected the object to be left to the next listing %t", test.name, test.forgotten)
+		}
+	}
+}
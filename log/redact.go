@@ -0,0 +1,119 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Redacted replaces the secrets in the logs
+const Redacted = "<redacted>"
+
+// fields whose name contains one of these are always masked
+var secretFieldNames = []string{"secret", "password", "passwd", "token", "private"}
+
+var secrets = struct {
+	sync.RWMutex
+	values []string
+}{}
+
+func init() {
+	log.AddHook(redactHook{})
+}
+
+// RegisterSecret makes sure that value never appears in the logs, neither in
+// the message nor in any field
+func RegisterSecret(value string) {
+	// too short values would mask random pieces of the logs
+	if len(value) < 4 {
+		return
+	}
+	secrets.Lock()
+	defer secrets.Unlock()
+	for _, v := range secrets.values {
+		if v == value {
+			return
+		}
+	}
+	secrets.values = append(secrets.values, value)
+}
+
+// ReplaceSecret registers value in place of old, for the secrets that are
+// rotated, like the temporary credentials, that would otherwise pile up
+func ReplaceSecret(old, value string) {
+	if old != value {
+		secrets.Lock()
+		for i, v := range secrets.values {
+			if v == old {
+				secrets.values = append(secrets.values[:i], secrets.values[i+1:]...)
+				break
+			}
+		}
+		secrets.Unlock()
+	}
+	RegisterSecret(value)
+}
+
+// RedactString replaces all the registered secrets in s
+func RedactString(s string) string {
+	secrets.RLock()
+	defer secrets.RUnlock()
+	for _, value := range secrets.values {
+		s = strings.Replace(s, value, Redacted, -1)
+	}
+	return s
+}
+
+// IsSecretField is true if a field with this name holds a secret
+func IsSecretField(name string) bool {
+	name = strings.ToLower(name)
+	for _, secret := range secretFieldNames {
+		if strings.Contains(name, secret) {
+			return true
+		}
+	}
+	return false
+}
+
+type redactHook struct{}
+
+func (redactHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (redactHook) Fire(entry *log.Entry) error {
+	entry.Message = RedactString(entry.Message)
+
+	// the map may be shared with other entries, it is replaced and not
+	// modified
+	data := make(log.Fields, len(entry.Data))
+	for key, value := range entry.Data {
+		if IsSecretField(key) {
+			data[key] = Redacted
+			continue
+		}
+		switch v := value.(type) {
+		case string:
+			data[key] = RedactString(v)
+		case error:
+			if redacted := RedactString(v.Error()); redacted != v.Error() {
+				data[key] = errors.New(redacted)
+			} else {
+				data[key] = v
+			}
+		case fmt.Stringer:
+			if redacted := RedactString(v.String()); redacted != v.String() {
+				data[key] = redacted
+			} else {
+				data[key] = v
+			}
+		default:
+			data[key] = value
+		}
+	}
+	entry.Data = data
+	return nil
+}
@@ -0,0 +1,131 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type stringer string
+
+func (s stringer) String() string { return string(s) }
+
+func TestIsSecretField(t *testing.T) {
+	tests := []struct {
+		name   string
+		secret bool
+	}{
+		{"secret-key", true},
+		{"SecretKey", true},
+		{"password", true},
+		{"Token", true},
+		{"private_key", true},
+		{"access-key", false},
+		{"bucket", false},
+	}
+	for _, test := range tests {
+		if secret := IsSecretField(test.name); secret != test.secret {
+			t.Errorf("%s: expected secret %t, got %t", test.name, test.secret, secret)
+		}
+	}
+}
+
+func TestRegisterSecret(t *testing.T) {
+	RegisterSecret("abc")
+	RegisterSecret("registered-secret")
+	RegisterSecret("registered-secret")
+
+	tests := []struct {
+		in  string
+		out string
+	}{
+		{"key registered-secret used", "key " + Redacted + " used"},
+		{"registered-secret/registered-secret", Redacted + "/" + Redacted},
+		// too short to be registered
+		{"abc", "abc"},
+		{"nothing", "nothing"},
+	}
+	for _, test := range tests {
+		if out := RedactString(test.in); out != test.out {
+			t.Errorf("%q: expected %q, got %q", test.in, test.out, out)
+		}
+	}
+}
+
+// entryRecorder keeps the entries as the formatters see them
+type entryRecorder struct {
+	entries []*log.Entry
+}
+
+func (r *entryRecorder) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (r *entryRecorder) Fire(entry *log.Entry) error {
+	r.entries = append(r.entries, entry)
+	return nil
+}
+
+func TestRedactHook(t *testing.T) {
+	RegisterSecret("hook-secret")
+
+	logger := log.New()
+	logger.Out = ioutil.Discard
+	recorder := &entryRecorder{}
+	logger.AddHook(redactHook{})
+	logger.AddHook(recorder)
+
+	shared := log.Fields{"secret-key": "visible-only-here"}
+	logger.WithFields(shared).
+		WithField("bucket", "uses hook-secret").
+		WithField("error", errors.New("failed with hook-secret")).
+		WithField("stringer", stringer("hook-secret")).
+		WithField("count", 3).
+		Info("message with hook-secret")
+
+	if len(recorder.entries) != 1 {
+		t.Fatalf("expected one entry, got %d", len(recorder.entries))
+	}
+	entry := recorder.entries[0]
+	if entry.Message != "message with "+Redacted {
+		t.Errorf("the message is not redacted: %s", entry.Message)
+	}
+	expected := map[string]string{
+		"secret-key": Redacted,
+		"bucket":     "uses " + Redacted,
+		"error":      "failed with " + Redacted,
+		"stringer":   Redacted,
+		"count":      "3",
+	}
+	for key, value := range expected {
+		if logged := fmt.Sprint(entry.Data[key]); logged != value {
+			t.Errorf("%s: expected %q, got %q", key, value, logged)
+		}
+	}
+	if shared["secret-key"] != "visible-only-here" {
+		t.Errorf("the fields of the caller are modified: %v", shared)
+	}
+}
+
+func TestReplaceSecret(t *testing.T) {
+	RegisterSecret("first-rotated-secret")
+	ReplaceSecret("first-rotated-secret", "second-rotated-secret")
+	ReplaceSecret("", "other-secret")
+
+	tests := []struct {
+		in  string
+		out string
+	}{
+		{"first-rotated-secret", "first-rotated-secret"},
+		{"second-rotated-secret", Redacted},
+		{"other-secret", Redacted},
+	}
+	for _, test := range tests {
+		if out := RedactString(test.in); out != test.out {
+			t.Errorf("%q: expected %q, got %q", test.in, test.out, out)
+		}
+	}
+}